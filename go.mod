@@ -3,12 +3,15 @@ module github.com/inconshreveable/ngrok
 go 1.24
 
 require (
+	github.com/andybalholm/brotli v1.2.0
 	github.com/gorilla/websocket v1.5.3
 	github.com/inconshreveable/go-vhost v1.0.0
 	github.com/inconshreveable/mousetrap v1.1.0
 	github.com/nsf/termbox-go v1.1.1
 	github.com/rcrowley/go-metrics v0.0.0-20201227073835-cf1acfcdf475
+	golang.org/x/crypto v0.36.0
 	golang.org/x/time v0.5.0
+	google.golang.org/protobuf v1.36.6
 	gopkg.in/inconshreveable/go-update.v0 v0.0.0-20150814200126-d8b0b1d421aa
 	gopkg.in/yaml.v1 v1.0.0-20140924161607-9f9df34309c0
 )
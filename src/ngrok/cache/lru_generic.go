@@ -25,6 +25,43 @@ type LRUCacheGeneric[K comparable, V Value] struct {
 
 	// How many bytes we are limiting the cache to
 	capacity uint64
+
+	// How long entries live after they're set, 0 for forever
+	ttl time.Duration
+
+	// Called after entries are evicted for capacity or expire
+	onEvict func(key K, value V, reason EvictReason)
+
+	// Entries evicted while holding mu, passed to onEvict after unlocking
+	evicted []evictedGeneric[K, V]
+
+	hits, misses, evictions, expirations uint64
+}
+
+// EvictReason is why an entry left the cache without being deleted
+type EvictReason int
+
+const (
+	// the cache was over capacity and the entry was the least recently used
+	EvictedCapacity EvictReason = iota
+
+	// the entry's TTL ran out
+	EvictedExpired
+)
+
+func (r EvictReason) String() string {
+	if r == EvictedExpired {
+		return "expired"
+	}
+	return "capacity"
+}
+
+// CacheCounters counts lookups and evictions since the cache was created
+type CacheCounters struct {
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64
+	Expirations uint64
 }
 
 type entryGeneric[K comparable, V Value] struct {
@@ -32,12 +69,24 @@ type entryGeneric[K comparable, V Value] struct {
 	value         V
 	size          int
 	time_accessed time.Time
+
+	// zero if the entry never expires
+	expires time.Time
+}
+
+type evictedGeneric[K comparable, V Value] struct {
+	key    K
+	value  V
+	reason EvictReason
 }
 
 // ItemGeneric represents a key-value pair in the cache
 type ItemGeneric[K comparable, V Value] struct {
 	Key   K
 	Value V
+
+	// zero if the item never expires
+	Expires time.Time
 }
 
 // NewLRUCacheGeneric creates a new generic LRU cache
@@ -49,41 +98,85 @@ func NewLRUCacheGeneric[K comparable, V Value](capacity uint64) *LRUCacheGeneric
 	}
 }
 
-// Get retrieves a value from the cache
-func (lru *LRUCacheGeneric[K, V]) Get(key K) (v V, ok bool) {
+// SetTTL sets how long entries set from now on live, 0 for forever
+func (lru *LRUCacheGeneric[K, V]) SetTTL(ttl time.Duration) {
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
+	lru.ttl = ttl
+}
+
+// OnEvict registers a function called whenever an entry is evicted
+// because the cache is over capacity or it expired. It isn't called for
+// entries which are deleted or cleared.
+func (lru *LRUCacheGeneric[K, V]) OnEvict(fn func(key K, value V, reason EvictReason)) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	lru.onEvict = fn
+}
+
+// Counters returns the hit, miss and eviction statistics
+func (lru *LRUCacheGeneric[K, V]) Counters() CacheCounters {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	return CacheCounters{lru.hits, lru.misses, lru.evictions, lru.expirations}
+}
+
+// Get retrieves a value from the cache, expired entries are removed
+// rather than returned
+func (lru *LRUCacheGeneric[K, V]) Get(key K) (v V, ok bool) {
+	lru.mu.Lock()
+	defer lru.unlock()
 
 	element := lru.table[key]
+	if element != nil && lru.expired(element, time.Now()) {
+		lru.remove(element, EvictedExpired)
+		element = nil
+	}
+
 	if element == nil {
+		lru.misses++
 		var zero V
 		return zero, false
 	}
+
+	lru.hits++
 	lru.moveToFront(element)
 	return element.Value.(*entryGeneric[K, V]).value, true
 }
 
-// Set adds or updates a value in the cache
+// Set adds or updates a value in the cache, it expires after the cache's TTL
 func (lru *LRUCacheGeneric[K, V]) Set(key K, value V) {
 	lru.mu.Lock()
-	defer lru.mu.Unlock()
+	defer lru.unlock()
+	lru.set(key, value, lru.ttl)
+}
 
-	if element := lru.table[key]; element != nil {
-		lru.updateInplace(element, value)
-	} else {
-		lru.addNew(key, value)
-	}
+// SetWithTTL adds or updates a value which expires after ttl, 0 for never
+func (lru *LRUCacheGeneric[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	lru.mu.Lock()
+	defer lru.unlock()
+	lru.set(key, value, ttl)
 }
 
 // SetIfAbsent adds a value only if the key doesn't exist
 func (lru *LRUCacheGeneric[K, V]) SetIfAbsent(key K, value V) {
 	lru.mu.Lock()
-	defer lru.mu.Unlock()
+	defer lru.unlock()
 
-	if element := lru.table[key]; element != nil {
+	element := lru.table[key]
+	if element != nil && lru.expired(element, time.Now()) {
+		lru.remove(element, EvictedExpired)
+		element = nil
+	}
+
+	if element != nil {
 		lru.moveToFront(element)
 	} else {
-		lru.addNew(key, value)
+		var expires time.Time
+		if lru.ttl > 0 {
+			expires = time.Now().Add(lru.ttl)
+		}
+		lru.addNew(key, value, expires)
 	}
 }
 
@@ -116,12 +209,50 @@ func (lru *LRUCacheGeneric[K, V]) Clear() {
 // SetCapacity updates the capacity of the cache
 func (lru *LRUCacheGeneric[K, V]) SetCapacity(capacity uint64) {
 	lru.mu.Lock()
-	defer lru.mu.Unlock()
+	defer lru.unlock()
 
 	lru.capacity = capacity
 	lru.checkCapacity()
 }
 
+// Sweep removes the expired entries and returns how many there were
+func (lru *LRUCacheGeneric[K, V]) Sweep() int {
+	lru.mu.Lock()
+	defer lru.unlock()
+
+	now, swept := time.Now(), 0
+	for e := lru.list.Back(); e != nil; {
+		prev := e.Prev()
+		if lru.expired(e, now) {
+			lru.remove(e, EvictedExpired)
+			swept++
+		}
+		e = prev
+	}
+	return swept
+}
+
+// StartSweeper sweeps the expired entries every interval until stop is called
+func (lru *LRUCacheGeneric[K, V]) StartSweeper(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				lru.Sweep()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
 // Stats returns cache statistics
 func (lru *LRUCacheGeneric[K, V]) Stats() (length, size, capacity uint64, oldest time.Time) {
 	lru.mu.Lock()
@@ -138,7 +269,9 @@ func (lru *LRUCacheGeneric[K, V]) StatsJSON() string {
 		return "{}"
 	}
 	l, s, c, o := lru.Stats()
-	return fmt.Sprintf("{\"Length\": %v, \"Size\": %v, \"Capacity\": %v, \"OldestAccess\": \"%v\"}", l, s, c, o)
+	n := lru.Counters()
+	return fmt.Sprintf("{\"Length\": %v, \"Size\": %v, \"Capacity\": %v, \"OldestAccess\": \"%v\", \"Hits\": %v, \"Misses\": %v, \"Evictions\": %v, \"Expirations\": %v}",
+		l, s, c, o, n.Hits, n.Misses, n.Evictions, n.Expirations)
 }
 
 // Keys returns all keys in the cache
@@ -146,9 +279,12 @@ func (lru *LRUCacheGeneric[K, V]) Keys() []K {
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
 
+	now := time.Now()
 	keys := make([]K, 0, lru.list.Len())
 	for e := lru.list.Front(); e != nil; e = e.Next() {
-		keys = append(keys, e.Value.(*entryGeneric[K, V]).key)
+		if !lru.expired(e, now) {
+			keys = append(keys, e.Value.(*entryGeneric[K, V]).key)
+		}
 	}
 	return keys
 }
@@ -158,14 +294,32 @@ func (lru *LRUCacheGeneric[K, V]) Items() []ItemGeneric[K, V] {
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
 
+	now := time.Now()
 	items := make([]ItemGeneric[K, V], 0, lru.list.Len())
 	for e := lru.list.Front(); e != nil; e = e.Next() {
+		if lru.expired(e, now) {
+			continue
+		}
 		v := e.Value.(*entryGeneric[K, V])
-		items = append(items, ItemGeneric[K, V]{Key: v.key, Value: v.value})
+		items = append(items, ItemGeneric[K, V]{Key: v.key, Value: v.value, Expires: v.expires})
 	}
 	return items
 }
 
+func (lru *LRUCacheGeneric[K, V]) set(key K, value V, ttl time.Duration) {
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+
+	if element := lru.table[key]; element != nil {
+		element.Value.(*entryGeneric[K, V]).expires = expires
+		lru.updateInplace(element, value)
+	} else {
+		lru.addNew(key, value, expires)
+	}
+}
+
 func (lru *LRUCacheGeneric[K, V]) updateInplace(element *list.Element, value V) {
 	valueSize := value.Size()
 	entry := element.Value.(*entryGeneric[K, V])
@@ -182,8 +336,8 @@ func (lru *LRUCacheGeneric[K, V]) moveToFront(element *list.Element) {
 	element.Value.(*entryGeneric[K, V]).time_accessed = time.Now()
 }
 
-func (lru *LRUCacheGeneric[K, V]) addNew(key K, value V) {
-	newEntry := &entryGeneric[K, V]{key, value, value.Size(), time.Now()}
+func (lru *LRUCacheGeneric[K, V]) addNew(key K, value V, expires time.Time) {
+	newEntry := &entryGeneric[K, V]{key, value, value.Size(), time.Now(), expires}
 	element := lru.list.PushFront(newEntry)
 	lru.table[key] = element
 	lru.size += uint64(newEntry.size)
@@ -192,11 +346,47 @@ func (lru *LRUCacheGeneric[K, V]) addNew(key K, value V) {
 
 func (lru *LRUCacheGeneric[K, V]) checkCapacity() {
 	for lru.size > lru.capacity {
-		delElem := lru.list.Back()
-		delValue := delElem.Value.(*entryGeneric[K, V])
-		lru.list.Remove(delElem)
-		delete(lru.table, delValue.key)
-		lru.size -= uint64(delValue.size)
+		lru.remove(lru.list.Back(), EvictedCapacity)
+	}
+}
+
+func (lru *LRUCacheGeneric[K, V]) expired(element *list.Element, now time.Time) bool {
+	expires := element.Value.(*entryGeneric[K, V]).expires
+	return !expires.IsZero() && now.After(expires)
+}
+
+// remove evicts an entry, onEvict is called for it once the lock is released
+func (lru *LRUCacheGeneric[K, V]) remove(element *list.Element, reason EvictReason) {
+	entry := element.Value.(*entryGeneric[K, V])
+	lru.list.Remove(element)
+	delete(lru.table, entry.key)
+	lru.size -= uint64(entry.size)
+
+	if reason == EvictedExpired {
+		lru.expirations++
+	} else {
+		lru.evictions++
+	}
+
+	if lru.onEvict != nil {
+		lru.evicted = append(lru.evicted, evictedGeneric[K, V]{entry.key, entry.value, reason})
+	}
+}
+
+// unlock releases the lock and then calls onEvict for the entries evicted
+// while it was held, so that onEvict may use the cache. Entries are only
+// collected when there's a callback.
+func (lru *LRUCacheGeneric[K, V]) unlock() {
+	evicted, onEvict := lru.evicted, lru.onEvict
+	lru.evicted = nil
+	lru.mu.Unlock()
+
+	if onEvict == nil {
+		return
+	}
+
+	for _, e := range evicted {
+		onEvict(e.key, e.value, e.reason)
 	}
 }
 
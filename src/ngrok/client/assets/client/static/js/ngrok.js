@@ -41,9 +41,11 @@ var hexRepr = function(bytes) {
 }
 
 ngrok.factory("txnSvc", function() {
-    var processBody = function(body, binary) {
-        body.binary = binary;
+    var processBody = function(body) {
+        var binary = body.Binary;
+        body.binary = binary && !body.Message;
         body.isForm = body.ContentType == "application/x-www-form-urlencoded";
+        body.isMultipart = !!body.Parts;
         body.exists = body.Length > 0;
         body.hasError = !!body.Error;
 
@@ -57,8 +59,11 @@ ngrok.factory("txnSvc", function() {
             "application/javascript": "javascript",
         }[body.ContentType];
 
-        // decode body
-        if (binary) {
+        // decode body, protobuf messages are shown as JSON
+        if (!!body.Message) {
+            body.Text = body.Message.Json;
+            syntaxClass = "json";
+        } else if (binary) {
             body.Text = "";
         } else {
             body.Text = Base64.decode(body.Text).text;
@@ -98,7 +103,7 @@ ngrok.factory("txnSvc", function() {
             }
         }
 
-        processBody(req.Body, req.Binary);
+        processBody(req.Body);
     };
 
     var processResp = function(resp) {
@@ -118,7 +123,7 @@ ngrok.factory("txnSvc", function() {
             }
         }
 
-        processBody(resp.Body, resp.Binary);
+        processBody(resp.Body);
     };
 
     var processTxn = function(txn) {
@@ -172,6 +177,13 @@ ngrok.factory("txnSvc", function() {
         all: function() {
             return txns;
         },
+        get: function(id) {
+            for (var i=0; i<txns.length; i++) {
+                if (txns[i].Id == id) {
+                    return txns[i];
+                }
+            }
+        },
         active: function(txn) {
             if (!txn) {
                 return active;
@@ -251,11 +263,27 @@ ngrok.directive({
             '<h6 ng-show="body.exists">' +
                 '{{ body.Length }} bytes ' +
                 '{{ body.RawContentType }}' +
+                '<span ng-show="!!body.Encoding" class="muted"> (decoded from {{ body.EncodedLength }} bytes {{ body.Encoding }})</span>' +
+                '<span ng-show="!!body.Message" class="muted"> as {{ body.Message.Type }}</span>' +
             '</h6>' +
 '' +
-            '<div ng-show="!body.isForm && !body.binary">' +
+            '<div ng-show="!body.isForm && !body.isMultipart && !body.binary">' +
                 '<pre ng-show="body.exists"><code ng-bind-html="body.Text"></code></pre>' +
             '</div>' +
+            '<div ng-show="!!body.Message.Trailers">' +
+                '<h6>gRPC Trailers</h6>' +
+                '<pre>{{ body.Message.Trailers }}</pre>' +
+            '</div>' +
+'' +
+            '<div ng-show="body.isMultipart">' +
+                '<div ng-repeat="part in body.Parts">' +
+                    '<h6>{{ part.Name }}' +
+                        '<span ng-show="!!part.FileName"> &mdash; file {{ part.FileName }}</span>' +
+                        '<span class="muted"> {{ part.Size }} bytes {{ part.ContentType }}</span>' +
+                    '</h6>' +
+                    '<pre ng-show="!part.Binary && part.Size > 0">{{ part.Text }}</pre>' +
+                '</div>' +
+            '</div>' +
 '' +
             '<div ng-show="body.isForm">' +
                 '<keyval title="Form Params" tuples="body.Form">' +
@@ -301,11 +329,78 @@ ngrok.directive({
     }
 });
 
+// split a raw request into the parts which can be edited
+var makeEdit = function(raw) {
+    var headEnd = raw.indexOf("\r\n\r\n");
+    var head = (headEnd < 0 ? raw : raw.substring(0, headEnd)).split("\r\n");
+    var requestLine = head.shift().split(" ");
+    return {
+        Method: requestLine[0],
+        Path: requestLine[1],
+        Headers: head.join("\n"),
+        Body: headEnd < 0 ? "" : raw.substring(headEnd + 4),
+        Target: ""
+    };
+};
+
 ngrok.controller({
+    "Intercepts": function($scope) {
+        $scope.intercepts = [];
+
+        var setIntercepts = function(intercepts) {
+            intercepts.forEach(function(p) {
+                var decoded = Base64.decode(p.Raw);
+                p.RawText = decoded.text;
+                p.edit = makeEdit(decoded.text);
+            });
+            $scope.intercepts = intercepts;
+        };
+
+        $.getJSON("/api/v1/intercepts", function(intercepts) {
+            $scope.$apply(function() { setIntercepts(intercepts); });
+        });
+        $scope.$on("intercepts", function(e, intercepts) { setIntercepts(intercepts); });
+
+        $scope.forward = function(p, edited) {
+            var data = {};
+            if (edited) {
+                data = { method: p.edit.Method, path: p.edit.Path, headers: p.edit.Headers, body: p.edit.Body };
+            }
+            $.ajax({
+                type: "POST",
+                url: "/api/v1/intercepts/" + p.Id + "/forward",
+                data: data,
+                error: function(xhr) {
+                    $scope.$apply(function() { p.error = xhr.responseText; });
+                }
+            });
+        };
+
+        $scope.drop = function(p) {
+            $.ajax({ type: "POST", url: "/api/v1/intercepts/" + p.Id + "/drop" });
+        };
+    },
+
     "HttpTxns": function($scope, txnSvc) {
         $scope.tunnels = window.data.UiState.Tunnels;
+        $scope.upstreams = window.data.UiState.Upstreams || {};
         $scope.txns = txnSvc.all();
 
+        // the health of upstreams changes without any traffic
+        setInterval(function() {
+            $.getJSON("/api/v1/tunnels", function(status) {
+                $scope.$apply(function() {
+                    var upstreams = {};
+                    (status.Tunnels || []).forEach(function(t) {
+                        if (!!t.Upstreams) {
+                            upstreams[t.PublicUrl] = t.Upstreams;
+                        }
+                    });
+                    $scope.upstreams = upstreams;
+                });
+            });
+        }, 5000);
+
         if (!!window.WebSocket) {
             var ws = new WebSocket("ws://" + location.host + "/_ws");
             ws.onopen = function() {
@@ -314,7 +409,12 @@ ngrok.controller({
 
             ws.onmessage = function(message) {
                 $scope.$apply(function() {
-                    txnSvc.add(message.data);
+                    var data = JSON.parse(message.data);
+                    if (!!data.Intercepts) {
+                        $scope.$broadcast("intercepts", data.Intercepts);
+                    } else {
+                        txnSvc.add(message.data);
+                    }
                 });
             };
 
@@ -331,18 +431,48 @@ ngrok.controller({
 
     "HttpRequest": function($scope, txnSvc) {
         $scope.replay = function() {
+            var redacted = txnSvc.active().Req.Redacted;
+            if (!!redacted && !confirm("This request was redacted (" + redacted.join(", ") +
+                    "), the replay will send [REDACTED] in their place. Replay anyway?")) {
+                return;
+            }
             $.ajax({
                 type: "POST",
                 url: "/http/in/replay",
                 data: { txnid: txnSvc.active().Id }
             });
         }
+
+        $scope.replayEdited = function() {
+            $scope.editError = null;
+            $.ajax({
+                type: "POST",
+                url: "/http/in/replay",
+                data: {
+                    txnid: txnSvc.active().Id,
+                    method: $scope.edit.Method,
+                    path: $scope.edit.Path,
+                    headers: $scope.edit.Headers,
+                    body: $scope.edit.Body,
+                    target: $scope.edit.Target
+                },
+                error: function(xhr) {
+                    $scope.$apply(function() {
+                        $scope.editError = xhr.responseText;
+                    });
+                }
+            });
+        }
+
         var setReq = function() {
             var txn = txnSvc.active();
+            $scope.editError = null;
             if (!!txn && txn.Req) {
                 $scope.Req = txnSvc.active().Req;
+                $scope.edit = $scope.Req.Binary ? null : makeEdit($scope.Req.RawText);
             } else {
                 $scope.Req = null;
+                $scope.edit = null;
             }
         };
         $scope.$watch(function() { return txnSvc.active() }, setReq);
@@ -372,6 +502,13 @@ ngrok.controller({
             $scope.Txn = txnSvc.active();
         };
 
+        $scope.showOriginal = function() {
+            var original = txnSvc.get($scope.Txn.ConnCtx.ReplayOf);
+            if (!!original) {
+                txnSvc.active(original);
+            }
+        };
+
         $scope.ISO8601 = function(ts) {
             if (!!ts) {
                 return new Date(ts * 1000).toISOString();
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/inconshreveable/ngrok/src/ngrok/version"
 	"os"
+	"strings"
 )
 
 const usage1 string = `Usage: %s [OPTIONS] <local port or address>
@@ -16,6 +17,7 @@ Examples:
 	ngrok 80
 	ngrok -subdomain=example 8080
 	ngrok -proto=tcp 22
+	ngrok -proto=tcp -inspect=redis 6379
 	ngrok -hostname="example.com" -httpauth="user:password" 10.0.0.1
 
 
@@ -24,6 +26,13 @@ Commands:
 	ngrok start [tunnel] [...]    Start tunnels by name from config file
 	ngork start-all               Start all tunnels defined in config file
 	ngrok list                    List tunnel names from config file
+	ngrok export-har [file]       Save the HTTP traffic of a running ngrok as HAR
+	ngrok replay <txn-id> [--to target]
+	                              Replay a captured request, optionally to another
+	                              port, address, tunnel or url
+	ngrok replay [options] <txn-id> [...] | --har file
+	                              Replay many requests and summarize the results,
+	                              options: --concurrency, --rate, --repeat, --to
 	ngrok help                    Print help
 	ngrok version                 Print ngrok version
 
@@ -31,21 +40,29 @@ Examples:
 	ngrok start www api blog pubsub
 	ngrok -log=stdout -config=ngrok.yml start ssh
 	ngrok start-all
+	ngrok export-har webhooks.har
+	ngrok replay 5fd2b0c1 --to :9090
+	ngrok replay --har webhooks.har --concurrency 8 --repeat 100
 	ngrok version
 
 `
 
 type Options struct {
-	config    string
-	logto     string
-	loglevel  string
-	authtoken string
-	httpauth  string
-	hostname  string
-	protocol  string
-	subdomain string
-	command   string
-	args      []string
+	config        string
+	logto         string
+	loglevel      string
+	authtoken     string
+	httpauth      string
+	hostname      string
+	protocol      string
+	subdomain     string
+	inspect       string
+	har           string
+	history       string
+	replay        replayOptions
+	inspectPublic bool
+	command       string
+	args          []string
 }
 
 func ParseArgs() (opts *Options, err error) {
@@ -95,18 +112,42 @@ func ParseArgs() (opts *Options, err error) {
 		"http+https",
 		"The protocol of the traffic over the tunnel {'http', 'https', 'tcp'} (default: 'http+https')")
 
+	inspect := flag.String(
+		"inspect",
+		"",
+		"Protocol analyzer used to inspect the tunnel's traffic, e.g. 'redis' for tcp tunnels (default: based on -proto)")
+
+	har := flag.String(
+		"har",
+		"",
+		"Save all captured HTTP traffic to this HAR file, rotated when it grows beyond har_max_size")
+
+	history := flag.String(
+		"history",
+		"",
+		"Keep a searchable history of the HTTP traffic in this directory")
+
+	inspectPublic := flag.Bool(
+		"inspect-public",
+		false,
+		"Allow the web interface to listen on a non-loopback inspect_addr")
+
 	flag.Parse()
 
 	opts = &Options{
-		config:    *config,
-		logto:     *logto,
-		loglevel:  *loglevel,
-		httpauth:  *httpauth,
-		subdomain: *subdomain,
-		protocol:  *protocol,
-		authtoken: *authtoken,
-		hostname:  *hostname,
-		command:   flag.Arg(0),
+		config:        *config,
+		logto:         *logto,
+		loglevel:      *loglevel,
+		httpauth:      *httpauth,
+		subdomain:     *subdomain,
+		protocol:      *protocol,
+		authtoken:     *authtoken,
+		hostname:      *hostname,
+		inspect:       *inspect,
+		har:           *har,
+		history:       *history,
+		inspectPublic: *inspectPublic,
+		command:       flag.Arg(0),
 	}
 
 	switch opts.command {
@@ -116,6 +157,12 @@ func ParseArgs() (opts *Options, err error) {
 		opts.args = flag.Args()[1:]
 	case "start-all":
 		opts.args = flag.Args()[1:]
+	case "export-har":
+		opts.args = flag.Args()[1:]
+	case "replay":
+		if opts.args, opts.replay, err = parseReplayArgs(flag.Args()[1:]); err != nil {
+			return
+		}
 	case "version":
 		fmt.Println(version.MajorMinor())
 		os.Exit(0)
@@ -142,3 +189,65 @@ func ParseArgs() (opts *Options, err error) {
 
 	return
 }
+
+type replayOptions struct {
+	to          string
+	har         string
+	concurrency int
+	rate        float64
+	repeat      int
+}
+
+// parses the arguments of the replay command, which takes its flags
+// before, between or after the transaction ids
+func parseReplayArgs(args []string) (txnIds []string, opts replayOptions, err error) {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.StringVar(
+		&opts.to,
+		"to",
+		"",
+		"Replay to this port, address, tunnel name or url instead of the original tunnel's local address")
+
+	flags.StringVar(
+		&opts.har,
+		"har",
+		"",
+		"Replay the requests of this HAR file")
+
+	flags.IntVar(
+		&opts.concurrency,
+		"concurrency",
+		1,
+		"Number of requests to replay at the same time")
+
+	flags.Float64Var(
+		&opts.rate,
+		"rate",
+		0,
+		"Maximum number of requests to start per second (default: no limit)")
+
+	flags.IntVar(
+		&opts.repeat,
+		"repeat",
+		1,
+		"Number of times to replay the requests")
+
+	for len(args) > 0 {
+		if !strings.HasPrefix(args[0], "-") {
+			txnIds = append(txnIds, args[0])
+			args = args[1:]
+			continue
+		}
+
+		if err = flags.Parse(args); err != nil {
+			return
+		}
+		args = flags.Args()
+	}
+	return
+}
+
+// whether to replay many requests instead of a single one
+func (opts replayOptions) bulk(txnIds []string) bool {
+	return len(txnIds) != 1 || opts.har != "" || opts.concurrency > 1 || opts.rate > 0 || opts.repeat > 1
+}
@@ -3,36 +3,237 @@ package client
 import (
 	"fmt"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"os/user"
 	"path"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v1"
 
+	"github.com/inconshreveable/ngrok/src/ngrok/client/intercept"
+	"github.com/inconshreveable/ngrok/src/ngrok/client/redact"
+	"github.com/inconshreveable/ngrok/src/ngrok/client/upstream"
+	"github.com/inconshreveable/ngrok/src/ngrok/errpage"
+	"github.com/inconshreveable/ngrok/src/ngrok/httpauth"
+	"github.com/inconshreveable/ngrok/src/ngrok/ipfilter"
 	"github.com/inconshreveable/ngrok/src/ngrok/log"
+	"github.com/inconshreveable/ngrok/src/ngrok/proto"
 )
 
 type Configuration struct {
 	HttpProxy          string                          `yaml:"http_proxy,omitempty"`
 	ServerAddr         string                          `yaml:"server_addr,omitempty"`
 	InspectAddr        string                          `yaml:"inspect_addr,omitempty"`
+	InspectAuth        string                          `yaml:"inspect_auth,omitempty"`
+	InspectToken       string                          `yaml:"inspect_token,omitempty"`
+	InspectPublic      bool                            `yaml:"inspect_public,omitempty"`
+	InspectHosts       []string                        `yaml:"inspect_hosts,omitempty"`
 	TrustHostRootCerts bool                            `yaml:"trust_host_root_certs,omitempty"`
 	AuthToken          string                          `yaml:"auth_token,omitempty"`
 	Tunnels            map[string]*TunnelConfiguration `yaml:"tunnels,omitempty"`
+	HarFile            string                          `yaml:"har_file,omitempty"`
+	HarMaxSize         int64                           `yaml:"har_max_size,omitempty"`
+	HistoryDir         string                          `yaml:"history_dir,omitempty"`
+	HistoryMaxRequests int                             `yaml:"history_max_requests,omitempty"`
+	HistoryMaxAge      string                          `yaml:"history_max_age,omitempty"`
+	HistoryRetention   time.Duration                   `yaml:"-"`
+	Redact             *RedactConfiguration            `yaml:"redact,omitempty"`
+	Protobuf           *ProtobufConfiguration          `yaml:"protobuf,omitempty"`
 	LogTo              string                          `yaml:"-"`
 	Path               string                          `yaml:"-"`
 }
 
+// rules for redacting sensitive data in captured HTTP traffic
+type RedactConfiguration struct {
+	Headers    []string `yaml:"headers,omitempty"`
+	JsonPaths  []string `yaml:"json_paths,omitempty"`
+	FormFields []string `yaml:"form_fields,omitempty"`
+	Patterns   []string `yaml:"patterns,omitempty"`
+}
+
+func (rc *RedactConfiguration) redactor() (*redact.Redactor, error) {
+	return redact.New(redact.Rules{
+		Headers:    rc.Headers,
+		JsonPaths:  rc.JsonPaths,
+		FormFields: rc.FormFields,
+		Patterns:   rc.Patterns,
+	})
+}
+
+// decoding of protobuf bodies in the web interface
+type ProtobufConfiguration struct {
+	// written by protoc --include_imports --descriptor_set_out
+	DescriptorSet string `yaml:"descriptor_set,omitempty"`
+
+	// message types of request paths, for bodies which don't name theirs
+	Messages map[string]string `yaml:"messages,omitempty"`
+}
+
 type TunnelConfiguration struct {
-	Subdomain  string            `yaml:"subdomain,omitempty"`
-	Hostname   string            `yaml:"hostname,omitempty"`
-	Protocols  map[string]string `yaml:"proto,omitempty"`
-	HttpAuth   string            `yaml:"auth,omitempty"`
-	RemotePort uint16            `yaml:"remote_port,omitempty"`
+	Subdomain  string               `yaml:"subdomain,omitempty"`
+	Hostname   string               `yaml:"hostname,omitempty"`
+	Protocols  map[string]string    `yaml:"proto,omitempty"`
+	HttpAuth   string               `yaml:"auth,omitempty"`
+	AuthUsers  []string             `yaml:"auth_users,omitempty"`
+	RemotePort uint16               `yaml:"remote_port,omitempty"`
+	Inspect    string               `yaml:"inspect,omitempty"`
+	Rules      []*RuleConfiguration `yaml:"rules,omitempty"`
+	Intercept  []*intercept.Rule    `yaml:"-"`
+
+	// share the public url with other clients using the same auth token
+	// and pool name
+	Pool       string `yaml:"pool,omitempty"`
+	PoolPolicy string `yaml:"pool_policy,omitempty"`
+
+	// IP addresses and CIDR networks which may, or may not, connect
+	IpAllow []string `yaml:"ip_allow,omitempty"`
+	IpDeny  []string `yaml:"ip_deny,omitempty"`
+
+	// more local addresses to forward to besides the one in proto
+	Upstream *UpstreamConfiguration `yaml:"upstream,omitempty"`
+
+	// version of the PROXY protocol header sent to the local service, 0
+	// to send none
+	ProxyProtocol int `yaml:"proxy_protocol,omitempty"`
+
+	// an HTML template shown when the local service can't be reached
+	OfflinePage string        `yaml:"offline_page,omitempty"`
+	Offline     *errpage.Page `yaml:"-"`
+}
+
+// the user:password credentials of a tunnel's http auth
+func (tc *TunnelConfiguration) httpAuth() []string {
+	if tc.HttpAuth == "" {
+		return tc.AuthUsers
+	}
+	return append([]string{tc.HttpAuth}, tc.AuthUsers...)
+}
+
+// checks that the http auth credentials of a tunnel can be hashed
+func validateHttpAuth(t *TunnelConfiguration, tunnelName string) error {
+	credentials := t.httpAuth()
+	if len(credentials) > httpauth.MaxCredentials {
+		return fmt.Errorf("Tunnel %s has %d http auth credentials, at most %d are allowed", tunnelName, len(credentials), httpauth.MaxCredentials)
+	}
+
+	for _, userPassword := range credentials {
+		if err := httpauth.Validate(userPassword); err != nil {
+			return fmt.Errorf("Invalid http auth of tunnel %s: %v", tunnelName, err)
+		}
+	}
+	return nil
+}
+
+type UpstreamConfiguration struct {
+	Addrs       []string                  `yaml:"addrs,omitempty"`
+	Policy      string                    `yaml:"policy,omitempty"`
+	HealthCheck *HealthCheckConfiguration `yaml:"health_check,omitempty"`
+	Check       upstream.HealthCheck      `yaml:"-"`
+}
+
+type HealthCheckConfiguration struct {
+	Path     string `yaml:"path,omitempty"`
+	Interval string `yaml:"interval,omitempty"`
+	Timeout  string `yaml:"timeout,omitempty"`
+}
+
+// normalizes the addresses and parses the health check of the upstreams
+// of a tunnel
+func (uc *UpstreamConfiguration) validate(tunnelName string) (err error) {
+	if len(uc.Addrs) == 0 {
+		return fmt.Errorf("Tunnel %s has an upstream section without addrs", tunnelName)
+	}
+
+	for i, addr := range uc.Addrs {
+		if uc.Addrs[i], err = normalizeAddress(addr, "for the upstreams of tunnel "+tunnelName); err != nil {
+			return
+		}
+	}
+
+	if hc := uc.HealthCheck; hc != nil {
+		uc.Check.Path = hc.Path
+		if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+			return fmt.Errorf("The health check path of tunnel %s must start with /", tunnelName)
+		}
+
+		if hc.Interval != "" {
+			if uc.Check.Interval, err = time.ParseDuration(hc.Interval); err != nil || uc.Check.Interval <= 0 {
+				return fmt.Errorf("Invalid health check interval '%s' for tunnel %s", hc.Interval, tunnelName)
+			}
+		}
+
+		if hc.Timeout != "" {
+			if uc.Check.Timeout, err = time.ParseDuration(hc.Timeout); err != nil || uc.Check.Timeout <= 0 {
+				return fmt.Errorf("Invalid health check timeout '%s' for tunnel %s", hc.Timeout, tunnelName)
+			}
+		}
+	}
+
+	_, err = upstream.NewPool(uc.Addrs, uc.Policy, uc.Check)
+	return
+}
+
+// a mock response or interception of the requests to a tunnel
+type RuleConfiguration struct {
+	Method    string                     `yaml:"method,omitempty"`
+	Path      string                     `yaml:"path,omitempty"`
+	Headers   map[string]string          `yaml:"headers,omitempty"`
+	Respond   *MockResponseConfiguration `yaml:"respond,omitempty"`
+	Offline   bool                       `yaml:"offline,omitempty"`
+	Intercept bool                       `yaml:"intercept,omitempty"`
+}
+
+type MockResponseConfiguration struct {
+	Status  int               `yaml:"status,omitempty"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+	Body    string            `yaml:"body,omitempty"`
+
+	// read the body from a file, relative to the configuration file
+	BodyFile string `yaml:"body_file,omitempty"`
+}
+
+func (rc *RuleConfiguration) rule(configPath string) (*intercept.Rule, error) {
+	r := &intercept.Rule{
+		Method:    rc.Method,
+		Path:      rc.Path,
+		Headers:   rc.Headers,
+		Offline:   rc.Offline,
+		Intercept: rc.Intercept,
+	}
+
+	if mock := rc.Respond; mock != nil {
+		r.Respond = &intercept.Response{Status: mock.Status, Header: make(http.Header), Body: []byte(mock.Body)}
+		if r.Respond.Status == 0 {
+			r.Respond.Status = 200
+		}
+
+		for name, value := range mock.Headers {
+			r.Respond.Header.Set(name, value)
+		}
+
+		if mock.BodyFile != "" {
+			var err error
+			if r.Respond.Body, err = os.ReadFile(configRelative(configPath, mock.BodyFile)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return r, r.Validate()
+}
+
+// resolves a path given in the configuration file relative to the file
+func configRelative(configPath, file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(filepath.Dir(configPath), file)
 }
 
 func LoadConfiguration(opts *Options) (config *Configuration, err error) {
@@ -81,11 +282,56 @@ func LoadConfiguration(opts *Options) (config *Configuration, err error) {
 		config.HttpProxy = os.Getenv("http_proxy")
 	}
 
+	if config.HarMaxSize == 0 {
+		config.HarMaxSize = defaultHarMaxSize
+	}
+
+	if config.HistoryMaxRequests == 0 {
+		config.HistoryMaxRequests = defaultHistoryMaxRequests
+	}
+
+	if config.HistoryMaxAge == "" {
+		config.HistoryMaxAge = defaultHistoryMaxAge
+	}
+
 	// validate and normalize configuration
+	if config.HistoryRetention, err = time.ParseDuration(config.HistoryMaxAge); err != nil {
+		err = fmt.Errorf("Invalid history_max_age '%s': %w", config.HistoryMaxAge, err)
+		return
+	}
+
 	if config.InspectAddr != "disabled" {
 		if config.InspectAddr, err = normalizeAddress(config.InspectAddr, "inspect_addr"); err != nil {
 			return
 		}
+
+		if opts.inspectPublic {
+			config.InspectPublic = true
+		}
+
+		// the interface exposes captured traffic and replay, don't
+		// let it be reached from other machines by accident
+		if !config.InspectPublic && !isLoopbackAddr(config.InspectAddr) {
+			err = fmt.Errorf("Refusing to serve the web interface on the non-loopback address %s, "+
+				"set inspect_public or pass -inspect-public to allow it", config.InspectAddr)
+			return
+		}
+	}
+
+	if config.Redact != nil {
+		if _, err = config.Redact.redactor(); err != nil {
+			return
+		}
+	}
+
+	if config.Protobuf != nil && config.Protobuf.DescriptorSet == "" {
+		err = fmt.Errorf("Invalid protobuf configuration, descriptor_set is required")
+		return
+	}
+
+	if config.InspectAuth != "" && !strings.Contains(config.InspectAuth, ":") {
+		err = fmt.Errorf("Invalid inspect_auth, expected 'user:password'")
+		return
 	}
 
 	if config.ServerAddr, err = normalizeAddress(config.ServerAddr, "server_addr"); err != nil {
@@ -119,6 +365,77 @@ func LoadConfiguration(opts *Options) (config *Configuration, err error) {
 			if err = validateProtocol(k, tunnelName); err != nil {
 				return
 			}
+
+			if err = validateAnalyzers(k, t.Inspect, t.Protocols[k], tunnelName); err != nil {
+				return
+			}
+		}
+
+		for i, rc := range t.Rules {
+			if _, ok := t.Protocols["http"]; !ok {
+				if _, ok := t.Protocols["https"]; !ok {
+					err = fmt.Errorf("Tunnel %s has rules, but only http tunnels can have them", name)
+					return
+				}
+			}
+
+			// paused requests are resumed from the web inspector, without it
+			// they'd hang until they time out
+			if rc.Intercept && config.InspectAddr == "disabled" {
+				err = fmt.Errorf("Rule %d of tunnel %s intercepts requests, which needs the web inspector, but inspect_addr is disabled", i+1, name)
+				return
+			}
+
+			var rule *intercept.Rule
+			if rule, err = rc.rule(configPath); err != nil {
+				err = fmt.Errorf("Invalid rule %d of tunnel %s: %v", i+1, name, err)
+				return
+			}
+			t.Intercept = append(t.Intercept, rule)
+		}
+
+		if _, ok := t.Protocols["udp"]; ok && t.Upstream != nil {
+			err = fmt.Errorf("Tunnel %s forwards udp, which can't have upstreams", name)
+			return
+		}
+
+		if t.Upstream != nil {
+			if err = t.Upstream.validate(name); err != nil {
+				return
+			}
+		}
+
+		if err = validateHttpAuth(t, name); err != nil {
+			return
+		}
+
+		if _, err = ipfilter.New(t.IpAllow, t.IpDeny); err != nil {
+			err = fmt.Errorf("Invalid ip_allow or ip_deny of tunnel %s: %v", name, err)
+			return
+		}
+
+		if t.ProxyProtocol != 0 {
+			if t.ProxyProtocol != 1 && t.ProxyProtocol != 2 {
+				err = fmt.Errorf("Invalid proxy_protocol %d of tunnel %s, use 1 or 2", t.ProxyProtocol, name)
+				return
+			}
+
+			if _, ok := t.Protocols["udp"]; ok {
+				err = fmt.Errorf("Tunnel %s forwards udp, which can't have a proxy_protocol", name)
+				return
+			}
+		}
+
+		if t.PoolPolicy != "" && t.Pool == "" {
+			err = fmt.Errorf("Tunnel %s has a pool_policy, but no pool", name)
+			return
+		}
+
+		if t.OfflinePage != "" {
+			if t.Offline, err = errpage.Load(502, configRelative(configPath, t.OfflinePage)); err != nil {
+				err = fmt.Errorf("Invalid offline_page of tunnel %s: %v", name, err)
+				return
+			}
 		}
 
 		// use the name of the tunnel as the subdomain if none is specified
@@ -139,6 +456,12 @@ func LoadConfiguration(opts *Options) (config *Configuration, err error) {
 	if opts.authtoken != "" {
 		config.AuthToken = opts.authtoken
 	}
+	if opts.har != "" {
+		config.HarFile = opts.har
+	}
+	if opts.history != "" {
+		config.HistoryDir = opts.history
+	}
 
 	switch opts.command {
 	// start a single tunnel, the default, simple ngrok behavior
@@ -148,19 +471,28 @@ func LoadConfiguration(opts *Options) (config *Configuration, err error) {
 			Subdomain: opts.subdomain,
 			Hostname:  opts.hostname,
 			HttpAuth:  opts.httpauth,
+			Inspect:   opts.inspect,
 			Protocols: make(map[string]string),
 		}
 
-		for _, proto := range strings.Split(opts.protocol, "+") {
-			if err = validateProtocol(proto, "default"); err != nil {
+		for _, p := range strings.Split(opts.protocol, "+") {
+			if err = validateProtocol(p, "default"); err != nil {
+				return
+			}
+
+			if config.Tunnels["default"].Protocols[p], err = normalizeAddress(opts.args[0], ""); err != nil {
 				return
 			}
 
-			if config.Tunnels["default"].Protocols[proto], err = normalizeAddress(opts.args[0], ""); err != nil {
+			if err = validateAnalyzers(p, opts.inspect, config.Tunnels["default"].Protocols[p], "default"); err != nil {
 				return
 			}
 		}
 
+		if err = validateHttpAuth(config.Tunnels["default"], "default"); err != nil {
+			return
+		}
+
 	// list tunnels
 	case "list":
 		for name, _ := range config.Tunnels {
@@ -194,6 +526,30 @@ func LoadConfiguration(opts *Options) (config *Configuration, err error) {
 	case "start-all":
 		return
 
+	// replay a request captured by a running client
+	case "replay":
+		var inspect *inspectClient
+		if inspect, err = newInspectClient(config); err != nil {
+			return
+		}
+
+		if err = replayRequests(inspect, opts.args, opts.replay); err != nil {
+			return
+		}
+		os.Exit(0)
+
+	// save the traffic captured by a running client
+	case "export-har":
+		var inspect *inspectClient
+		if inspect, err = newInspectClient(config); err != nil {
+			return
+		}
+
+		if err = exportHar(inspect, opts.args); err != nil {
+			return
+		}
+		os.Exit(0)
+
 	default:
 		err = fmt.Errorf("Unknown command: %s", opts.command)
 		return
@@ -217,6 +573,21 @@ func defaultPath() string {
 	return path.Join(homeDir, ".ngrok")
 }
 
+// whether an address only accepts connections from this machine
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 func normalizeAddress(addr string, propName string) (string, error) {
 	// normalize port to address
 	if _, err := strconv.Atoi(addr); err == nil {
@@ -235,16 +606,54 @@ func normalizeAddress(addr string, propName string) (string, error) {
 	return fmt.Sprintf("%s:%s", host, port), nil
 }
 
-func validateProtocol(proto, propName string) (err error) {
-	switch proto {
-	case "http", "https", "http+https", "tcp":
-	default:
-		err = fmt.Errorf("Invalid protocol for %s: %s", propName, proto)
+func validateProtocol(tunnelProto, propName string) (err error) {
+	if proto.ValidTunnelProtocol(tunnelProto) != nil {
+		err = fmt.Errorf("Invalid protocol for %s: %s", propName, tunnelProto)
 	}
 
 	return
 }
 
+// returns the analyzer which inspects the traffic of a tunnel protocol, either
+// the one selected by name in the configuration or the protocol's default
+func selectAnalyzer(tunnelProto, inspect string) (r proto.Registration, err error) {
+	var ok bool
+	if inspect == "" {
+		if r, ok = proto.DefaultFor(tunnelProto); !ok {
+			err = fmt.Errorf("no analyzer registered for protocol %s", tunnelProto)
+		}
+		return
+	}
+
+	if r, ok = proto.Lookup(inspect); !ok {
+		err = fmt.Errorf("unknown protocol analyzer %s", inspect)
+	} else if !r.Supports(tunnelProto) {
+		err = fmt.Errorf("protocol analyzer %s can't inspect %s tunnels", inspect, tunnelProto)
+	}
+	return
+}
+
+// checks that the analyzers which will inspect the tunnel's traffic exist and
+// runs their configuration validation hooks
+func validateAnalyzers(tunnelProto, inspect, localAddr, propName string) error {
+	for _, p := range strings.Split(tunnelProto, "+") {
+		r, err := selectAnalyzer(p, inspect)
+		if err != nil {
+			return fmt.Errorf("Invalid configuration %s: %v", propName, err)
+		}
+
+		if r.Validate == nil {
+			continue
+		}
+
+		if err = r.Validate(p, localAddr); err != nil {
+			return fmt.Errorf("Invalid configuration %s: %v", propName, err)
+		}
+	}
+
+	return nil
+}
+
 func SaveAuthToken(configPath, authtoken string) (err error) {
 	// empty configuration by default for the case that we can't read it
 	c := new(Configuration)
@@ -2,7 +2,9 @@ package client
 
 import (
 	"fmt"
+	"github.com/inconshreveable/ngrok/src/ngrok/client/decode"
 	"github.com/inconshreveable/ngrok/src/ngrok/client/mvc"
+	"github.com/inconshreveable/ngrok/src/ngrok/client/store"
 	"github.com/inconshreveable/ngrok/src/ngrok/client/views/term"
 	"github.com/inconshreveable/ngrok/src/ngrok/client/views/web"
 	"github.com/inconshreveable/ngrok/src/ngrok/log"
@@ -19,11 +21,8 @@ type cmdQuit struct {
 }
 
 type cmdPlayRequest struct {
-	// the tunnel to play this request over
-	tunnel mvc.Tunnel
-
-	// the bytes of the request to issue
-	payload []byte
+	// the request to play and where to play it
+	replay mvc.Replay
 }
 
 // The MVC Controller
@@ -79,8 +78,8 @@ func (ctl *Controller) Shutdown(message string) {
 	ctl.cmds <- cmdQuit{message: message}
 }
 
-func (ctl *Controller) PlayRequest(tunnel mvc.Tunnel, payload []byte) {
-	ctl.cmds <- cmdPlayRequest{tunnel: tunnel, payload: payload}
+func (ctl *Controller) PlayRequest(replay mvc.Replay) {
+	ctl.cmds <- cmdPlayRequest{replay: replay}
 }
 
 func (ctl *Controller) Go(fn func()) {
@@ -158,8 +157,22 @@ func (ctl *Controller) Run(config *Configuration) {
 	// init web ui
 	var webView *web.WebView
 	if config.InspectAddr != "disabled" {
-		webView = web.NewWebView(ctl, config.InspectAddr)
+		webView = web.NewWebView(ctl, config.InspectAddr, web.Access{
+			BasicAuth: config.InspectAuth,
+			Token:     config.InspectToken,
+			Hosts:     config.InspectHosts,
+			Public:    config.InspectPublic,
+		})
 		ctl.AddView(webView)
+		webView.ServeIntercepts(model.intercepts)
+
+		if pb := config.Protobuf; pb != nil {
+			if p, err := decode.LoadProtobuf(pb.DescriptorSet, pb.Messages); err != nil {
+				ctl.Error("Failed to load protobuf descriptors: %v", err)
+			} else {
+				webView.DecodeProtobuf(p)
+			}
+		}
 	}
 
 	// init term ui
@@ -169,17 +182,39 @@ func (ctl *Controller) Run(config *Configuration) {
 		ctl.AddView(termView)
 	}
 
-	for _, protocol := range model.GetProtocols() {
-		switch p := protocol.(type) {
-		case *proto.Http:
-			if termView != nil {
-				ctl.AddView(termView.NewHttpView(p))
+	// init the views of each protocol analyzer that has them
+	for _, p := range model.GetProtocols() {
+		if termView != nil {
+			if v := termView.NewProtocolView(p); v != nil {
+				ctl.AddView(v)
 			}
+		}
 
+		if webView != nil {
+			if v := webView.NewProtocolView(p); v != nil {
+				ctl.AddView(v)
+			}
+		}
+	}
+
+	// save http traffic
+	httpProto := httpProtocol(model)
+	if config.HarFile != "" && httpProto != nil {
+		if harView, err := NewHarView(ctl, httpProto, config.HarFile, config.HarMaxSize); err != nil {
+			ctl.Error("Failed to open HAR file %s: %v", config.HarFile, err)
+		} else {
+			ctl.AddView(harView)
+		}
+	}
+
+	if config.HistoryDir != "" && httpProto != nil {
+		if history, err := store.Open(config.HistoryDir, config.HistoryMaxRequests, config.HistoryRetention); err != nil {
+			ctl.Error("Failed to open request history in %s: %v", config.HistoryDir, err)
+		} else {
+			ctl.AddView(NewHistoryView(ctl, httpProto, history))
 			if webView != nil {
-				ctl.AddView(webView.NewHttpView(p))
+				webView.ServeHistory(history)
 			}
-		default:
 		}
 	}
 
@@ -203,7 +238,7 @@ func (ctl *Controller) Run(config *Configuration) {
 				}()
 
 			case cmdPlayRequest:
-				ctl.Go(func() { ctl.model.PlayRequest(cmd.tunnel, cmd.payload) })
+				ctl.Go(func() { ctl.model.PlayRequest(cmd.replay) })
 			}
 
 		case obj := <-updates:
@@ -215,3 +250,13 @@ func (ctl *Controller) Run(config *Configuration) {
 		}
 	}
 }
+
+// the http protocol analyzer, if the model has one
+func httpProtocol(model *ClientModel) *proto.Http {
+	for _, p := range model.GetProtocols() {
+		if httpProto, ok := p.(*proto.Http); ok {
+			return httpProto
+		}
+	}
+	return nil
+}
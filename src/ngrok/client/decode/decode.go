@@ -0,0 +1,126 @@
+// Decoders for the bodies of captured HTTP traffic
+//
+// The inspector shows bodies the way the application sees them rather than
+// as they were sent on the wire: content encodings are undone, multipart
+// forms are split into their parts and protobuf messages are decoded to
+// JSON when a descriptor set describes them.
+package decode
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+)
+
+// decoded bodies larger than this are truncated, so that a small
+// compressed body can't exhaust the client's memory
+const maxDecodedSize = 10 * 1024 * 1024
+
+// ContentEncoding undoes the codings listed in a Content-Encoding header,
+// in the reverse of the order they were applied. It returns an error for
+// unknown codings and corrupt data.
+func ContentEncoding(encoding string, body []byte) ([]byte, error) {
+	codings := strings.Split(encoding, ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := strings.ToLower(strings.TrimSpace(codings[i]))
+
+		var r io.Reader
+		var err error
+		switch coding {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip":
+			r, err = gzip.NewReader(bytes.NewReader(body))
+		case "deflate":
+			r, err = deflateReader(body)
+		case "br":
+			r = brotli.NewReader(bytes.NewReader(body))
+		default:
+			return nil, fmt.Errorf("Unsupported content encoding '%s'", coding)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode %s body: %v", coding, err)
+		}
+
+		if body, err = io.ReadAll(io.LimitReader(r, maxDecodedSize)); err != nil {
+			return nil, fmt.Errorf("Failed to decode %s body: %v", coding, err)
+		}
+	}
+	return body, nil
+}
+
+// deflate is supposed to be zlib wrapped, but plenty of servers send a
+// raw deflate stream instead
+func deflateReader(body []byte) (io.Reader, error) {
+	if r, err := zlib.NewReader(bytes.NewReader(body)); err == nil {
+		return r, nil
+	}
+	return flate.NewReader(bytes.NewReader(body)), nil
+}
+
+type Part struct {
+	Name        string
+	FileName    string
+	ContentType string
+	Header      http.Header
+	Size        int
+
+	// the content of text parts, empty for binary parts
+	Text   string
+	Binary bool
+}
+
+// Multipart splits a multipart body into its parts, contentType must have
+// the boundary parameter
+func Multipart(contentType string, body []byte) ([]Part, error) {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	boundary := params["boundary"]
+	if boundary == "" {
+		return nil, fmt.Errorf("Multipart body without a boundary")
+	}
+
+	parts := make([]Part, 0)
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			return parts, nil
+		} else if err != nil {
+			return parts, err
+		}
+
+		content, err := io.ReadAll(p)
+		if err != nil {
+			return parts, err
+		}
+
+		part := Part{
+			Name:        p.FormName(),
+			FileName:    p.FileName(),
+			ContentType: p.Header.Get("Content-Type"),
+			Header:      http.Header(p.Header),
+			Size:        len(content),
+			Binary:      !utf8.Valid(content),
+		}
+
+		if !part.Binary {
+			part.Text = string(content)
+		}
+		parts = append(parts, part)
+	}
+}
@@ -0,0 +1,216 @@
+package decode
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"mime"
+	"os"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Protobuf decodes protobuf bodies with the message types of a descriptor
+// set, as written by protoc --include_imports --descriptor_set_out
+type Protobuf struct {
+	files *protoregistry.Files
+
+	// message types of request paths, for bodies which don't name theirs
+	messages map[string]protoreflect.MessageDescriptor
+}
+
+// the decoded messages of a body
+type Message struct {
+	Type string
+
+	// the messages as indented JSON, one per gRPC frame
+	Json string
+
+	// gRPC-web trailers, which are sent at the end of the response body
+	Trailers string
+}
+
+// LoadProtobuf reads a descriptor set file. messages maps request paths to
+// the fully qualified message type of their request and response bodies, a
+// path ending in '/' matches every path below it.
+func LoadProtobuf(descriptorSet string, messages map[string]string) (*Protobuf, error) {
+	b, err := os.ReadFile(descriptorSet)
+	if err != nil {
+		return nil, err
+	}
+
+	var set descriptorpb.FileDescriptorSet
+	if err = proto.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("Invalid descriptor set %s: %v", descriptorSet, err)
+	}
+
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid descriptor set %s: %v", descriptorSet, err)
+	}
+
+	p := &Protobuf{files: files, messages: make(map[string]protoreflect.MessageDescriptor)}
+	for path, name := range messages {
+		md, err := p.message(name)
+		if err != nil {
+			return nil, err
+		}
+		p.messages[path] = md
+	}
+	return p, nil
+}
+
+func (p *Protobuf) message(name string) (protoreflect.MessageDescriptor, error) {
+	d, err := p.files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, fmt.Errorf("Unknown protobuf message type '%s'", name)
+	}
+
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("'%s' is not a protobuf message type", name)
+	}
+	return md, nil
+}
+
+// Decode decodes a request body, or a response body if response is set.
+// It returns nil if the body isn't protobuf or its message type is
+// unknown, and an error if it can't be decoded.
+func (p *Protobuf) Decode(contentType, path string, response bool, body []byte) (*Message, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, nil
+	}
+
+	var grpc, text bool
+	switch mediaType {
+	case "application/grpc", "application/grpc+proto", "application/grpc-web", "application/grpc-web+proto":
+		grpc = true
+	case "application/grpc-web-text", "application/grpc-web-text+proto":
+		grpc, text = true, true
+	case "application/protobuf", "application/x-protobuf", "application/vnd.google.protobuf":
+	default:
+		return nil, nil
+	}
+
+	md := p.messageType(params, path, response)
+	if md == nil {
+		return nil, nil
+	}
+
+	if text {
+		if body, err = base64.StdEncoding.DecodeString(string(body)); err != nil {
+			return nil, fmt.Errorf("Invalid grpc-web-text body: %v", err)
+		}
+	}
+
+	msg := &Message{Type: string(md.FullName())}
+	if !grpc {
+		msg.Json, err = toJson(md, body)
+		return msg, err
+	}
+
+	// gRPC messages are framed by a flags byte and a 4 byte length, the
+	// high bit of the flags marks a gRPC-web trailers frame
+	var messages []string
+	for len(body) > 0 {
+		if len(body) < 5 {
+			return nil, fmt.Errorf("Truncated gRPC frame")
+		}
+
+		flags, length := body[0], binary.BigEndian.Uint32(body[1:5])
+		if uint64(len(body)-5) < uint64(length) {
+			return nil, fmt.Errorf("Truncated gRPC frame")
+		}
+		frame := body[5 : 5+length]
+		body = body[5+length:]
+
+		switch {
+		case flags&0x80 != 0:
+			msg.Trailers += string(frame)
+		case flags&0x01 != 0:
+			return nil, fmt.Errorf("Compressed gRPC messages can't be decoded")
+		default:
+			json, err := toJson(md, frame)
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, json)
+		}
+	}
+
+	msg.Json = strings.Join(messages, "\n")
+	return msg, nil
+}
+
+// the message type named by the content type, configured for the path
+// or, for gRPC, given by the method's signature
+func (p *Protobuf) messageType(params map[string]string, path string, response bool) protoreflect.MessageDescriptor {
+	for _, param := range []string{"proto", "messagetype"} {
+		if name := params[param]; name != "" {
+			if md, err := p.message(name); err == nil {
+				return md
+			}
+		}
+	}
+
+	if md, ok := p.messages[path]; ok {
+		return md
+	}
+
+	var longest string
+	for prefix := range p.messages {
+		if strings.HasSuffix(prefix, "/") && strings.HasPrefix(path, prefix) && len(prefix) > len(longest) {
+			longest = prefix
+		}
+	}
+	if longest != "" {
+		return p.messages[longest]
+	}
+
+	// gRPC paths are /package.Service/Method
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) != 2 {
+		return nil
+	}
+
+	d, err := p.files.FindDescriptorByName(protoreflect.FullName(parts[0]))
+	if err != nil {
+		return nil
+	}
+
+	service, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil
+	}
+
+	method := service.Methods().ByName(protoreflect.Name(parts[1]))
+	if method == nil {
+		return nil
+	}
+
+	if response {
+		return method.Output()
+	}
+	return method.Input()
+}
+
+func toJson(md protoreflect.MessageDescriptor, b []byte) (string, error) {
+	m := dynamicpb.NewMessage(md)
+	if err := proto.Unmarshal(b, m); err != nil {
+		return "", fmt.Errorf("Failed to decode %s: %v", md.FullName(), err)
+	}
+
+	json, err := protojson.MarshalOptions{Multiline: true, Indent: "  "}.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return string(json), nil
+}
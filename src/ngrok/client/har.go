@@ -0,0 +1,83 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/client/har"
+	"github.com/inconshreveable/ngrok/src/ngrok/client/mvc"
+	"github.com/inconshreveable/ngrok/src/ngrok/log"
+	"github.com/inconshreveable/ngrok/src/ngrok/proto"
+)
+
+const (
+	defaultHarMaxSize = 10 * 1024 * 1024 // 10 MB
+	harMaxBackups     = 5
+)
+
+// HarView is a view without a user interface: it saves every HTTP
+// transaction captured by the http protocol analyzer to a HAR file
+type HarView struct {
+	log.Logger
+
+	writer *har.Writer
+	queue  *txnQueue
+}
+
+func NewHarView(ctl mvc.Controller, httpProto *proto.Http, path string, maxSize int64) (*HarView, error) {
+	writer, err := har.NewWriter(path, maxSize, harMaxBackups)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &HarView{
+		Logger: log.NewPrefixLogger("view", "har"),
+		writer: writer,
+	}
+
+	v.Info("Saving HTTP traffic to %s", path)
+	v.queue = newTxnQueue(ctl, v.Logger, httpProto, v.save)
+	return v, nil
+}
+
+func (v *HarView) save(txn *proto.HttpTxn) {
+	if err := v.writer.Write(har.FromTxn(txn)); err != nil {
+		v.Error("Failed to write HAR entry: %v", err)
+	}
+}
+
+func (v *HarView) Shutdown() {
+	v.queue.Shutdown()
+	if err := v.writer.Close(); err != nil {
+		v.Error("Failed to close HAR file: %v", err)
+	}
+}
+
+// exports the HTTP transactions buffered by a running ngrok client to a
+// HAR file, or to stdout if no path is given
+func exportHar(inspect *inspectClient, args []string) (err error) {
+	resp, err := inspect.do("GET", "/http/in/har", "", nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to export HAR from %s: %s", inspect.addr, resp.Status)
+	}
+
+	var out io.Writer = os.Stdout
+	if len(args) > 0 {
+		f, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	_, err = io.Copy(out, resp.Body)
+	return
+}
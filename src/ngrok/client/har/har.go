@@ -0,0 +1,294 @@
+// HTTP Archive (HAR 1.2) encoding of captured HTTP transactions
+// See http://www.softwareishard.com/blog/har-12-spec/
+package har
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/client/mvc"
+	"github.com/inconshreveable/ngrok/src/ngrok/proto"
+	"github.com/inconshreveable/ngrok/src/ngrok/version"
+)
+
+const Version = "1.2"
+
+type Har struct {
+	Log Log `json:"log"`
+}
+
+type Log struct {
+	Version string  `json:"version"`
+	Creator Creator `json:"creator"`
+	Entries []Entry `json:"entries"`
+}
+
+type Creator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type Entry struct {
+	StartedDateTime string   `json:"startedDateTime"`
+	Time            float64  `json:"time"`
+	Request         Request  `json:"request"`
+	Response        Response `json:"response"`
+	Cache           struct{} `json:"cache"`
+	Timings         Timings  `json:"timings"`
+	Connection      string   `json:"connection,omitempty"`
+	Comment         string   `json:"comment,omitempty"`
+}
+
+type Request struct {
+	Method      string      `json:"method"`
+	Url         string      `json:"url"`
+	HttpVersion string      `json:"httpVersion"`
+	Cookies     []Cookie    `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	QueryString []NameValue `json:"queryString"`
+	PostData    *PostData   `json:"postData,omitempty"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+	Comment     string      `json:"comment,omitempty"`
+}
+
+type Response struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HttpVersion string      `json:"httpVersion"`
+	Cookies     []Cookie    `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	Content     Content     `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+	Comment     string      `json:"comment,omitempty"`
+}
+
+type Cookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HttpOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+type NameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type PostData struct {
+	MimeType string      `json:"mimeType"`
+	Params   []NameValue `json:"params"`
+	Text     string      `json:"text"`
+
+	// HAR 1.2 has no way to mark binary request bodies, we use the same
+	// convention as the response content
+	Encoding string `json:"_encoding,omitempty"`
+}
+
+type Content struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type Timings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// New returns an empty archive
+func New() *Har {
+	return &Har{
+		Log: Log{
+			Version: Version,
+			Creator: Creator{Name: "ngrok", Version: version.MajorMinor()},
+			Entries: make([]Entry, 0),
+		},
+	}
+}
+
+// FromTxn converts a transaction which has a response to a HAR entry
+func FromTxn(txn *proto.HttpTxn) Entry {
+	req, resp := txn.Req, txn.Resp
+
+	// the request doesn't know whether it arrived over TLS, the public
+	// URL of the tunnel does
+	u := *req.URL
+	if connCtx, ok := txn.ConnUserCtx.(mvc.ConnectionContext); ok {
+		if publicUrl, err := url.Parse(connCtx.Tunnel.PublicUrl); err == nil {
+			u.Scheme = publicUrl.Scheme
+		}
+	}
+
+	ms := float64(txn.Duration) / float64(time.Millisecond)
+	e := Entry{
+		StartedDateTime: txn.Start.Format(time.RFC3339Nano),
+		Time:            ms,
+		Timings:         Timings{Send: 0, Wait: ms, Receive: 0},
+		Request: Request{
+			Method:      req.Method,
+			Url:         u.String(),
+			HttpVersion: req.Proto,
+			Cookies:     fromCookies(req.Cookies()),
+			Headers:     fromValues(req.Header),
+			QueryString: fromValues(req.URL.Query()),
+			HeadersSize: -1,
+			BodySize:    len(req.BodyBytes),
+			Comment:     redactedComment(req.Redacted),
+		},
+		Response: Response{
+			Status:      resp.StatusCode,
+			StatusText:  http.StatusText(resp.StatusCode),
+			HttpVersion: resp.Proto,
+			Cookies:     fromCookies(resp.Cookies()),
+			Headers:     fromValues(resp.Header),
+			RedirectURL: resp.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    len(resp.BodyBytes),
+			Comment:     redactedComment(resp.Redacted),
+			Content: Content{
+				Size:     len(resp.BodyBytes),
+				MimeType: resp.Header.Get("Content-Type"),
+			},
+		},
+	}
+
+	e.Response.Content.Text, e.Response.Content.Encoding = encodeBody(resp.BodyBytes)
+
+	if len(req.BodyBytes) > 0 {
+		pd := &PostData{MimeType: req.Header.Get("Content-Type"), Params: make([]NameValue, 0)}
+		pd.Text, pd.Encoding = encodeBody(req.BodyBytes)
+		if pd.MimeType == "application/x-www-form-urlencoded" {
+			if form, err := url.ParseQuery(string(req.BodyBytes)); err == nil {
+				pd.Params = fromValues(form)
+			}
+		}
+		e.Request.PostData = pd
+	}
+
+	return e
+}
+
+func redactedComment(redacted []string) string {
+	if len(redacted) == 0 {
+		return ""
+	}
+	return "redacted: " + strings.Join(redacted, ", ")
+}
+
+// Raw returns the request as it would be written on the wire, so that it
+// can be replayed. Content-Length is computed from the posted data and the
+// pseudo-headers of HTTP/2 requests are dropped.
+func (r Request) Raw() ([]byte, error) {
+	u, err := url.Parse(r.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	var body []byte
+	if pd := r.PostData; pd != nil {
+		switch {
+		case pd.Encoding == "base64":
+			if body, err = base64.StdEncoding.DecodeString(pd.Text); err != nil {
+				return nil, err
+			}
+		case pd.Text == "" && len(pd.Params) > 0:
+			form := make(url.Values)
+			for _, p := range pd.Params {
+				form.Add(p.Name, p.Value)
+			}
+			body = []byte(form.Encode())
+		default:
+			body = []byte(pd.Text)
+		}
+	}
+
+	req := &http.Request{
+		Method:        r.Method,
+		URL:           &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery},
+		Host:          u.Host,
+		Header:        make(http.Header),
+		ContentLength: int64(len(body)),
+	}
+
+	// an empty User-Agent stops Write from adding its own
+	req.Header.Set("User-Agent", "")
+	for _, h := range r.Headers {
+		switch name := http.CanonicalHeaderKey(h.Name); {
+		case strings.HasPrefix(name, ":"), name == "Content-Length", name == "Transfer-Encoding":
+		case name == "Host":
+			req.Host = h.Value
+		case name == "User-Agent":
+			req.Header.Set(name, h.Value)
+		default:
+			req.Header.Add(name, h.Value)
+		}
+	}
+
+	if len(body) > 0 {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	var buf bytes.Buffer
+	if err = req.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// text bodies are stored as is, binary ones base64 encoded
+func encodeBody(body []byte) (text, encoding string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+// converts headers or url values to name/value pairs in a stable order
+func fromValues(values map[string][]string) []NameValue {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	nvs := make([]NameValue, 0, len(values))
+	for _, name := range names {
+		for _, v := range values[name] {
+			nvs = append(nvs, NameValue{Name: name, Value: v})
+		}
+	}
+	return nvs
+}
+
+func fromCookies(cookies []*http.Cookie) []Cookie {
+	hc := make([]Cookie, len(cookies))
+	for i, c := range cookies {
+		hc[i] = Cookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			HttpOnly: c.HttpOnly,
+			Secure:   c.Secure,
+		}
+		if !c.Expires.IsZero() {
+			hc[i].Expires = c.Expires.Format(time.RFC3339)
+		}
+	}
+	return hc
+}
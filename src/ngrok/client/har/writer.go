@@ -0,0 +1,142 @@
+package har
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// closes the entries array and the archive, always kept at the end of the file
+const trailer = "\n]}}\n"
+
+// Writer appends entries to a HAR file. The file is a complete archive
+// after every write so that it can be loaded while ngrok is still running,
+// or after it crashed. Once the file grows beyond maxSize, it's rotated:
+// capture.har is renamed to capture.1.har, capture.1.har to capture.2.har
+// and so on, keeping at most maxBackups old files.
+type Writer struct {
+	sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+	count      int
+}
+
+func NewWriter(path string, maxSize int64, maxBackups int) (*Writer, error) {
+	w := &Writer{path: path, maxSize: maxSize, maxBackups: maxBackups}
+
+	// never append to an archive left behind by an earlier run
+	if fi, err := os.Stat(path); err == nil && fi.Size() > 0 {
+		if err = w.rotate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Write appends an entry to the archive
+func (w *Writer) Write(e Entry) error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.f == nil {
+		return fmt.Errorf("HAR writer for %s is closed", w.path)
+	}
+
+	entry, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if w.count > 0 && w.size+int64(len(entry)) > w.maxSize {
+		if err = w.f.Close(); err != nil {
+			return err
+		}
+
+		if err = w.rotate(); err != nil {
+			return err
+		}
+
+		if err = w.open(); err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	if w.count > 0 {
+		buf.WriteString(",")
+	}
+	buf.WriteString("\n")
+	buf.Write(entry)
+	buf.WriteString(trailer)
+
+	// overwrite the trailer with the new entry followed by the trailer
+	offset := w.size - int64(len(trailer))
+	if _, err = w.f.WriteAt(buf.Bytes(), offset); err != nil {
+		return err
+	}
+
+	w.size = offset + int64(buf.Len())
+	w.count++
+	return nil
+}
+
+func (w *Writer) Close() (err error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.f != nil {
+		err = w.f.Close()
+		w.f = nil
+	}
+	return
+}
+
+// creates a new, empty archive at the writer's path
+func (w *Writer) open() (err error) {
+	empty, err := json.Marshal(New())
+	if err != nil {
+		return
+	}
+
+	// everything up to and including the opening bracket of the entries
+	header := strings.TrimSuffix(string(empty), "]}}")
+
+	if w.f, err = os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600); err != nil {
+		return
+	}
+
+	n, err := w.f.WriteString(header + trailer)
+	w.size = int64(n)
+	w.count = 0
+	return
+}
+
+// shifts the existing archives to make room for a new one
+func (w *Writer) rotate() error {
+	for i := w.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(w.backupPath(i), w.backupPath(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if w.maxBackups == 0 {
+		return os.Remove(w.path)
+	}
+	return os.Rename(w.path, w.backupPath(1))
+}
+
+func (w *Writer) backupPath(i int) string {
+	ext := filepath.Ext(w.path)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(w.path, ext), i, ext)
+}
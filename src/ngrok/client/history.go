@@ -0,0 +1,83 @@
+package client
+
+import (
+	"github.com/inconshreveable/ngrok/src/ngrok/client/mvc"
+	"github.com/inconshreveable/ngrok/src/ngrok/client/store"
+	"github.com/inconshreveable/ngrok/src/ngrok/log"
+	"github.com/inconshreveable/ngrok/src/ngrok/proto"
+)
+
+const (
+	defaultHistoryMaxRequests = 10000
+	defaultHistoryMaxAge      = "168h"
+)
+
+// HistoryView is a view without a user interface: it records every HTTP
+// transaction captured by the http protocol analyzer in the history store
+type HistoryView struct {
+	log.Logger
+
+	store *store.Store
+	queue *txnQueue
+}
+
+func NewHistoryView(ctl mvc.Controller, httpProto *proto.Http, s *store.Store) *HistoryView {
+	v := &HistoryView{
+		Logger: log.NewPrefixLogger("view", "history"),
+		store:  s,
+	}
+
+	v.queue = newTxnQueue(ctl, v.Logger, httpProto, v.save)
+	return v
+}
+
+func (v *HistoryView) save(txn *proto.HttpTxn) {
+	r, err := newRecord(txn)
+	if err != nil {
+		v.Error("Failed to record request %s: %v", txn.Id, err)
+		return
+	}
+
+	if err = v.store.Append(r); err != nil {
+		v.Error("Failed to save request %s: %v", txn.Id, err)
+	}
+}
+
+func (v *HistoryView) Shutdown() {
+	v.queue.Shutdown()
+	if err := v.store.Close(); err != nil {
+		v.Error("Failed to close request history: %v", err)
+	}
+}
+
+func newRecord(txn *proto.HttpTxn) (*store.Record, error) {
+	raw, err := proto.DumpRequestOut(txn.Req.Request, true)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &store.Record{
+		Id:         txn.Id,
+		Start:      txn.Start,
+		Duration:   txn.Duration,
+		Method:     txn.Req.Method,
+		Url:        txn.Req.URL.String(),
+		Path:       txn.Req.URL.Path,
+		Status:     txn.Resp.StatusCode,
+		ReqHeader:  txn.Req.Header,
+		ReqBody:    txn.Req.BodyBytes,
+		ReqRaw:     raw,
+		RespHeader: txn.Resp.Header,
+		RespBody:   txn.Resp.BodyBytes,
+
+		ReqRedacted:  txn.Req.Redacted,
+		RespRedacted: txn.Resp.Redacted,
+	}
+
+	if connCtx, ok := txn.ConnUserCtx.(mvc.ConnectionContext); ok {
+		r.Tunnel = connCtx.Tunnel.PublicUrl
+		r.ClientAddr = connCtx.ClientAddr
+		r.ReplayOf = connCtx.ReplayOf
+	}
+	return r, nil
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// inspectClient talks to the web inspection interface of a running
+// client, for the commands which act on its captured traffic
+type inspectClient struct {
+	addr      string
+	basicAuth string
+	token     string
+}
+
+func newInspectClient(config *Configuration) (*inspectClient, error) {
+	if config.InspectAddr == "disabled" {
+		return nil, fmt.Errorf("The web inspection interface is disabled, there is no captured traffic")
+	}
+
+	// an interface listening on all addresses is reached over loopback
+	addr := config.InspectAddr
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+			addr = net.JoinHostPort("127.0.0.1", port)
+		}
+	}
+
+	return &inspectClient{addr: addr, basicAuth: config.InspectAuth, token: config.InspectToken}, nil
+}
+
+func (c *inspectClient) do(method, path, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, "http://"+c.addr+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if c.basicAuth != "" {
+		user, password, _ := strings.Cut(c.basicAuth, ":")
+		req.SetBasicAuth(user, password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to reach the running ngrok client at %s: %v", c.addr, err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,301 @@
+package intercept
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/log"
+	"github.com/inconshreveable/ngrok/src/ngrok/util"
+)
+
+// how long a request stays paused when nobody decides what to do with it
+const DefaultTimeout = 5 * time.Minute
+
+// a request paused by an intercept rule
+type Pending struct {
+	Id     string
+	Tunnel string
+	Start  time.Time
+	Method string
+	Path   string
+
+	// the request as it was read from the tunnel
+	Raw []byte
+
+	decision chan Decision
+}
+
+// Decision is what happens to a paused request
+type Decision struct {
+	Drop bool
+
+	// the request to forward in place of the paused one, or nil to
+	// forward it unchanged
+	Payload []byte
+}
+
+// Hub serves the connections of tunnels with rules and keeps the requests
+// they have paused
+type Hub struct {
+	log.Logger
+
+	// paused requests are forwarded unchanged after this long
+	timeout time.Duration
+
+	lock    sync.Mutex
+	pending []*Pending
+
+	// receives the paused requests whenever they change
+	Updates *util.Broadcast
+}
+
+func NewHub(timeout time.Duration) *Hub {
+	return &Hub{
+		Logger:  log.NewPrefixLogger("intercept"),
+		timeout: timeout,
+		pending: make([]*Pending, 0),
+		Updates: util.NewBroadcast(),
+	}
+}
+
+// Pending returns the paused requests, oldest first
+func (h *Hub) Pending() []Pending {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	pending := make([]Pending, len(h.pending))
+	for i, p := range h.pending {
+		pending[i] = *p
+	}
+	return pending
+}
+
+// Resolve forwards or drops a paused request
+func (h *Hub) Resolve(id string, d Decision) error {
+	h.lock.Lock()
+	p := h.remove(id)
+	h.lock.Unlock()
+
+	if p == nil {
+		return fmt.Errorf("No paused request with id %s", id)
+	}
+
+	p.decision <- d
+	h.publish()
+	return nil
+}
+
+// must hold the lock
+func (h *Hub) remove(id string) *Pending {
+	for i, p := range h.pending {
+		if p.Id == id {
+			h.pending = append(h.pending[:i], h.pending[i+1:]...)
+			return p
+		}
+	}
+	return nil
+}
+
+func (h *Hub) publish() {
+	h.Updates.In() <- h.Pending()
+}
+
+// pause waits until the request is resolved, or the timeout expires
+func (h *Hub) pause(tunnel string, req *http.Request, raw []byte) Decision {
+	p := &Pending{
+		Id:       util.RandId(8),
+		Tunnel:   tunnel,
+		Start:    time.Now(),
+		Method:   req.Method,
+		Path:     req.URL.RequestURI(),
+		Raw:      raw,
+		decision: make(chan Decision, 1),
+	}
+
+	h.lock.Lock()
+	h.pending = append(h.pending, p)
+	h.lock.Unlock()
+	h.publish()
+	h.Info("Paused %s %s on tunnel %s", p.Method, p.Path, tunnel)
+
+	select {
+	case d := <-p.decision:
+		return d
+
+	case <-time.After(h.timeout):
+		h.lock.Lock()
+		removed := h.remove(p.Id)
+		h.lock.Unlock()
+
+		// it may have been resolved just as the timeout expired
+		if removed == nil {
+			return <-p.decision
+		}
+
+		h.publish()
+		h.Warn("Forwarding %s %s after nobody resolved it for %v", p.Method, p.Path, h.timeout)
+		return Decision{}
+	}
+}
+
+// Serve answers the requests read from c, a connection of the tunnel,
+// according to the rules. Requests which aren't answered by a rule are
+// sent to the connection returned by dial, which is only called once it's
+// needed. If it fails, the response returned by offline is written to c.
+func (h *Hub) Serve(c net.Conn, tunnel string, rules []*Rule, dial func() (net.Conn, error), offline func(*http.Request) []byte) {
+	defer c.Close()
+
+	var (
+		local   net.Conn
+		localRd *bufio.Reader
+		dialErr error
+	)
+	defer func() {
+		if local != nil {
+			local.Close()
+		}
+	}()
+
+	rd := bufio.NewReader(c)
+	for {
+		req, err := http.ReadRequest(rd)
+		if err != nil {
+			if err != io.EOF {
+				h.Debug("Failed to read request: %v", err)
+			}
+			return
+		}
+
+		keepUserAgent(req)
+		rule := match(rules, req)
+		if rule != nil && rule.Respond != nil && !rule.Offline {
+			if err = respond(c, req, rule.Respond); err != nil || req.Close {
+				return
+			}
+			continue
+		}
+
+		if rule != nil && rule.Intercept {
+			if req, err = h.intercept(tunnel, req); err != nil {
+				h.Warn("%v", err)
+				return
+			} else if req == nil {
+				return
+			}
+		}
+
+		if local == nil && dialErr == nil {
+			if local, dialErr = dial(); dialErr == nil {
+				localRd = bufio.NewReader(local)
+			}
+		}
+
+		if dialErr != nil {
+			if rule != nil && rule.Offline {
+				if err = respond(c, req, rule.Respond); err != nil || req.Close {
+					return
+				}
+				continue
+			}
+
+			c.Write(offline(req))
+			return
+		}
+
+		if err = req.Write(local); err != nil {
+			h.Warn("Failed to write request to local service: %v", err)
+			return
+		}
+
+		resp, err := http.ReadResponse(localRd, req)
+		if err != nil {
+			h.Warn("Failed to read response from local service: %v", err)
+			return
+		}
+
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			// the connection now belongs to another protocol, e.g. websockets
+			resp.Write(c)
+			go func() {
+				io.Copy(local, rd)
+				local.Close()
+			}()
+			io.Copy(c, localRd)
+			return
+		}
+
+		err = resp.Write(c)
+		resp.Body.Close()
+		if err != nil || req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+// intercept pauses the request and returns the one to forward in its
+// place, or nil if it was dropped
+func (h *Hub) intercept(tunnel string, req *http.Request) (*http.Request, error) {
+	var buf bytes.Buffer
+	if err := req.Write(&buf); err != nil {
+		return nil, fmt.Errorf("Failed to read intercepted request: %v", err)
+	}
+	raw := buf.Bytes()
+
+	d := h.pause(tunnel, req, raw)
+	if d.Drop {
+		h.Info("Dropped %s %s", req.Method, req.URL.RequestURI())
+		return nil, nil
+	}
+
+	if d.Payload != nil {
+		raw = d.Payload
+	}
+
+	forward, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid request to forward: %v", err)
+	}
+	keepUserAgent(forward)
+	return forward, nil
+}
+
+// an empty User-Agent stops Write from adding its own to a request
+// which didn't have one
+func keepUserAgent(req *http.Request) {
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header.Set("User-Agent", "")
+	}
+}
+
+// respond writes a canned response to the request, after reading its body
+// so the next request on the connection can be read
+func respond(c net.Conn, req *http.Request, r *Response) error {
+	if _, err := io.Copy(io.Discard, req.Body); err != nil {
+		return err
+	}
+
+	header := make(http.Header)
+	for name, values := range r.Header {
+		header[name] = values
+	}
+	header.Set("Content-Length", strconv.Itoa(len(r.Body)))
+
+	resp := &http.Response{
+		StatusCode:    r.Status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        header,
+		ContentLength: int64(len(r.Body)),
+		Body:          io.NopCloser(bytes.NewReader(r.Body)),
+		Close:         req.Close,
+	}
+	return resp.Write(c)
+}
@@ -0,0 +1,117 @@
+// Mock responses and interception of requests to a tunnel
+//
+// A tunnel with rules doesn't join its public connections straight to the
+// local service. Each request is matched against the rules first: it may be
+// answered with a canned response without dialing the local service at
+// all, or be paused until it is forwarded or dropped from the inspector.
+// Requests which match no rule are proxied as usual.
+package intercept
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+type Rule struct {
+	// the requests the rule applies to, empty values match anything
+	Method string
+
+	// an exact path, a glob like /users/*/avatar or a prefix ending
+	// in * like /api/*
+	Path string
+
+	// headers which must be present, with the given value unless
+	// it is empty
+	Headers map[string]string
+
+	// answer matching requests with this response
+	Respond *Response
+
+	// only answer with Respond while the local service can't be reached
+	Offline bool
+
+	// pause matching requests until they're forwarded or dropped
+	Intercept bool
+}
+
+type Response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// Validate checks that the rule is well formed
+func (r *Rule) Validate() error {
+	if r.Respond == nil && !r.Intercept {
+		return fmt.Errorf("A rule must either respond or intercept")
+	}
+
+	if r.Respond != nil && r.Intercept {
+		return fmt.Errorf("A rule can't both respond and intercept")
+	}
+
+	if r.Offline && r.Respond == nil {
+		return fmt.Errorf("Only rules which respond can apply when the local service is offline")
+	}
+
+	if r.Respond != nil && (r.Respond.Status < 100 || r.Respond.Status > 999) {
+		return fmt.Errorf("Invalid response status %d", r.Respond.Status)
+	}
+
+	if _, err := path.Match(r.Path, ""); err != nil {
+		return fmt.Errorf("Invalid path pattern '%s': %v", r.Path, err)
+	}
+	return nil
+}
+
+func (r *Rule) Matches(req *http.Request) bool {
+	if r.Method != "" && !strings.EqualFold(r.Method, req.Method) {
+		return false
+	}
+
+	if r.Path != "" && !matchPath(r.Path, req.URL.Path) {
+		return false
+	}
+
+	for name, value := range r.Headers {
+		values, ok := req.Header[http.CanonicalHeaderKey(name)]
+		if !ok {
+			return false
+		}
+
+		if value != "" && !contains(values, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchPath(pattern, p string) bool {
+	if strings.HasSuffix(pattern, "*") && !strings.ContainsAny(pattern[:len(pattern)-1], "*?[") {
+		return strings.HasPrefix(p, pattern[:len(pattern)-1])
+	}
+
+	ok, _ := path.Match(pattern, p)
+	return ok
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// the first rule matching the request, or nil
+func match(rules []*Rule, req *http.Request) *Rule {
+	for _, r := range rules {
+		if r.Matches(req) {
+			return r
+		}
+	}
+	return nil
+}
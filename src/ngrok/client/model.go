@@ -1,24 +1,34 @@
 package client
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
 	"fmt"
-	"io"
 	"math"
 	"net"
+	"net/http"
 	"runtime"
+	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	metrics "github.com/rcrowley/go-metrics"
 
+	"github.com/inconshreveable/ngrok/src/ngrok/client/decode"
+	"github.com/inconshreveable/ngrok/src/ngrok/client/intercept"
 	"github.com/inconshreveable/ngrok/src/ngrok/client/mvc"
+	"github.com/inconshreveable/ngrok/src/ngrok/client/upstream"
 	"github.com/inconshreveable/ngrok/src/ngrok/conn"
+	"github.com/inconshreveable/ngrok/src/ngrok/errpage"
+	"github.com/inconshreveable/ngrok/src/ngrok/httpauth"
 	"github.com/inconshreveable/ngrok/src/ngrok/log"
 	"github.com/inconshreveable/ngrok/src/ngrok/msg"
 	"github.com/inconshreveable/ngrok/src/ngrok/proto"
+	"github.com/inconshreveable/ngrok/src/ngrok/proxyproto"
+	"github.com/inconshreveable/ngrok/src/ngrok/udp"
 	"github.com/inconshreveable/ngrok/src/ngrok/util"
 	"github.com/inconshreveable/ngrok/src/ngrok/version"
 )
@@ -32,16 +42,26 @@ const (
 	BadGateway          = `<html>
 <body style="background-color: #97a8b9">
     <div style="margin:auto; width:400px;padding: 20px 60px; background-color: #D3D3D3; border: 5px solid maroon;">
-        <h2>Tunnel %s unavailable</h2>
-        <p>Unable to initiate connection to <strong>%s</strong>. A web server must be running on port <strong>%s</strong> to complete the tunnel.</p>
+        <h2>Tunnel {{.PublicUrl}} unavailable</h2>
+        <p>Unable to initiate connection to <strong>{{.LocalAddr}}</strong>. A web server must be running on port <strong>{{.LocalAddr}}</strong> to complete the tunnel.</p>
+    </div>
+</body>
+</html>
 `
+
+	// how long to wait for the request that can't be proxied, to answer it
+	// in the format it accepts
+	offlineReadTimeout = 5 * time.Second
 )
 
+var defaultOfflinePage = errpage.Must(errpage.New(502, BadGateway))
+
 type ClientModel struct {
 	log.Logger
 
 	id            string
 	tunnels       map[string]mvc.Tunnel
+	tunnelsLock   *sync.RWMutex
 	serverVersion string
 	metrics       *ClientMetrics
 	updateStatus  mvc.UpdateStatus
@@ -55,6 +75,13 @@ type ClientModel struct {
 	tlsConfig     *tls.Config
 	tunnelConfig  map[string]*TunnelConfiguration
 	configPath    string
+	intercepts    *intercept.Hub
+
+	// the upstreams of tunnels which forward to several addresses, keyed
+	// by upstreamKey. The control connection starts them while the
+	// proxy connections, views and replays use them.
+	upstreams     map[string]*tunnelUpstreams
+	upstreamsLock *sync.RWMutex
 
 	// Context support
 	ctx    context.Context
@@ -62,11 +89,26 @@ type ClientModel struct {
 }
 
 func newClientModel(config *Configuration, ctl mvc.Controller) *ClientModel {
+	// the analyzers tunnels ask for besides the default ones
+	selected := make(map[string]bool)
+	for _, t := range config.Tunnels {
+		if t != nil && t.Inspect != "" {
+			selected[t.Inspect] = true
+		}
+	}
+
+	// create one instance of each protocol analyzer the tunnels may use,
+	// the views of the others would only take up room
 	protoMap := make(map[string]proto.Protocol)
-	protoMap["http"] = proto.NewHttp()
-	protoMap["https"] = protoMap["http"]
-	protoMap["tcp"] = proto.NewTcp()
-	protocols := []proto.Protocol{protoMap["http"], protoMap["tcp"]}
+	protocols := make([]proto.Protocol, 0)
+	for _, r := range proto.Registrations() {
+		if !r.Default && !selected[r.Name] {
+			continue
+		}
+
+		protoMap[r.Name] = r.New()
+		protocols = append(protocols, protoMap[r.Name])
+	}
 
 	m := &ClientModel{
 		Logger: log.NewPrefixLogger("client"),
@@ -95,8 +137,10 @@ func newClientModel(config *Configuration, ctl mvc.Controller) *ClientModel {
 		// protocol list
 		protocols: protocols,
 
-		// open tunnels
-		tunnels: make(map[string]mvc.Tunnel),
+		// open tunnels, the control connection adds them while the views
+		// and replays read them
+		tunnels:     make(map[string]mvc.Tunnel),
+		tunnelsLock: new(sync.RWMutex),
 
 		// controller
 		ctl: ctl,
@@ -106,11 +150,36 @@ func newClientModel(config *Configuration, ctl mvc.Controller) *ClientModel {
 
 		// config path
 		configPath: config.Path,
+
+		// serves the tunnels with mock and intercept rules
+		intercepts: intercept.NewHub(intercept.DefaultTimeout),
+
+		upstreams:     make(map[string]*tunnelUpstreams),
+		upstreamsLock: new(sync.RWMutex),
 	}
 
 	// initialize context
 	m.ctx, m.cancel = context.WithCancel(context.Background())
 
+	// redact captured traffic before any view sees it, the rules were
+	// validated with the rest of the configuration
+	if config.Redact != nil {
+		if redactor, err := config.Redact.redactor(); err == nil {
+			// failing to load the descriptors is reported by the web view
+			if pb := config.Protobuf; pb != nil {
+				if p, err := decode.LoadProtobuf(pb.DescriptorSet, pb.Messages); err == nil {
+					redactor.DecodeProtobuf(p)
+				}
+			}
+
+			for _, p := range protocols {
+				if httpProto, ok := p.(*proto.Http); ok {
+					httpProto.Redact = redactor.Txn
+				}
+			}
+		}
+	}
+
 	// configure TLS
 	if config.TrustHostRootCerts {
 		m.Info("Trusting host's root certificates")
@@ -145,17 +214,36 @@ func serverName(addr string) string {
 	return host
 }
 
+// returns the protocol analyzer which inspects the traffic of a tunnel protocol
+func (c *ClientModel) analyzerFor(tunnelProto, inspect string) proto.Protocol {
+	if r, err := selectAnalyzer(tunnelProto, inspect); err == nil {
+		return c.protoMap[r.Name]
+	}
+
+	// config validation makes this unlikely, fall back to raw tcp
+	return c.protoMap["tcp"]
+}
+
 // mvc.State interface
 func (c ClientModel) GetProtocols() []proto.Protocol { return c.protocols }
 func (c ClientModel) GetClientVersion() string       { return version.MajorMinor() }
 func (c ClientModel) GetServerVersion() string       { return c.serverVersion }
 func (c ClientModel) GetTunnels() []mvc.Tunnel {
+	c.tunnelsLock.RLock()
+	defer c.tunnelsLock.RUnlock()
+
 	tunnels := make([]mvc.Tunnel, 0)
 	for _, t := range c.tunnels {
 		tunnels = append(tunnels, t)
 	}
 	return tunnels
 }
+func (c ClientModel) GetUpstreams(t mvc.Tunnel) []mvc.UpstreamStatus {
+	if pool := c.upstreamPool(t); pool != nil {
+		return pool.Statuses()
+	}
+	return nil
+}
 func (c ClientModel) GetConnStatus() mvc.ConnStatus     { return c.connStatus }
 func (c ClientModel) GetUpdateStatus() mvc.UpdateStatus { return c.updateStatus }
 
@@ -176,18 +264,15 @@ func (c ClientModel) SetUpdateStatus(updateStatus mvc.UpdateStatus) {
 }
 
 // mvc.Model interface
-func (c *ClientModel) PlayRequest(tunnel mvc.Tunnel, payload []byte) {
-	var localConn conn.Conn
-	localConn, err := conn.Dial(tunnel.LocalAddr, "prv", nil)
-	if err != nil {
-		c.Warn("Failed to open private leg to %s: %v", tunnel.LocalAddr, err)
-		return
+func (c *ClientModel) PlayRequest(replay mvc.Replay) {
+	result := c.playRequest(replay)
+	if result.Err != nil {
+		c.Warn("Failed to replay request: %v", result.Err)
 	}
 
-	defer localConn.Close()
-	localConn = tunnel.Protocol.WrapConn(context.Background(), localConn, mvc.ConnectionContext{Tunnel: tunnel, ClientAddr: "127.0.0.1"})
-	localConn.Write(payload)
-	io.ReadAll(localConn)
+	if replay.Result != nil {
+		replay.Result <- result
+	}
 }
 
 func (c *ClientModel) Shutdown() {
@@ -296,22 +381,49 @@ func (c *ClientModel) control() {
 		c.Error("Failed to save auth token: %v", err)
 	}
 
+	// don't let an older server expose tunnels without their http auth
+	if !authResp.HttpAuthHashes {
+		for name, config := range c.tunnelConfig {
+			if len(config.httpAuth()) > 0 {
+				emsg := fmt.Sprintf("Tunnel %s has http auth, which the server (version %s) doesn't support, upgrade it", name, authResp.MmVersion)
+				c.ctl.Shutdown(emsg)
+				return
+			}
+		}
+	}
+
 	// request tunnels
 	reqIdToTunnelConfig := make(map[string]*TunnelConfiguration)
-	for _, config := range c.tunnelConfig {
+	reqIdToTunnelName := make(map[string]string)
+	for name, config := range c.tunnelConfig {
 		// create the protocol list to ask for
 		var protocols []string
 		for proto, _ := range config.Protocols {
 			protocols = append(protocols, proto)
 		}
 
+		// only salted hashes of the passwords are sent to the server
+		var authUsers []string
+		for _, userPassword := range config.httpAuth() {
+			hashed, err := httpauth.Hash(userPassword)
+			if err != nil {
+				c.ctl.Shutdown(fmt.Sprintf("Tunnel %s: %v", name, err))
+				return
+			}
+			authUsers = append(authUsers, hashed)
+		}
+
 		reqTunnel := &msg.ReqTunnel{
-			ReqId:      util.RandId(8),
-			Protocol:   strings.Join(protocols, "+"),
-			Hostname:   config.Hostname,
-			Subdomain:  config.Subdomain,
-			HttpAuth:   config.HttpAuth,
-			RemotePort: config.RemotePort,
+			ReqId:         util.RandId(8),
+			Protocol:      strings.Join(protocols, "+"),
+			Hostname:      config.Hostname,
+			Subdomain:     config.Subdomain,
+			HttpAuthUsers: authUsers,
+			Pool:          config.Pool,
+			PoolPolicy:    config.PoolPolicy,
+			RemotePort:    config.RemotePort,
+			IpAllow:       config.IpAllow,
+			IpDeny:        config.IpDeny,
 		}
 
 		// send the tunnel request
@@ -322,6 +434,7 @@ func (c *ClientModel) control() {
 		// save request id association so we know which local address
 		// to proxy to later
 		reqIdToTunnelConfig[reqTunnel.ReqId] = config
+		reqIdToTunnelName[reqTunnel.ReqId] = name
 	}
 
 	// start the heartbeat
@@ -350,13 +463,19 @@ func (c *ClientModel) control() {
 				continue
 			}
 
+			config := reqIdToTunnelConfig[m.ReqId]
 			tunnel := mvc.Tunnel{
+				Name:      reqIdToTunnelName[m.ReqId],
 				PublicUrl: m.Url,
-				LocalAddr: reqIdToTunnelConfig[m.ReqId].Protocols[m.Protocol],
-				Protocol:  c.protoMap[m.Protocol],
+				LocalAddr: config.Protocols[m.Protocol],
+				Protocol:  c.analyzerFor(m.Protocol, config.Inspect),
 			}
 
+			c.tunnelsLock.Lock()
 			c.tunnels[tunnel.PublicUrl] = tunnel
+			c.tunnelsLock.Unlock()
+
+			c.startUpstreams(tunnel, config.Upstream)
 			c.connStatus = mvc.ConnOnline
 			c.Info("Tunnel established at %v", tunnel.PublicUrl)
 			c.update()
@@ -399,28 +518,51 @@ func (c *ClientModel) proxy() {
 		return
 	}
 
+	c.tunnelsLock.RLock()
 	tunnel, ok := c.tunnels[startPxy.Url]
+	c.tunnelsLock.RUnlock()
 	if !ok {
 		remoteConn.Error("Couldn't find tunnel for proxy: %s", startPxy.Url)
 		return
 	}
 
+	if tunnel.Protocol.GetName() == "udp" {
+		c.proxyUdp(tunnel, remoteConn)
+		return
+	}
+
 	// start up the private connection
 	start := time.Now()
-	localConn, err := conn.Dial(tunnel.LocalAddr, "prv", nil)
-	if err != nil {
-		remoteConn.Warn("Failed to open private leg %s: %v", tunnel.LocalAddr, err)
-
-		if tunnel.Protocol.GetName() == "http" {
-			// try to be helpful when you're in HTTP mode and a human might see the output
-			badGatewayBody := fmt.Sprintf(BadGateway, tunnel.PublicUrl, tunnel.LocalAddr, tunnel.LocalAddr)
-			remoteConn.Write([]byte(fmt.Sprintf(`HTTP/1.0 502 Bad Gateway
-Content-Type: text/html
-Content-Length: %d
-
-%s`, len(badGatewayBody), badGatewayBody)))
+	var localConn conn.Conn
+	if t, ok := c.tunnelConfig[tunnel.Name]; ok && len(t.Intercept) > 0 {
+		// the tunnel's rules see each request before the local service does
+		client, server := net.Pipe()
+		c.ctl.Go(func() {
+			c.intercepts.Serve(server, tunnel.Name, t.Intercept, func() (net.Conn, error) {
+				local, err := c.dialLocal(tunnel, startPxy.ClientAddr)
+				if err != nil {
+					remoteConn.Warn("Failed to open private leg %s: %v", tunnel.LocalAddr, err)
+					return nil, err
+				}
+				return local, nil
+			}, func(req *http.Request) []byte {
+				return c.offlineResponse(tunnel, req)
+			})
+		})
+		localConn = conn.Wrap(client, "prv")
+	} else {
+		localConn, err = c.dialLocal(tunnel, startPxy.ClientAddr)
+		if err != nil {
+			remoteConn.Warn("Failed to open private leg %s: %v", tunnel.LocalAddr, err)
+
+			if tunnel.Protocol.GetName() == "http" {
+				// try to be helpful when you're in HTTP mode and a human might see the output
+				remoteConn.SetReadDeadline(time.Now().Add(offlineReadTimeout))
+				req, _ := http.ReadRequest(bufio.NewReader(remoteConn))
+				remoteConn.Write(c.offlineResponse(tunnel, req))
+			}
+			return
 		}
-		return
 	}
 	defer localConn.Close()
 
@@ -439,6 +581,162 @@ Content-Length: %d
 	c.update()
 }
 
+// relays the datagrams of a udp tunnel, which all arrive over a single
+// proxy connection, to the local service
+func (c *ClientModel) proxyUdp(tunnel mvc.Tunnel, remoteConn conn.Conn) {
+	remoteConn.SetDeadline(time.Time{})
+
+	m := c.metrics
+	m.connMeter.Mark(1)
+	c.update()
+	m.connTimer.Time(func() {
+		bytesIn, bytesOut := udp.NewForwarder(tunnel.LocalAddr, 0).Serve(remoteConn)
+		m.bytesIn.Update(bytesIn)
+		m.bytesOut.Update(bytesOut)
+		m.bytesInCount.Inc(bytesIn)
+		m.bytesOutCount.Inc(bytesOut)
+	})
+	c.update()
+}
+
+// the health checked upstreams of a tunnel
+type tunnelUpstreams struct {
+	pool  *upstream.Pool
+	addrs []string
+
+	// stops the health checks
+	stop context.CancelFunc
+}
+
+// the upstreams of a tunnel are kept when it's established again at
+// another url after reconnecting, the protocols of a tunnel can have
+// different local addresses
+func upstreamKey(tunnel mvc.Tunnel) string {
+	scheme, _, _ := strings.Cut(tunnel.PublicUrl, "://")
+	return tunnel.Name + "[" + scheme + "]"
+}
+
+// starts checking the health of the upstreams of a tunnel which forwards
+// to several addresses. The tunnel's address is the first upstream.
+func (c *ClientModel) startUpstreams(tunnel mvc.Tunnel, config *UpstreamConfiguration) {
+	if config == nil {
+		return
+	}
+
+	key := upstreamKey(tunnel)
+	addrs := append([]string{tunnel.LocalAddr}, config.Addrs...)
+
+	c.upstreamsLock.Lock()
+	defer c.upstreamsLock.Unlock()
+
+	if old, ok := c.upstreams[key]; ok {
+		// the tunnel is established again after reconnecting
+		if slices.Equal(old.addrs, addrs) {
+			return
+		}
+		old.stop()
+	}
+
+	pool, err := upstream.NewPool(addrs, config.Policy, config.Check)
+	if err != nil {
+		// the configuration was validated when it was loaded
+		c.Error("Failed to create the upstreams of %s: %v", tunnel.PublicUrl, err)
+		delete(c.upstreams, key)
+		return
+	}
+
+	ctx, stop := context.WithCancel(c.ctx)
+	c.upstreams[key] = &tunnelUpstreams{pool: pool, addrs: addrs, stop: stop}
+	c.ctl.Go(func() { pool.Run(ctx, c.update) })
+}
+
+// the upstreams of a tunnel, nil if it forwards to a single address
+func (c *ClientModel) upstreamPool(tunnel mvc.Tunnel) *upstream.Pool {
+	c.upstreamsLock.RLock()
+	defer c.upstreamsLock.RUnlock()
+
+	if u, ok := c.upstreams[upstreamKey(tunnel)]; ok {
+		return u.pool
+	}
+	return nil
+}
+
+// the local address new connections of a tunnel go to, the healthiest of
+// its upstreams if it has several
+func (c *ClientModel) localAddr(tunnel mvc.Tunnel) string {
+	if pool := c.upstreamPool(tunnel); pool != nil {
+		return pool.Candidates()[0]
+	}
+	return tunnel.LocalAddr
+}
+
+// dials the local service of a tunnel for a connection from clientAddr,
+// starting with a PROXY header if the tunnel sends them
+func (c *ClientModel) dialLocal(tunnel mvc.Tunnel, clientAddr string) (conn.Conn, error) {
+	local, err := c.dialUpstream(tunnel)
+	if err != nil {
+		return nil, err
+	}
+
+	// tell the local service who the connection is really from
+	if t, ok := c.tunnelConfig[tunnel.Name]; ok && t.ProxyProtocol != 0 {
+		// the address is unknown if it doesn't parse
+		src, _ := net.ResolveTCPAddr("tcp", clientAddr)
+		if err = proxyproto.Write(local, t.ProxyProtocol, src, local.RemoteAddr()); err != nil {
+			local.Close()
+			return nil, err
+		}
+	}
+	return local, nil
+}
+
+// dials the local address of a tunnel. A tunnel with several upstreams
+// tries each of them in the order of its selection policy.
+func (c *ClientModel) dialUpstream(tunnel mvc.Tunnel) (conn.Conn, error) {
+	pool := c.upstreamPool(tunnel)
+	if pool == nil {
+		local, err := conn.Dial(tunnel.LocalAddr, "prv", nil)
+		if err != nil {
+			return nil, err
+		}
+		return local, nil
+	}
+
+	var err error
+	for _, addr := range pool.Candidates() {
+		var local conn.Conn
+		if local, err = conn.Dial(addr, "prv", nil); err == nil {
+			return local, nil
+		}
+
+		if pool.MarkDown(addr, err) {
+			c.update()
+		}
+	}
+	return nil, err
+}
+
+// the response to req when the local service of an http tunnel can't be
+// reached, req is nil if it couldn't be read
+func (c *ClientModel) offlineResponse(tunnel mvc.Tunnel, req *http.Request) []byte {
+	page := defaultOfflinePage
+	if t, ok := c.tunnelConfig[tunnel.Name]; ok && t.Offline != nil {
+		page = t.Offline
+	}
+
+	data := errpage.Data{
+		Message:   fmt.Sprintf("Tunnel %s unavailable, unable to initiate connection to %s", tunnel.PublicUrl, tunnel.LocalAddr),
+		PublicUrl: tunnel.PublicUrl,
+		LocalAddr: tunnel.LocalAddr,
+	}
+
+	var accept string
+	if req != nil {
+		accept, data.Host = req.Header.Get("Accept"), req.Host
+	}
+	return page.Response(accept, data)
+}
+
 // Hearbeating to ensure our connection ngrokd is still live
 func (c *ClientModel) heartbeat(lastPongAddr *int64, conn conn.Conn) {
 	lastPing := time.Unix(atomic.LoadInt64(lastPongAddr)-1, 0)
@@ -12,7 +12,7 @@ type Controller interface {
 	Shutdown(message string)
 
 	// PlayRequest instructs the model to play requests
-	PlayRequest(tunnel Tunnel, payload []byte)
+	PlayRequest(replay Replay)
 
 	// A channel of updates
 	Updates() *util.Broadcast
@@ -1,9 +1,40 @@
 package mvc
 
+import (
+	"time"
+)
+
 type Model interface {
 	Run()
 
 	Shutdown()
 
-	PlayRequest(tunnel Tunnel, payload []byte)
+	PlayRequest(replay Replay)
+}
+
+// Replay describes a request to play against a tunnel's local service
+type Replay struct {
+	// the tunnel whose protocol analyzer captures the replay
+	Tunnel Tunnel
+
+	// the bytes of the request to issue
+	Payload []byte
+
+	// id of the captured transaction being replayed, if any
+	ReplayOf string
+
+	// where to send the request instead of the tunnel's local address:
+	// a port or address (":9090"), the name or public url of another
+	// tunnel, or any http(s) url
+	Target string
+
+	// if not nil, receives the outcome of the replay
+	Result chan ReplayResult
+}
+
+type ReplayResult struct {
+	// status code of the response to an HTTP request
+	Status   int
+	Duration time.Duration
+	Err      error
 }
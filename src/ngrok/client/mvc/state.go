@@ -1,6 +1,8 @@
 package mvc
 
 import (
+	"time"
+
 	"github.com/inconshreveable/ngrok/src/ngrok/proto"
 	metrics "github.com/rcrowley/go-metrics"
 )
@@ -23,20 +25,36 @@ const (
 )
 
 type Tunnel struct {
+	// name of the tunnel in the configuration file
+	Name      string
 	PublicUrl string
 	Protocol  proto.Protocol
 	LocalAddr string
 }
 
+// the health of one of the local addresses a tunnel forwards to
+type UpstreamStatus struct {
+	Addr      string
+	Healthy   bool
+	Error     string    `json:",omitempty"`
+	CheckedAt time.Time `json:",omitempty"`
+}
+
 type ConnectionContext struct {
 	Tunnel     Tunnel
 	ClientAddr string
+
+	// id of the transaction this connection replays, empty
+	// for connections that came in over the tunnel
+	ReplayOf string
 }
 
 type State interface {
 	GetClientVersion() string
 	GetServerVersion() string
 	GetTunnels() []Tunnel
+	// the upstreams of a tunnel which forwards to more than one address
+	GetUpstreams(t Tunnel) []UpstreamStatus
 	GetProtocols() []proto.Protocol
 	GetUpdateStatus() UpdateStatus
 	GetConnStatus() ConnStatus
@@ -0,0 +1,516 @@
+// Redaction of sensitive data in captured HTTP traffic
+//
+// Captured transactions are redacted before they are handed to any view,
+// so secrets never reach the web interface, HAR files or the request
+// history. Redacted values are replaced by Placeholder and every redaction
+// is recorded in the request or response, which lets replay warn that it won't
+// send the original request.
+//
+// Bodies are redacted as the views show them: content encodings are undone
+// first, and a redacted body is kept decoded. Multipart bodies are redacted
+// part by part. Binary bodies, protobuf messages among them, can't be edited
+// in place, so one with something to redact is replaced as a whole.
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/client/decode"
+	"github.com/inconshreveable/ngrok/src/ngrok/proto"
+)
+
+const Placeholder = "[REDACTED]"
+
+type Rules struct {
+	// names of headers whose values are redacted
+	Headers []string
+
+	// paths of JSON body values to redact, e.g. $.password,
+	// $.users[*].token, $.data[0].secret or $..api_key at any depth
+	JsonPaths []string
+
+	// names of query parameters, url-encoded form fields and multipart
+	// form parts to redact
+	FormFields []string
+
+	// regular expressions whose matches in header values, query
+	// strings and text bodies are redacted
+	Patterns []string
+}
+
+type Redactor struct {
+	headers    map[string]bool
+	jsonPaths  []jsonPath
+	formFields map[string]bool
+	patterns   []*regexp.Regexp
+
+	// decodes protobuf bodies, if a descriptor set was given
+	protobuf *decode.Protobuf
+}
+
+// New compiles the rules, it returns an error for invalid JSON paths
+// and regular expressions
+func New(rules Rules) (*Redactor, error) {
+	r := &Redactor{
+		headers:    make(map[string]bool),
+		formFields: make(map[string]bool),
+	}
+
+	for _, h := range rules.Headers {
+		r.headers[http.CanonicalHeaderKey(h)] = true
+	}
+
+	for _, f := range rules.FormFields {
+		r.formFields[f] = true
+	}
+
+	for _, p := range rules.JsonPaths {
+		path, err := parseJsonPath(p)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid JSON path '%s': %v", p, err)
+		}
+		r.jsonPaths = append(r.jsonPaths, path)
+	}
+
+	for _, p := range rules.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid redaction pattern '%s': %v", p, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+
+	return r, nil
+}
+
+// DecodeProtobuf checks the protobuf bodies described by p against the JSON
+// paths and patterns, as they're shown in the web interface. It must be
+// called before any traffic is captured.
+func (r *Redactor) DecodeProtobuf(p *decode.Protobuf) {
+	r.protobuf = p
+}
+
+// Txn redacts the part of a transaction which was just captured: the
+// request if there is no response yet, the response otherwise
+func (r *Redactor) Txn(txn *proto.HttpTxn) {
+	if txn.Resp == nil {
+		req := txn.Req
+		r.header(&req.Redacted, req.Header)
+		req.URL.RawQuery = r.query(&req.Redacted, req.URL.RawQuery)
+		if body, changed := r.body(&req.Redacted, req.Header, req.URL.Path, false, req.BodyBytes); changed {
+			req.BodyBytes, req.Body = body, io.NopCloser(bytes.NewReader(body))
+			req.ContentLength = setContentLength(req.Header, body)
+		}
+		return
+	}
+
+	resp := txn.Resp
+	r.header(&resp.Redacted, resp.Header)
+	if body, changed := r.body(&resp.Redacted, resp.Header, txn.Req.URL.Path, true, resp.BodyBytes); changed {
+		resp.BodyBytes, resp.Body = body, io.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = setContentLength(resp.Header, body)
+	}
+}
+
+// keeps a Content-Length header in step with a redacted body
+func setContentLength(h http.Header, body []byte) int64 {
+	if h.Get("Content-Length") != "" {
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	return int64(len(body))
+}
+
+func mark(redacted *[]string, format string, args ...interface{}) {
+	what := fmt.Sprintf(format, args...)
+	for _, r := range *redacted {
+		if r == what {
+			return
+		}
+	}
+	*redacted = append(*redacted, what)
+}
+
+func (r *Redactor) header(redacted *[]string, h http.Header) {
+	for name, values := range h {
+		if r.headers[name] {
+			for i := range values {
+				values[i] = Placeholder
+			}
+			mark(redacted, "header %s", name)
+			continue
+		}
+
+		for i, v := range values {
+			if v, ok := r.replacePatterns(v); ok {
+				values[i] = v
+				mark(redacted, "header %s", name)
+			}
+		}
+	}
+}
+
+func (r *Redactor) query(redacted *[]string, rawQuery string) string {
+	if rawQuery == "" {
+		return rawQuery
+	}
+
+	if values, err := url.ParseQuery(rawQuery); err == nil && r.redactForm(redacted, "query", values) {
+		rawQuery = values.Encode()
+	}
+
+	if q, ok := r.replacePatterns(rawQuery); ok {
+		rawQuery = q
+		mark(redacted, "query string")
+	}
+	return rawQuery
+}
+
+// returns the redacted body of the request to path, or of its response,
+// and whether it differs from the captured one
+func (r *Redactor) body(redacted *[]string, h http.Header, path string, response bool, body []byte) ([]byte, bool) {
+	if len(body) == 0 || (len(r.jsonPaths) == 0 && len(r.formFields) == 0 && len(r.patterns) == 0) {
+		return body, false
+	}
+
+	encoding := h.Get("Content-Encoding")
+	if encoding == "" {
+		return r.decodedBody(redacted, h, path, response, body)
+	}
+
+	decoded, err := decode.ContentEncoding(encoding, body)
+	if err != nil {
+		// a body which can't be decoded can't be checked either
+		return r.replaceBody(redacted, h, "body with content encoding %s", encoding), true
+	}
+
+	redactedBody, changed := r.decodedBody(redacted, h, path, response, decoded)
+	if !changed {
+		return body, false
+	}
+
+	// rather than encode it again, the redacted body is kept decoded
+	h.Del("Content-Encoding")
+	return redactedBody, true
+}
+
+func (r *Redactor) decodedBody(redacted *[]string, h http.Header, path string, response bool, body []byte) ([]byte, bool) {
+	changed := false
+	contentType := strings.TrimSpace(strings.Split(h.Get("Content-Type"), ";")[0])
+	switch {
+	case contentType == "application/json" || strings.HasSuffix(contentType, "+json"):
+		if b, ok := r.json(redacted, body); ok {
+			body, changed = b, true
+		}
+
+	case contentType == "application/x-www-form-urlencoded":
+		if values, err := url.ParseQuery(string(body)); err == nil && r.redactForm(redacted, "form", values) {
+			body, changed = []byte(values.Encode()), true
+		}
+
+	case strings.HasPrefix(contentType, "multipart/"):
+		// the patterns were matched against each part
+		if b, ok, err := r.multipart(redacted, h.Get("Content-Type"), path, response, body); err == nil {
+			return b, ok
+		}
+
+	case r.protobuf != nil:
+		if msg, err := r.protobuf.Decode(h.Get("Content-Type"), path, response, body); err == nil && msg != nil {
+			if r.protobufMatches(redacted, msg) {
+				return r.replaceBody(redacted, h, "protobuf body"), true
+			}
+		}
+	}
+
+	if !utf8.Valid(body) {
+		for _, re := range r.patterns {
+			if re.Match(body) {
+				return r.replaceBody(redacted, h, "body"), true
+			}
+		}
+		return body, changed
+	}
+
+	if b, ok := r.replacePatterns(string(body)); ok {
+		body, changed = []byte(b), true
+		mark(redacted, "body")
+	}
+	return body, changed
+}
+
+// replaceBody redacts a body which can't be redacted in place, the
+// placeholder is marked as text so the views don't try to decode it
+func (r *Redactor) replaceBody(redacted *[]string, h http.Header, format string, args ...interface{}) []byte {
+	h.Del("Content-Encoding")
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	mark(redacted, format, args...)
+	return []byte(Placeholder)
+}
+
+// redacts the parts of a multipart body named by the form fields, and
+// the other parts like bodies of their own
+func (r *Redactor) multipart(redacted *[]string, contentType, path string, response bool, body []byte) ([]byte, bool, error) {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return body, false, err
+	}
+
+	boundary := params["boundary"]
+	if boundary == "" {
+		return body, false, fmt.Errorf("Multipart body without a boundary")
+	}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	if err = w.SetBoundary(boundary); err != nil {
+		return body, false, err
+	}
+
+	changed := false
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return body, false, err
+		}
+
+		content, err := io.ReadAll(p)
+		if err != nil {
+			return body, false, err
+		}
+
+		h := http.Header(p.Header)
+		if name := p.FormName(); r.formFields[name] {
+			content = []byte(Placeholder)
+			mark(redacted, "multipart field %s", name)
+			changed = true
+		} else if b, ok := r.decodedBody(redacted, h, path, response, content); ok {
+			content = b
+			changed = true
+		}
+
+		pw, err := w.CreatePart(p.Header)
+		if err != nil {
+			return body, false, err
+		}
+		pw.Write(content)
+	}
+
+	if !changed {
+		return body, false, nil
+	}
+
+	if err = w.Close(); err != nil {
+		return body, false, err
+	}
+	return buf.Bytes(), true, nil
+}
+
+// reports whether the JSON paths or patterns match the decoded messages
+// of a protobuf body
+func (r *Redactor) protobufMatches(redacted *[]string, msg *decode.Message) bool {
+	matched := false
+
+	// gRPC bodies decode to a JSON document per message
+	dec := json.NewDecoder(strings.NewReader(msg.Json))
+	dec.UseNumber()
+	for {
+		var doc interface{}
+		if err := dec.Decode(&doc); err != nil {
+			break
+		}
+
+		for _, path := range r.jsonPaths {
+			if _, ok := path.redact(doc); ok {
+				mark(redacted, "JSON %s", path.expr)
+				matched = true
+			}
+		}
+	}
+
+	if _, ok := r.replacePatterns(msg.Json + "\n" + msg.Trailers); ok {
+		matched = true
+	}
+	return matched
+}
+
+func (r *Redactor) redactForm(redacted *[]string, part string, values url.Values) (changed bool) {
+	for name, vs := range values {
+		if r.formFields[name] {
+			for i := range vs {
+				vs[i] = Placeholder
+			}
+			mark(redacted, "%s field %s", part, name)
+			changed = true
+		}
+	}
+	return
+}
+
+func (r *Redactor) json(redacted *[]string, body []byte) ([]byte, bool) {
+	if len(r.jsonPaths) == 0 {
+		return body, false
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return body, false
+	}
+
+	changed := false
+	for _, path := range r.jsonPaths {
+		var matched bool
+		if doc, matched = path.redact(doc); matched {
+			mark(redacted, "JSON %s", path.expr)
+			changed = true
+		}
+	}
+
+	if !changed {
+		return body, false
+	}
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return body, false
+	}
+	return b, true
+}
+
+func (r *Redactor) replacePatterns(s string) (string, bool) {
+	changed := false
+	for _, re := range r.patterns {
+		if re.MatchString(s) {
+			s = re.ReplaceAllLiteralString(s, Placeholder)
+			changed = true
+		}
+	}
+	return s, changed
+}
+
+// a JSON path is a list of steps from the root of a document
+type jsonPath struct {
+	expr  string
+	steps []jsonStep
+}
+
+type jsonStep struct {
+	key       string // object key, "*" for any key or element
+	index     int    // array index when key is empty
+	recursive bool   // whether the step matches at any depth
+}
+
+func parseJsonPath(expr string) (p jsonPath, err error) {
+	p.expr = expr
+	rest, ok := strings.CutPrefix(expr, "$")
+	if !ok {
+		return p, fmt.Errorf("must start with $")
+	}
+
+	for rest != "" {
+		var step jsonStep
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			step.recursive = true
+			if step.key, rest = cutKey(rest[2:]); step.key == "" {
+				return p, fmt.Errorf("empty key")
+			}
+
+		case rest[0] == '.':
+			if step.key, rest = cutKey(rest[1:]); step.key == "" {
+				return p, fmt.Errorf("empty key")
+			}
+
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return p, fmt.Errorf("unterminated [")
+			}
+
+			sub := strings.Trim(rest[1:end], `'"`)
+			rest = rest[end+1:]
+			if sub == "*" {
+				step.key = "*"
+			} else if step.index, err = strconv.Atoi(sub); err != nil {
+				// a quoted key, e.g. ['content-type']
+				step.key, err = sub, nil
+			}
+
+		default:
+			return p, fmt.Errorf("unexpected %q", rest[0])
+		}
+
+		p.steps = append(p.steps, step)
+	}
+
+	if len(p.steps) == 0 {
+		return p, fmt.Errorf("the whole document can't be redacted")
+	}
+	return p, nil
+}
+
+func cutKey(s string) (key, rest string) {
+	end := strings.IndexAny(s, ".[")
+	if end < 0 {
+		return s, ""
+	}
+	return s[:end], s[end:]
+}
+
+// replaces the values the path matches and reports whether it matched any
+func (p jsonPath) redact(doc interface{}) (interface{}, bool) {
+	return redactSteps(doc, p.steps)
+}
+
+func redactSteps(v interface{}, steps []jsonStep) (interface{}, bool) {
+	if len(steps) == 0 {
+		return Placeholder, true
+	}
+
+	step, matched := steps[0], false
+	switch node := v.(type) {
+	case map[string]interface{}:
+		for k, child := range node {
+			var ok bool
+			if step.key == "*" || step.key == k {
+				if node[k], ok = redactSteps(child, steps[1:]); ok {
+					matched = true
+				}
+			} else if step.recursive {
+				if node[k], ok = redactSteps(child, steps); ok {
+					matched = true
+				}
+			}
+		}
+
+	case []interface{}:
+		for i, child := range node {
+			var ok bool
+			if step.key == "*" || (step.key == "" && step.index == i) {
+				if node[i], ok = redactSteps(child, steps[1:]); ok {
+					matched = true
+				}
+			} else if step.recursive {
+				if node[i], ok = redactSteps(child, steps); ok {
+					matched = true
+				}
+			}
+		}
+	}
+	return v, matched
+}
@@ -0,0 +1,300 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/client/mvc"
+	"github.com/inconshreveable/ngrok/src/ngrok/client/views/web"
+	"github.com/inconshreveable/ngrok/src/ngrok/conn"
+)
+
+// replays come from the client itself
+const replayClientAddr = "127.0.0.1:0"
+
+func (c *ClientModel) playRequest(replay mvc.Replay) (result mvc.ReplayResult) {
+	tunnel, payload, tlsCfg, ours, err := c.replayTarget(replay)
+	if err != nil {
+		result.Err = err
+		return
+	}
+
+	start := time.Now()
+	var localConn conn.Conn
+	if ours {
+		// like the tunnel's own connections, with its upstreams and PROXY header
+		localConn, err = c.dialLocal(tunnel, replayClientAddr)
+	} else {
+		localConn, err = conn.Dial(tunnel.LocalAddr, "prv", tlsCfg)
+	}
+	if err != nil {
+		result.Err = fmt.Errorf("Failed to open private leg to %s: %v", tunnel.LocalAddr, err)
+		return
+	}
+
+	defer localConn.Close()
+	localConn = tunnel.Protocol.WrapConn(context.Background(), localConn, mvc.ConnectionContext{Tunnel: tunnel, ClientAddr: replayClientAddr, ReplayOf: replay.ReplayOf})
+	if _, result.Err = localConn.Write(payload); result.Err != nil {
+		return
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(payload)))
+	if err != nil {
+		// not an HTTP request, wait for the local service to hang up
+		_, result.Err = io.ReadAll(localConn)
+	} else {
+		// read just the one response instead of waiting for the local
+		// service to close a keep-alive connection
+		var resp *http.Response
+		if resp, result.Err = http.ReadResponse(bufio.NewReader(localConn), req); result.Err == nil {
+			_, result.Err = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			result.Status = resp.StatusCode
+		}
+	}
+
+	result.Duration = time.Since(start)
+	return
+}
+
+// resolves the target of a replay to the tunnel it is captured by, the
+// request to send and the TLS configuration to send it with. ours is set
+// when the target is the local service of one of our tunnels.
+func (c *ClientModel) replayTarget(replay mvc.Replay) (tunnel mvc.Tunnel, payload []byte, tlsCfg *tls.Config, ours bool, err error) {
+	tunnel, payload = replay.Tunnel, replay.Payload
+	target := replay.Target
+
+	switch {
+	case target == "":
+		tunnel.LocalAddr, ours = c.localAddr(tunnel), true
+		return
+
+	case strings.Contains(target, "://"):
+		var u *url.URL
+		if u, err = url.Parse(target); err != nil {
+			err = fmt.Errorf("Invalid replay target '%s': %v", target, err)
+			return
+		}
+
+		// the public url of one of our tunnels replays to its local service
+		for _, t := range c.GetTunnels() {
+			if t.PublicUrl == u.Scheme+"://"+u.Host {
+				tunnel, ours = t, true
+				tunnel.LocalAddr = c.localAddr(t)
+				return
+			}
+		}
+
+		var port string
+		switch u.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+			tlsCfg = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+		default:
+			err = fmt.Errorf("Replay target url scheme must be http or https, got %s", u.Scheme)
+			return
+		}
+
+		if u.Port() != "" {
+			port = u.Port()
+		}
+
+		tunnel.LocalAddr = net.JoinHostPort(u.Hostname(), port)
+		payload, err = retargetRequest(payload, u)
+		return
+
+	default:
+		// prefer a tunnel of the same scheme when a name has several
+		scheme := strings.SplitN(replay.Tunnel.PublicUrl, "://", 2)[0]
+		found := false
+		for _, t := range c.GetTunnels() {
+			if t.Name == target && (!found || strings.HasPrefix(t.PublicUrl, scheme+"://")) {
+				tunnel, found = t, true
+			}
+		}
+
+		if found {
+			tunnel.LocalAddr, ours = c.localAddr(tunnel), true
+			return
+		}
+
+		if tunnel.LocalAddr, err = normalizeAddress(target, "replay target"); err != nil {
+			err = fmt.Errorf("Replay target '%s' is neither an address, a url nor a running tunnel", target)
+		}
+		return
+	}
+}
+
+// points a request at the host of a url, prefixing its path with the url's path
+func retargetRequest(payload []byte, u *url.URL) ([]byte, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(payload)))
+	if err != nil {
+		return nil, fmt.Errorf("Only HTTP requests can be replayed to a url: %v", err)
+	}
+
+	req.Host = u.Host
+	req.URL.Path = strings.TrimSuffix(u.Path, "/") + req.URL.Path
+	req.URL.RawPath = ""
+
+	// an empty User-Agent stops Write from adding its own
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header.Set("User-Agent", "")
+	}
+
+	var buf bytes.Buffer
+	if err = req.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// replays captured requests through a running client and prints the outcome
+func replayRequests(inspect *inspectClient, txnIds []string, opts replayOptions) error {
+	if len(txnIds) == 0 && opts.har == "" {
+		return fmt.Errorf("Usage: ngrok replay [options] <txn-id> [...] | --har <file>")
+	}
+
+	if opts.bulk(txnIds) {
+		return bulkReplay(inspect, txnIds, opts)
+	}
+
+	form := url.Values{"target": {opts.to}}
+	path := fmt.Sprintf("/api/v1/requests/%s/replay", url.PathEscape(txnIds[0]))
+	resp, err := inspect.do("POST", path, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err = checkReplayResponse(resp); err != nil {
+		return err
+	}
+
+	var result web.ReplayResponse
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+
+	if result.Warning != "" {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", result.Warning)
+	}
+
+	if result.Error != "" {
+		return fmt.Errorf("Failed to replay %s: %s", txnIds[0], result.Error)
+	}
+
+	fmt.Printf("Replayed %s: %d %s in %v\n", txnIds[0], result.Status, http.StatusText(result.Status), time.Duration(result.Duration))
+	return nil
+}
+
+func bulkReplay(inspect *inspectClient, txnIds []string, opts replayOptions) (err error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for _, id := range txnIds {
+		form.WriteField("txnid", id)
+	}
+	form.WriteField("target", opts.to)
+	form.WriteField("concurrency", strconv.Itoa(opts.concurrency))
+	form.WriteField("rate", strconv.FormatFloat(opts.rate, 'f', -1, 64))
+	form.WriteField("repeat", strconv.Itoa(opts.repeat))
+
+	if opts.har != "" {
+		f, err := os.Open(opts.har)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		part, err := form.CreateFormFile("har", filepath.Base(opts.har))
+		if err != nil {
+			return err
+		}
+
+		if _, err = io.Copy(part, f); err != nil {
+			return err
+		}
+	}
+
+	if err = form.Close(); err != nil {
+		return
+	}
+
+	resp, err := inspect.do("POST", "/api/v1/replay", form.FormDataContentType(), &body)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if err = checkReplayResponse(resp); err != nil {
+		return err
+	}
+
+	var summary web.BulkReplaySummary
+	if err = json.NewDecoder(resp.Body).Decode(&summary); err != nil {
+		return
+	}
+
+	printBulkSummary(summary)
+	return
+}
+
+func checkReplayResponse(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var apiErr web.ApiError
+	if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+		return fmt.Errorf("Failed to replay: %s", resp.Status)
+	}
+	return fmt.Errorf("Failed to replay: %s", apiErr.Error)
+}
+
+func printBulkSummary(s web.BulkReplaySummary) {
+	ms := func(ns int64) string {
+		return fmt.Sprintf("%.2fms", float64(ns)/float64(time.Millisecond))
+	}
+
+	fmt.Printf("Replayed %d requests in %v (%.1f req/s), %d failed\n\n",
+		s.Requests, time.Duration(s.Duration).Round(time.Millisecond), s.RequestsPerSecond, s.Failed)
+
+	// status codes, most frequent first
+	codes := make([]int, 0, len(s.Statuses))
+	for code := range s.Statuses {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return s.Statuses[codes[i]] > s.Statuses[codes[j]] })
+
+	for _, code := range codes {
+		fmt.Printf("  %d %-30s %d\n", code, http.StatusText(code), s.Statuses[code])
+	}
+
+	for msg, n := range s.Errors {
+		fmt.Printf("  error: %-26s %d\n", msg, n)
+	}
+
+	l := s.Latency
+	fmt.Printf("\nLatency: min %s, mean %s, p50 %s, p90 %s, p95 %s, p99 %s, max %s\n",
+		ms(l.Min), ms(l.Mean), ms(l.P50), ms(l.P90), ms(l.P95), ms(l.P99), ms(l.Max))
+
+	for _, warning := range s.Warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+}
@@ -0,0 +1,483 @@
+// Durable history of the HTTP transactions captured by the client
+//
+// Records are appended as lines of JSON to a data file. A second file
+// indexes them by transaction id with their offset in the data file and
+// the metadata most queries filter on, so that only the records which may
+// match a query are read back from disk. The index is rebuilt from the
+// data file whenever the two disagree, e.g. after a crash.
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dataFile  = "requests.log"
+	indexFile = "requests.idx"
+
+	// how far past the retention limits the store may grow before it is
+	// compacted, so that we don't rewrite it on every append
+	compactSlackPct = 10
+	compactSlackAge = time.Hour
+
+	// number of results returned by queries which don't set a limit
+	defaultLimit = 50
+)
+
+type Record struct {
+	Id         string
+	Start      time.Time
+	Duration   time.Duration
+	Tunnel     string
+	ClientAddr string
+	Method     string
+	Url        string
+	Path       string
+	Status     int
+	ReplayOf   string
+	ReqHeader  http.Header
+	ReqBody    []byte
+	ReqRaw     []byte
+	RespHeader http.Header
+	RespBody   []byte
+
+	// what was redacted before the transaction was captured
+	ReqRedacted  []string `json:",omitempty"`
+	RespRedacted []string `json:",omitempty"`
+}
+
+// IndexEntry locates a record in the data file
+type IndexEntry struct {
+	Id     string
+	Offset int64
+	Length int
+	Start  time.Time
+	Method string
+	Path   string
+	Status int
+	Tunnel string
+}
+
+// Query selects records. Zero values don't filter.
+type Query struct {
+	Method      string
+	Path        string // prefix of the request path
+	Status      int
+	StatusClass int    // e.g. 4 for all 4xx responses
+	Header      string // "Name" or "Name: value" of a request or response header
+	Body        string // substring of the request or response body
+	Since       time.Time
+	Until       time.Time
+	Limit       int
+}
+
+type Store struct {
+	sync.Mutex
+
+	dir        string
+	maxRecords int
+	maxAge     time.Duration
+
+	data    *os.File
+	index   *os.File
+	size    int64
+	entries []IndexEntry // in the order they were appended
+	byId    map[string]int
+	first   int // entries before this one were cleared and await compaction
+}
+
+// Open opens or creates a store in dir which keeps at most maxRecords
+// records no older than maxAge. Zero disables the respective limit.
+func Open(dir string, maxRecords int, maxAge time.Duration) (s *Store, err error) {
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+
+	s = &Store{dir: dir, maxRecords: maxRecords, maxAge: maxAge}
+	if err = s.load(); err != nil {
+		return nil, err
+	}
+
+	if s.needsCompaction(0, 0) {
+		if err = s.compact(); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return
+}
+
+// Append adds a record to the store
+func (s *Store) Append(r *Record) (err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.data == nil {
+		return fmt.Errorf("store %s is closed", s.dir)
+	}
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+
+	entry := IndexEntry{
+		Id:     r.Id,
+		Offset: s.size,
+		Length: len(line),
+		Start:  r.Start,
+		Method: r.Method,
+		Path:   r.Path,
+		Status: r.Status,
+		Tunnel: r.Tunnel,
+	}
+
+	if _, err = s.data.Write(append(line, '\n')); err != nil {
+		return
+	}
+	s.size += int64(len(line)) + 1
+
+	if err = writeEntry(s.index, entry); err != nil {
+		return
+	}
+	s.add(entry)
+
+	if s.needsCompaction(compactSlackPct, compactSlackAge) {
+		err = s.compact()
+	}
+	return
+}
+
+// Get returns the record with the given transaction id
+func (s *Store) Get(id string) (*Record, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	i, ok := s.byId[id]
+	if !ok || i < s.first || s.expired(s.entries[i]) {
+		return nil, os.ErrNotExist
+	}
+	return s.read(s.entries[i])
+}
+
+// Find returns the records matching the query, newest first
+func (s *Store) Find(q Query) ([]*Record, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+
+	records := make([]*Record, 0)
+	for i := len(s.entries) - 1; i >= s.first && len(records) < limit; i-- {
+		e := s.entries[i]
+		if s.expired(e) || !q.matchesEntry(e) {
+			continue
+		}
+
+		r, err := s.read(e)
+		if err != nil {
+			return nil, err
+		}
+
+		if q.matchesRecord(r) {
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
+
+// Clear deletes all of the records
+func (s *Store) Clear() error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.first = len(s.entries)
+	return s.compact()
+}
+
+func (s *Store) Close() (err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.data != nil {
+		err = s.data.Close()
+		s.index.Close()
+		s.data, s.index = nil, nil
+	}
+	return
+}
+
+func (q Query) matchesEntry(e IndexEntry) bool {
+	switch {
+	case q.Method != "" && !strings.EqualFold(q.Method, e.Method):
+	case q.Path != "" && !strings.HasPrefix(e.Path, q.Path):
+	case q.Status != 0 && q.Status != e.Status:
+	case q.StatusClass != 0 && q.StatusClass != e.Status/100:
+	case !q.Since.IsZero() && e.Start.Before(q.Since):
+	case !q.Until.IsZero() && e.Start.After(q.Until):
+	default:
+		return true
+	}
+	return false
+}
+
+func (q Query) matchesRecord(r *Record) bool {
+	if q.Header != "" && !matchHeader(r.ReqHeader, q.Header) && !matchHeader(r.RespHeader, q.Header) {
+		return false
+	}
+
+	if q.Body != "" && !bytes.Contains(r.ReqBody, []byte(q.Body)) && !bytes.Contains(r.RespBody, []byte(q.Body)) {
+		return false
+	}
+	return true
+}
+
+// matches "Name" against the presence of a header and "Name: value"
+// against a header whose value contains value
+func matchHeader(h http.Header, filter string) bool {
+	name, value, hasValue := strings.Cut(filter, ":")
+	values, ok := h[http.CanonicalHeaderKey(strings.TrimSpace(name))]
+	if !ok || !hasValue {
+		return ok
+	}
+
+	value = strings.TrimSpace(value)
+	for _, v := range values {
+		if strings.Contains(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Store) expired(e IndexEntry) bool {
+	return s.maxAge > 0 && time.Since(e.Start) > s.maxAge
+}
+
+// reports whether the store exceeds its retention limits by more
+// than the given slack
+func (s *Store) needsCompaction(slackPct int, slackAge time.Duration) bool {
+	live := len(s.entries) - s.first
+	if s.maxRecords > 0 && live > s.maxRecords*(100+slackPct)/100 {
+		return true
+	}
+
+	if s.maxAge > 0 && live > 0 && time.Since(s.entries[s.first].Start) > s.maxAge+slackAge {
+		return true
+	}
+	return false
+}
+
+func (s *Store) add(e IndexEntry) {
+	s.byId[e.Id] = len(s.entries)
+	s.entries = append(s.entries, e)
+}
+
+func (s *Store) read(e IndexEntry) (*Record, error) {
+	buf := make([]byte, e.Length)
+	if _, err := s.data.ReadAt(buf, e.Offset); err != nil {
+		return nil, err
+	}
+
+	r := new(Record)
+	if err := json.Unmarshal(buf, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// opens the data and index files, rebuilding the index if it doesn't
+// account for exactly the records in the data file
+func (s *Store) load() (err error) {
+	if s.data, err = os.OpenFile(s.path(dataFile), os.O_CREATE|os.O_RDWR, 0600); err != nil {
+		return
+	}
+
+	if s.index, err = os.OpenFile(s.path(indexFile), os.O_CREATE|os.O_RDWR, 0600); err != nil {
+		s.data.Close()
+		return
+	}
+
+	fi, err := s.data.Stat()
+	if err != nil {
+		return
+	}
+	s.size = fi.Size()
+
+	s.entries, s.byId, s.first = nil, make(map[string]int), 0
+	if err = readEntries(s.index, s.add); err == nil && s.indexedSize() == s.size {
+		if _, err = s.index.Seek(0, io.SeekEnd); err != nil {
+			return
+		}
+		_, err = s.data.Seek(0, io.SeekEnd)
+		return
+	}
+
+	return s.rebuildIndex()
+}
+
+// the size of the data file according to the index
+func (s *Store) indexedSize() int64 {
+	if len(s.entries) == 0 {
+		return 0
+	}
+	last := s.entries[len(s.entries)-1]
+	return last.Offset + int64(last.Length) + 1
+}
+
+func (s *Store) rebuildIndex() (err error) {
+	s.entries, s.byId = nil, make(map[string]int)
+
+	if _, err = s.data.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+
+	var offset int64
+	rd := bufio.NewReader(s.data)
+	for {
+		line, err := rd.ReadBytes('\n')
+		if err != nil {
+			// a partially written record is dropped
+			break
+		}
+
+		r := new(Record)
+		if json.Unmarshal(line, r) == nil {
+			s.add(IndexEntry{
+				Id:     r.Id,
+				Offset: offset,
+				Length: len(line) - 1,
+				Start:  r.Start,
+				Method: r.Method,
+				Path:   r.Path,
+				Status: r.Status,
+				Tunnel: r.Tunnel,
+			})
+		}
+		offset += int64(len(line))
+	}
+
+	// rewriting everything drops the partial record and corrupt lines
+	return s.compact()
+}
+
+// rewrites the store without the records that were deleted or exceed the
+// retention limits. The new files are written next to the old ones and
+// renamed over them, if we crash in between load() notices the index and
+// data disagree and rebuilds the index.
+func (s *Store) compact() (err error) {
+	first := s.first
+	if s.maxRecords > 0 && len(s.entries)-first > s.maxRecords {
+		first = len(s.entries) - s.maxRecords
+	}
+	for first < len(s.entries) && s.expired(s.entries[first]) {
+		first++
+	}
+
+	data, err := os.OpenFile(s.path(dataFile+".tmp"), os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		return
+	}
+
+	index, err := os.OpenFile(s.path(indexFile+".tmp"), os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		data.Close()
+		return
+	}
+
+	var (
+		size    int64
+		entries []IndexEntry
+	)
+	for _, e := range s.entries[first:] {
+		buf := make([]byte, e.Length+1)
+		if _, err = s.data.ReadAt(buf, e.Offset); err != nil {
+			break
+		}
+
+		e.Offset = size
+		if _, err = data.Write(buf); err != nil {
+			break
+		}
+		size += int64(len(buf))
+
+		if err = writeEntry(index, e); err != nil {
+			break
+		}
+		entries = append(entries, e)
+	}
+
+	if err == nil {
+		err = data.Sync()
+	}
+
+	if err == nil {
+		err = index.Sync()
+	}
+
+	if err != nil {
+		data.Close()
+		index.Close()
+		return
+	}
+
+	if err = os.Rename(data.Name(), s.path(dataFile)); err != nil {
+		return
+	}
+
+	if err = os.Rename(index.Name(), s.path(indexFile)); err != nil {
+		return
+	}
+
+	s.data.Close()
+	s.index.Close()
+	s.data, s.index, s.size = data, index, size
+
+	s.entries, s.byId, s.first = nil, make(map[string]int), 0
+	for _, e := range entries {
+		s.add(e)
+	}
+	return
+}
+
+func (s *Store) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+func writeEntry(w io.Writer, e IndexEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+func readEntries(f *os.File, fn func(IndexEntry)) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e IndexEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return err
+		}
+		fn(e)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"github.com/inconshreveable/ngrok/src/ngrok/client/mvc"
+	"github.com/inconshreveable/ngrok/src/ngrok/log"
+	"github.com/inconshreveable/ngrok/src/ngrok/proto"
+)
+
+// how many complete transactions may wait to be saved
+const txnQueueSize = 256
+
+// txnQueue hands the complete HTTP transactions broadcast by the http
+// protocol analyzer to a worker which saves them. The broadcast waits for
+// every listener, so a slow disk mustn't hold it up: when the worker falls
+// behind, transactions are dropped and reported.
+type txnQueue struct {
+	log.Logger
+
+	httpProto *proto.Http
+	updates   chan interface{}
+	pending   chan *proto.HttpTxn
+	save      func(*proto.HttpTxn)
+
+	// how many transactions were dropped since the worker last kept up
+	dropped int
+
+	shutdown chan int
+	done     chan int
+}
+
+func newTxnQueue(ctl mvc.Controller, logger log.Logger, httpProto *proto.Http, save func(*proto.HttpTxn)) *txnQueue {
+	q := &txnQueue{
+		Logger:    logger,
+		httpProto: httpProto,
+		updates:   httpProto.Txns.Reg(),
+		pending:   make(chan *proto.HttpTxn, txnQueueSize),
+		save:      save,
+		shutdown:  make(chan int),
+		done:      make(chan int),
+	}
+
+	ctl.Go(q.receive)
+	ctl.Go(q.work)
+	return q
+}
+
+func (q *txnQueue) receive() {
+	defer close(q.pending)
+
+	for {
+		select {
+		case obj := <-q.updates:
+			// transactions are broadcast once for the request and again
+			// with their response, only complete ones are saved
+			txn := obj.(*proto.HttpTxn)
+			if txn.Resp == nil {
+				continue
+			}
+
+			select {
+			case q.pending <- txn:
+				if q.dropped > 0 {
+					q.Warn("Dropped %d transactions while saving them fell behind", q.dropped)
+					q.dropped = 0
+				}
+
+			default:
+				if q.dropped == 0 {
+					q.Warn("Saving transactions is falling behind, dropping them")
+				}
+				q.dropped++
+			}
+
+		case <-q.shutdown:
+			// the broadcast may be sending to the listener, keep taking
+			// its updates until it's unregistered
+			unregistered := make(chan int)
+			go func() {
+				q.httpProto.Txns.UnReg(q.updates)
+				close(unregistered)
+			}()
+
+			for {
+				select {
+				case <-q.updates:
+				case <-unregistered:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (q *txnQueue) work() {
+	defer close(q.done)
+
+	for txn := range q.pending {
+		q.save(txn)
+	}
+}
+
+// Shutdown stops taking transactions and waits until the queued ones are
+// saved
+func (q *txnQueue) Shutdown() {
+	close(q.shutdown)
+	<-q.done
+}
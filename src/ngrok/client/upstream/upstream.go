@@ -0,0 +1,207 @@
+// Local upstreams of a tunnel and their health
+//
+// A tunnel can forward to several local addresses, e.g. the blue and green
+// builds of a service. A Pool checks their health periodically, by
+// connecting to them or by requesting a path over HTTP, and orders them by
+// its selection policy so that connections go to a healthy upstream.
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/client/mvc"
+	"github.com/inconshreveable/ngrok/src/ngrok/log"
+)
+
+const (
+	// use the first healthy upstream, in the order they're configured
+	FirstHealthy = "first_healthy"
+
+	// spread connections over all of the healthy upstreams
+	RoundRobin = "round_robin"
+
+	DefaultInterval = 5 * time.Second
+	DefaultTimeout  = 2 * time.Second
+)
+
+type HealthCheck struct {
+	// request this path with GET and expect a 2xx or 3xx response,
+	// empty to only check that the upstream accepts connections
+	Path string
+
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+type Pool struct {
+	log.Logger
+
+	policy string
+	check  HealthCheck
+
+	lock     sync.Mutex
+	statuses []mvc.UpstreamStatus
+
+	// the next upstream for round robin
+	next uint32
+}
+
+// NewPool creates a pool of the addresses with the given selection policy.
+// All of them are healthy until they are checked.
+func NewPool(addrs []string, policy string, check HealthCheck) (*Pool, error) {
+	if policy == "" {
+		policy = FirstHealthy
+	}
+
+	if policy != FirstHealthy && policy != RoundRobin {
+		return nil, fmt.Errorf("Unknown upstream policy '%s', use %s or %s", policy, FirstHealthy, RoundRobin)
+	}
+
+	if check.Interval <= 0 {
+		check.Interval = DefaultInterval
+	}
+
+	if check.Timeout <= 0 {
+		check.Timeout = DefaultTimeout
+	}
+
+	p := &Pool{
+		Logger:   log.NewPrefixLogger("upstream"),
+		policy:   policy,
+		check:    check,
+		statuses: make([]mvc.UpstreamStatus, len(addrs)),
+	}
+
+	for i, addr := range addrs {
+		p.statuses[i] = mvc.UpstreamStatus{Addr: addr, Healthy: true}
+	}
+	return p, nil
+}
+
+// Statuses returns the health of each upstream
+func (p *Pool) Statuses() []mvc.UpstreamStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return append([]mvc.UpstreamStatus(nil), p.statuses...)
+}
+
+// Candidates returns the upstreams in the order they should be tried: the
+// healthy ones as the policy orders them, then the unhealthy ones as a
+// last resort
+func (p *Pool) Candidates() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var healthy, unhealthy []string
+	for _, s := range p.statuses {
+		if s.Healthy {
+			healthy = append(healthy, s.Addr)
+		} else {
+			unhealthy = append(unhealthy, s.Addr)
+		}
+	}
+
+	if p.policy == RoundRobin && len(healthy) > 1 {
+		n := int(atomic.AddUint32(&p.next, 1)-1) % len(healthy)
+		healthy = append(healthy[n:], healthy[:n]...)
+	}
+	return append(healthy, unhealthy...)
+}
+
+// MarkDown records that an upstream refused a connection, it stays
+// unhealthy until the next check succeeds
+func (p *Pool) MarkDown(addr string, err error) bool {
+	return p.set(addr, err)
+}
+
+// set records the outcome of a check and reports whether the upstream's
+// health changed
+func (p *Pool) set(addr string, err error) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for i := range p.statuses {
+		s := &p.statuses[i]
+		if s.Addr != addr {
+			continue
+		}
+
+		healthy := err == nil
+		changed := s.Healthy != healthy
+		s.Healthy, s.CheckedAt, s.Error = healthy, time.Now(), ""
+		if err != nil {
+			s.Error = err.Error()
+		}
+
+		if changed && healthy {
+			p.Info("Upstream %s is healthy", addr)
+		} else if changed {
+			p.Warn("Upstream %s is unhealthy: %v", addr, err)
+		}
+		return changed
+	}
+	return false
+}
+
+// Run checks the upstreams until ctx is done, calling changed whenever
+// the health of one of them changes
+func (p *Pool) Run(ctx context.Context, changed func()) {
+	ticker := time.NewTicker(p.check.Interval)
+	defer ticker.Stop()
+
+	for {
+		anyChanged := false
+		for _, s := range p.Statuses() {
+			if p.set(s.Addr, p.checkOne(ctx, s.Addr)) {
+				anyChanged = true
+			}
+		}
+
+		if anyChanged {
+			changed()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *Pool) checkOne(ctx context.Context, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, p.check.Timeout)
+	defer cancel()
+
+	if p.check.Path == "" {
+		c, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+addr+p.check.Path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "ngrok health check")
+
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("%s returned %s", p.check.Path, resp.Status)
+	}
+	return nil
+}
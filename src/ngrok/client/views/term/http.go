@@ -24,6 +24,12 @@ type HttpView struct {
 	termView     *TermView
 }
 
+func init() {
+	RegisterView("http", func(v *TermView, p proto.Protocol) mvc.View {
+		return v.NewHttpView(p.(*proto.Http))
+	})
+}
+
 func colorFor(status string) termbox.Attribute {
 	switch status[0] {
 	case '3':
@@ -37,11 +43,11 @@ func colorFor(status string) termbox.Attribute {
 	return termbox.ColorWhite
 }
 
-func newTermHttpView(ctl mvc.Controller, termView *TermView, proto *proto.Http, x, y int) *HttpView {
+func newTermHttpView(ctl mvc.Controller, termView *TermView, proto *proto.Http, x, y, h int) *HttpView {
 	v := &HttpView{
 		httpProto:    proto,
 		HttpRequests: util.NewRing(size),
-		area:         NewArea(x, y, 70, size+5),
+		area:         NewArea(x, y, 70, h),
 		shutdown:     make(chan int),
 		termView:     termView,
 		Logger:       log.NewPrefixLogger("view", "term", "http"),
@@ -66,10 +72,18 @@ func (v *HttpView) Run() {
 }
 
 func (v *HttpView) Render() {
+	// the terminal had no room left for the view
+	if v.h == 0 {
+		return
+	}
+
 	v.Clear()
 	v.Printf(0, 0, "HTTP Requests")
 	v.Printf(0, 1, "-------------")
 	for i, obj := range v.HttpRequests.Slice() {
+		if 3+i >= v.h {
+			break
+		}
 		txn := obj.(*proto.HttpTxn)
 		path := truncatePath(txn.Req.URL.Path)
 		v.Printf(0, 3+i, "%s %v", txn.Req.Method, path)
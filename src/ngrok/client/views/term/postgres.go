@@ -0,0 +1,124 @@
+package term
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	termbox "github.com/nsf/termbox-go"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/client/mvc"
+	"github.com/inconshreveable/ngrok/src/ngrok/log"
+	"github.com/inconshreveable/ngrok/src/ngrok/proto"
+	"github.com/inconshreveable/ngrok/src/ngrok/util"
+)
+
+type PostgresView struct {
+	log.Logger
+	*area
+
+	pgProto  *proto.Postgres
+	Queries  *util.Ring
+	shutdown chan int
+	termView *TermView
+}
+
+func init() {
+	RegisterView("postgres", func(v *TermView, p proto.Protocol) mvc.View {
+		return v.NewPostgresView(p.(*proto.Postgres))
+	})
+}
+
+func (v *TermView) NewPostgresView(p *proto.Postgres) *PostgresView {
+	y, h := v.allocRows(size + 5)
+	return newTermPostgresView(v.ctl, v, p, 0, y, h)
+}
+
+func newTermPostgresView(ctl mvc.Controller, termView *TermView, proto *proto.Postgres, x, y, h int) *PostgresView {
+	v := &PostgresView{
+		pgProto:  proto,
+		Queries:  util.NewRing(size),
+		area:     NewArea(x, y, 70, h),
+		shutdown: make(chan int),
+		termView: termView,
+		Logger:   log.NewPrefixLogger("view", "term", "postgres"),
+	}
+	ctl.Go(v.Run)
+	return v
+}
+
+func (v *PostgresView) Run() {
+	updates := v.pgProto.Txns.Reg()
+	defer v.pgProto.Txns.UnReg(updates)
+
+	for {
+		select {
+		case txn := <-updates:
+			v.Debug("Got Postgres update")
+			if !txn.(*proto.PostgresTxn).Done {
+				v.Queries.Add(txn)
+			}
+			v.Render()
+
+		case <-v.shutdown:
+			return
+		}
+	}
+}
+
+func (v *PostgresView) Render() {
+	// the terminal had no room left for the view
+	if v.h == 0 {
+		return
+	}
+
+	v.Clear()
+	v.Printf(0, 0, "Postgres Queries")
+	v.Printf(0, 1, "----------------")
+	msec := float64(time.Millisecond)
+	for i, obj := range v.Queries.Slice() {
+		if 3+i >= v.h {
+			break
+		}
+		txn := obj.(*proto.PostgresTxn)
+		v.Printf(0, 3+i, "%s", truncatePath(queryLine(txn)))
+		if !txn.Done {
+			continue
+		}
+
+		if txn.Error != nil {
+			v.APrintf(termbox.ColorRed, 30, 3+i, "%-*s", replyMaxLength, truncateReply(txn.Error.Code+" "+txn.Error.Message))
+		} else {
+			v.Printf(30, 3+i, "%-*s", replyMaxLength, truncateReply(resultLine(txn)))
+		}
+		v.Printf(31+replyMaxLength, 3+i, "%.2fms", float64(txn.Duration)/msec)
+	}
+	v.termView.Flush()
+}
+
+func (v *PostgresView) Shutdown() {
+	close(v.shutdown)
+}
+
+// the query text on a single line, or who logged in for a startup
+func queryLine(txn *proto.PostgresTxn) string {
+	if txn.Kind == proto.PgStartup {
+		return fmt.Sprintf("STARTUP %s@%s", txn.Params["user"], txn.Params["database"])
+	}
+	return collapseSpace(txn.Query)
+}
+
+func resultLine(txn *proto.PostgresTxn) string {
+	switch {
+	case txn.Kind == proto.PgStartup:
+		return "authenticated " + txn.AuthMethod
+	case len(txn.Tags) == 0:
+		return "(empty)"
+	default:
+		return fmt.Sprintf("%s (%d rows)", txn.Tags[len(txn.Tags)-1], txn.Rows)
+	}
+}
+
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
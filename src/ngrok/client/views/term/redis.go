@@ -0,0 +1,115 @@
+package term
+
+import (
+	"time"
+
+	termbox "github.com/nsf/termbox-go"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/client/mvc"
+	"github.com/inconshreveable/ngrok/src/ngrok/log"
+	"github.com/inconshreveable/ngrok/src/ngrok/proto"
+	"github.com/inconshreveable/ngrok/src/ngrok/util"
+)
+
+const replyMaxLength = 25
+
+type RedisView struct {
+	log.Logger
+	*area
+
+	redisProto *proto.Redis
+	Commands   *util.Ring
+	shutdown   chan int
+	termView   *TermView
+}
+
+func init() {
+	RegisterView("redis", func(v *TermView, p proto.Protocol) mvc.View {
+		return v.NewRedisView(p.(*proto.Redis))
+	})
+}
+
+func (v *TermView) NewRedisView(p *proto.Redis) *RedisView {
+	y, h := v.allocRows(size + 5)
+	return newTermRedisView(v.ctl, v, p, 0, y, h)
+}
+
+func newTermRedisView(ctl mvc.Controller, termView *TermView, proto *proto.Redis, x, y, h int) *RedisView {
+	v := &RedisView{
+		redisProto: proto,
+		Commands:   util.NewRing(size),
+		area:       NewArea(x, y, 70, h),
+		shutdown:   make(chan int),
+		termView:   termView,
+		Logger:     log.NewPrefixLogger("view", "term", "redis"),
+	}
+	ctl.Go(v.Run)
+	return v
+}
+
+func (v *RedisView) Run() {
+	updates := v.redisProto.Txns.Reg()
+	defer v.redisProto.Txns.UnReg(updates)
+
+	for {
+		select {
+		case txn := <-updates:
+			v.Debug("Got Redis update")
+			if txn.(*proto.RedisTxn).Reply == nil {
+				v.Commands.Add(txn)
+			}
+			v.Render()
+
+		case <-v.shutdown:
+			return
+		}
+	}
+}
+
+func (v *RedisView) Render() {
+	// the terminal had no room left for the view
+	if v.h == 0 {
+		return
+	}
+
+	v.Clear()
+	v.Printf(0, 0, "Redis Commands")
+	v.Printf(0, 1, "--------------")
+	msec := float64(time.Millisecond)
+	for i, obj := range v.Commands.Slice() {
+		if 3+i >= v.h {
+			break
+		}
+		txn := obj.(*proto.RedisTxn)
+		v.Printf(0, 3+i, "%s", truncatePath(commandLine(txn)))
+		if txn.Reply != nil {
+			color := termbox.ColorWhite
+			if txn.Reply.IsError() {
+				color = termbox.ColorRed
+			}
+			v.APrintf(color, 30, 3+i, "%-*s", replyMaxLength, truncateReply(txn.Reply.String()))
+			v.Printf(31+replyMaxLength, 3+i, "%.2fms", float64(txn.Duration)/msec)
+		}
+	}
+	v.termView.Flush()
+}
+
+func (v *RedisView) Shutdown() {
+	close(v.shutdown)
+}
+
+// the command name followed by its first argument, usually the key
+func commandLine(txn *proto.RedisTxn) string {
+	line := txn.Name()
+	if len(txn.Command) > 1 {
+		line += " " + txn.Command[1]
+	}
+	return line
+}
+
+func truncateReply(reply string) string {
+	if r := []rune(reply); len(r) > replyMaxLength {
+		return string(r[:replyMaxLength-3]) + "..."
+	}
+	return reply
+}
@@ -10,6 +10,18 @@ import (
 	"time"
 )
 
+// ViewFactory creates the terminal view for a protocol analyzer
+type ViewFactory func(v *TermView, p proto.Protocol) mvc.View
+
+// terminal views of the protocol analyzers, keyed by analyzer name
+var viewFactories = make(map[string]ViewFactory)
+
+// RegisterView makes the terminal view for the named protocol analyzer
+// available. It should be called from an init() function.
+func RegisterView(name string, factory ViewFactory) {
+	viewFactories[name] = factory
+}
+
 type TermView struct {
 	ctl      mvc.Controller
 	updates  chan interface{}
@@ -17,6 +29,7 @@ type TermView struct {
 	shutdown chan int
 	redraw   *util.Broadcast
 	subviews []mvc.View
+	nextRow  int
 	log.Logger
 	*area
 }
@@ -35,6 +48,7 @@ func NewTermView(ctl mvc.Controller) *TermView {
 		shutdown: make(chan int),
 		Logger:   log.NewPrefixLogger("view", "term"),
 		area:     NewArea(0, 0, w, 10),
+		nextRow:  12,
 	}
 
 	ctl.Go(v.run)
@@ -104,7 +118,25 @@ func (v *TermView) draw() {
 	v.Printf(0, 3, "%-30s%s/%s", "Version", state.GetClientVersion(), state.GetServerVersion())
 	var i int = 4
 	for _, t := range state.GetTunnels() {
-		v.Printf(0, i, "%-30s%s -> %s", "Forwarding", t.PublicUrl, t.LocalAddr)
+		upstreams := state.GetUpstreams(t)
+		if len(upstreams) == 0 {
+			v.Printf(0, i, "%-30s%s -> %s", "Forwarding", t.PublicUrl, t.LocalAddr)
+			i++
+			continue
+		}
+
+		v.Printf(0, i, "%-30s%s ->", "Forwarding", t.PublicUrl)
+		x := 30 + len(t.PublicUrl) + 3
+		for _, u := range upstreams {
+			health, color := "up", termbox.ColorGreen
+			if !u.Healthy {
+				health, color = "down", termbox.ColorRed
+			}
+			v.Printf(x, i, " %s", u.Addr)
+			x += len(u.Addr) + 1
+			v.APrintf(color, x, i, " (%s)", health)
+			x += len(health) + 3
+		}
 		i++
 	}
 	v.Printf(0, i+0, "%-30s%s", "Web Interface", v.ctl.GetWebInspectAddr())
@@ -154,7 +186,29 @@ func (v *TermView) Flush() {
 }
 
 func (v *TermView) NewHttpView(p *proto.Http) *HttpView {
-	return newTermHttpView(v.ctl, v, p, 0, 12)
+	y, h := v.allocRows(size + 5)
+	return newTermHttpView(v.ctl, v, p, 0, y, h)
+}
+
+// NewProtocolView creates the terminal view registered for the protocol
+// analyzer, or returns nil if it doesn't have one
+func (v *TermView) NewProtocolView(p proto.Protocol) mvc.View {
+	factory, ok := viewFactories[p.GetName()]
+	if !ok {
+		return nil
+	}
+	return factory(v, p)
+}
+
+// reserves rows below the tunnel status for a protocol view and returns
+// the first of them, and how many it got. Views get fewer rows, or none,
+// when the terminal isn't tall enough for them.
+func (v *TermView) allocRows(h int) (int, int) {
+	_, height := termbox.Size()
+	y := v.nextRow
+	h = max(0, min(h, height-y))
+	v.nextRow += h
+	return y, h
 }
 
 func (v *TermView) input() {
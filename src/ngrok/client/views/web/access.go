@@ -0,0 +1,124 @@
+package web
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Access controls who may use the web inspection interface. Captured
+// traffic often contains secrets and replay lets a caller send requests
+// to the local services, so besides optional authentication the interface
+// rejects requests that other web sites make on behalf of a browser.
+type Access struct {
+	// "user:password" for HTTP basic authentication
+	BasicAuth string
+
+	// token accepted as "Authorization: Bearer <token>"
+	Token string
+
+	// host names besides loopback ones the interface may be reached by.
+	// Requests for other hosts are rejected to defeat DNS rebinding,
+	// unless the interface is public and this is empty.
+	Hosts []string
+
+	// whether the interface listens on a non-loopback address
+	Public bool
+}
+
+func (a Access) authRequired() bool {
+	return a.BasicAuth != "" || a.Token != ""
+}
+
+// guard wraps the handler of the inspection interface with the checks
+// configured by the access settings
+func (wv *WebView) guard(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !wv.access.allowedHost(r.Host) {
+			wv.Warn("Rejected request for host %s, possible DNS rebinding attack", r.Host)
+			http.Error(w, "Invalid Host header", 403)
+			return
+		}
+
+		if !sameOrigin(r) {
+			wv.Warn("Rejected cross-origin %s %s from %s", r.Method, r.URL.Path, r.Header.Get("Origin"))
+			http.Error(w, "Cross-origin requests are not allowed", 403)
+			return
+		}
+
+		if !wv.access.authorized(r) {
+			if wv.access.BasicAuth != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="ngrok"`)
+			}
+			http.Error(w, http.StatusText(401), 401)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (a Access) allowedHost(hostport string) bool {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+
+	if host == "localhost" {
+		return true
+	}
+
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return true
+	}
+
+	for _, allowed := range a.Hosts {
+		if strings.EqualFold(host, allowed) {
+			return true
+		}
+	}
+
+	return a.Public && len(a.Hosts) == 0
+}
+
+func (a Access) authorized(r *http.Request) bool {
+	if !a.authRequired() {
+		return true
+	}
+
+	if a.Token != "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			return subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1
+		}
+	}
+
+	if a.BasicAuth != "" {
+		if user, password, ok := r.BasicAuth(); ok {
+			return subtle.ConstantTimeCompare([]byte(user+":"+password), []byte(a.BasicAuth)) == 1
+		}
+	}
+
+	return false
+}
+
+// Browsers can't read the responses to cross-origin requests, but they
+// still send them, and websockets aren't subject to the same-origin policy
+// at all. Requests that may have effects, and websocket handshakes, must
+// come from the inspection interface itself or from outside a browser.
+func sameOrigin(r *http.Request) bool {
+	safe := r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS"
+	if safe && !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return true
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return r.Header.Get("Sec-Fetch-Site") != "cross-site"
+	}
+
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
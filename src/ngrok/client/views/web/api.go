@@ -0,0 +1,211 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/client/mvc"
+)
+
+// prefix of the versioned JSON API on the inspect address. Errors are
+// returned as an ApiError with an appropriate status code.
+const apiPrefix = "/api/v1"
+
+type ApiError struct {
+	Error string
+}
+
+type ApiStatus struct {
+	ConnStatus    string
+	ClientVersion string
+	ServerVersion string
+	Tunnels       []ApiTunnel
+	Metrics       ApiMetrics
+}
+
+type ApiTunnel struct {
+	Name      string
+	PublicUrl string
+	LocalAddr string
+	Inspect   string // the protocol analyzer inspecting the tunnel's traffic
+
+	// the health of each local address, for tunnels which have several
+	Upstreams []mvc.UpstreamStatus `json:",omitempty"`
+}
+
+// metrics of all of the connections through the client's tunnels.
+// Durations are in nanoseconds.
+type ApiMetrics struct {
+	Connections  int64
+	ConnRate1    float64
+	ConnRate5    float64
+	ConnRate15   float64
+	ConnDuration ApiPercentiles
+	BytesIn      int64
+	BytesOut     int64
+	ConnBytesIn  ApiPercentiles
+	ConnBytesOut ApiPercentiles
+}
+
+type ApiPercentiles struct {
+	Mean float64
+	P50  float64
+	P90  float64
+	P95  float64
+	P99  float64
+}
+
+type ReplayResponse struct {
+	Status   int
+	Duration int64
+	Error    string
+	Warning  string `json:",omitempty"`
+}
+
+// registers the API of the client itself:
+//
+//	GET /api/v1/tunnels  the connection status, tunnels and metrics
+func (wv *WebView) registerApi() {
+	http.HandleFunc("GET "+apiPrefix+"/tunnels", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, apiStatus(wv.ctl.State()))
+	})
+
+	// keep unknown API requests from being redirected to the web interface
+	http.HandleFunc(apiPrefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		writeApiError(w, 404, fmt.Errorf("No API endpoint %s %s", r.Method, r.URL.Path))
+	})
+}
+
+// registers the API for the captured HTTP transactions:
+//
+//	GET    /api/v1/requests              captured requests, newest first,
+//	                                     at most limit of them
+//	GET    /api/v1/requests/{id}         a captured request with its response
+//	POST   /api/v1/requests/{id}/replay  replays a request and waits for it to
+//	                                     complete, see makeReplay for the form
+//	POST   /api/v1/replay                replays many requests, see serveBulkReplay
+//	DELETE /api/v1/requests              forgets the captured requests
+func (whv *WebHttpView) registerApi() {
+	http.HandleFunc("GET "+apiPrefix+"/requests", func(w http.ResponseWriter, r *http.Request) {
+		txns := whv.HttpRequests.Slice()
+		if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && limit >= 0 && limit < len(txns) {
+			txns = txns[:limit]
+		}
+
+		writeJson(w, map[string]interface{}{"Requests": txns})
+	})
+
+	http.HandleFunc("GET "+apiPrefix+"/requests/{id}", func(w http.ResponseWriter, r *http.Request) {
+		txn, ok := whv.getTxn(r.PathValue("id"))
+		if !ok {
+			writeApiError(w, 404, fmt.Errorf("No captured request with id %s", r.PathValue("id")))
+			return
+		}
+
+		writeJson(w, txn)
+	})
+
+	http.HandleFunc("POST "+apiPrefix+"/requests/{id}/replay", func(w http.ResponseWriter, r *http.Request) {
+		txn, ok := whv.getTxn(r.PathValue("id"))
+		if !ok {
+			writeApiError(w, 404, fmt.Errorf("No captured request with id %s", r.PathValue("id")))
+			return
+		}
+
+		r.ParseForm()
+		replay, err := makeReplay(txn, r.Form)
+		if err != nil {
+			writeApiError(w, 400, err)
+			return
+		}
+
+		replay.Result = make(chan mvc.ReplayResult, 1)
+		whv.ctl.PlayRequest(replay)
+
+		select {
+		case result := <-replay.Result:
+			resp := ReplayResponse{Status: result.Status, Duration: result.Duration.Nanoseconds()}
+			if result.Err != nil {
+				resp.Error = result.Err.Error()
+			}
+			if !isEdited(r.Form) {
+				resp.Warning = replayWarning(txn)
+			}
+			writeJson(w, resp)
+
+		case <-r.Context().Done():
+		}
+	})
+
+	http.HandleFunc("POST "+apiPrefix+"/replay", whv.serveBulkReplay)
+
+	http.HandleFunc("DELETE "+apiPrefix+"/requests", func(w http.ResponseWriter, r *http.Request) {
+		whv.clearTxns()
+		w.WriteHeader(204)
+	})
+}
+
+func apiStatus(state mvc.State) ApiStatus {
+	connMeter, connTimer := state.GetConnectionMetrics()
+	bytesInCount, bytesIn := state.GetBytesInMetrics()
+	bytesOutCount, bytesOut := state.GetBytesOutMetrics()
+
+	status := ApiStatus{
+		ConnStatus:    connStatusName(state.GetConnStatus()),
+		ClientVersion: state.GetClientVersion(),
+		ServerVersion: state.GetServerVersion(),
+		Tunnels:       make([]ApiTunnel, 0),
+		Metrics: ApiMetrics{
+			Connections:  connMeter.Count(),
+			ConnRate1:    connMeter.Rate1(),
+			ConnRate5:    connMeter.Rate5(),
+			ConnRate15:   connMeter.Rate15(),
+			ConnDuration: percentiles(connTimer.Mean(), connTimer.Percentiles),
+			BytesIn:      bytesInCount.Count(),
+			BytesOut:     bytesOutCount.Count(),
+			ConnBytesIn:  percentiles(bytesIn.Mean(), bytesIn.Percentiles),
+			ConnBytesOut: percentiles(bytesOut.Mean(), bytesOut.Percentiles),
+		},
+	}
+
+	for _, t := range state.GetTunnels() {
+		status.Tunnels = append(status.Tunnels, ApiTunnel{
+			Name:      t.Name,
+			PublicUrl: t.PublicUrl,
+			LocalAddr: t.LocalAddr,
+			Inspect:   t.Protocol.GetName(),
+			Upstreams: state.GetUpstreams(t),
+		})
+	}
+	return status
+}
+
+func percentiles(mean float64, fn func([]float64) []float64) ApiPercentiles {
+	ps := fn([]float64{0.5, 0.9, 0.95, 0.99})
+	return ApiPercentiles{Mean: mean, P50: ps[0], P90: ps[1], P95: ps[2], P99: ps[3]}
+}
+
+func connStatusName(status mvc.ConnStatus) string {
+	switch status {
+	case mvc.ConnConnecting:
+		return "connecting"
+	case mvc.ConnReconnecting:
+		return "reconnecting"
+	case mvc.ConnOnline:
+		return "online"
+	}
+	return "unknown"
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeApiError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ApiError{Error: err.Error()})
+}
@@ -0,0 +1,296 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/client/har"
+	"github.com/inconshreveable/ngrok/src/ngrok/client/mvc"
+)
+
+const (
+	maxBulkConcurrency = 64
+	maxBulkRequests    = 100000
+
+	// upper bound on the size of uploaded HAR files kept in memory
+	maxHarUpload = 32 << 20
+)
+
+type BulkReplayOptions struct {
+	Concurrency int
+	Rate        float64 // requests per second, 0 for no limit
+	Repeat      int
+}
+
+type BulkReplaySummary struct {
+	Requests          int
+	Failed            int // replays which didn't get a response
+	Statuses          map[int]int
+	Errors            map[string]int
+	Duration          int64
+	RequestsPerSecond float64
+	Latency           LatencySummary
+	Warnings          []string `json:",omitempty"`
+}
+
+// latencies of the replays which got a response, in nanoseconds
+type LatencySummary struct {
+	Min  int64
+	Mean int64
+	P50  int64
+	P90  int64
+	P95  int64
+	P99  int64
+	Max  int64
+}
+
+// replays the captured requests given by their txnid form values, or the
+// requests of an uploaded HAR file, in order and waits for all of them to
+// complete
+func (whv *WebHttpView) serveBulkReplay(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(maxHarUpload); err != nil && err != http.ErrNotMultipart {
+		writeApiError(w, 400, err)
+		return
+	}
+
+	opts, err := parseBulkReplayOptions(r.Form)
+	if err != nil {
+		writeApiError(w, 400, err)
+		return
+	}
+
+	replays, status, err := whv.bulkReplays(r)
+	if err != nil {
+		writeApiError(w, status, err)
+		return
+	}
+
+	if len(replays) == 0 {
+		writeApiError(w, 400, fmt.Errorf("Specify the requests to replay with txnid or upload a har file"))
+		return
+	}
+
+	if len(replays)*opts.Repeat > maxBulkRequests {
+		writeApiError(w, 400, fmt.Errorf("Refusing to replay more than %d requests at once", maxBulkRequests))
+		return
+	}
+
+	whv.Info("Replaying %d requests %d times with concurrency %d", len(replays), opts.Repeat, opts.Concurrency)
+	summary := runBulkReplay(r.Context(), whv.ctl, replays, opts)
+	for _, txnid := range r.Form["txnid"] {
+		if txn, ok := whv.getTxn(txnid); ok {
+			if warning := replayWarning(txn); warning != "" {
+				summary.Warnings = append(summary.Warnings, txnid+": "+warning)
+			}
+		}
+	}
+	writeJson(w, summary)
+}
+
+func parseBulkReplayOptions(form url.Values) (opts BulkReplayOptions, err error) {
+	opts = BulkReplayOptions{Concurrency: 1, Repeat: 1}
+
+	if v := form.Get("concurrency"); v != "" {
+		if opts.Concurrency, err = strconv.Atoi(v); err != nil || opts.Concurrency < 1 || opts.Concurrency > maxBulkConcurrency {
+			return opts, fmt.Errorf("concurrency must be between 1 and %d", maxBulkConcurrency)
+		}
+	}
+
+	if v := form.Get("repeat"); v != "" {
+		if opts.Repeat, err = strconv.Atoi(v); err != nil || opts.Repeat < 1 {
+			return opts, fmt.Errorf("repeat must be at least 1")
+		}
+	}
+
+	if v := form.Get("rate"); v != "" {
+		if opts.Rate, err = strconv.ParseFloat(v, 64); err != nil || opts.Rate < 0 {
+			return opts, fmt.Errorf("rate must be a positive number of requests per second")
+		}
+	}
+	return opts, nil
+}
+
+// the replays selected by a bulk replay request and, if that fails,
+// the status code to respond with
+func (whv *WebHttpView) bulkReplays(r *http.Request) (replays []mvc.Replay, status int, err error) {
+	target := url.Values{"target": {r.Form.Get("target")}}
+
+	for _, txnid := range r.Form["txnid"] {
+		txn, ok := whv.getTxn(txnid)
+		if !ok {
+			return nil, 404, fmt.Errorf("No captured request with id %s", txnid)
+		}
+
+		replay, err := makeReplay(txn, target)
+		if err != nil {
+			return nil, 400, err
+		}
+		replays = append(replays, replay)
+	}
+
+	file, _, err := r.FormFile("har")
+	if err == http.ErrMissingFile {
+		return replays, 0, nil
+	} else if err != nil {
+		return nil, 400, err
+	}
+	defer file.Close()
+
+	var archive har.Har
+	if err = json.NewDecoder(file).Decode(&archive); err != nil {
+		return nil, 400, fmt.Errorf("Invalid HAR file: %v", err)
+	}
+
+	tunnels := whv.ctl.State().GetTunnels()
+	for i, e := range archive.Log.Entries {
+		payload, err := e.Request.Raw()
+		if err != nil {
+			return nil, 400, fmt.Errorf("Invalid request in HAR entry %d: %v", i, err)
+		}
+
+		tunnel, ok := tunnelForUrl(tunnels, e.Request.Url)
+		if !ok {
+			return nil, 400, fmt.Errorf("There is no running http tunnel to replay the HAR file through")
+		}
+
+		replays = append(replays, mvc.Replay{Tunnel: tunnel, Payload: payload, Target: target.Get("target")})
+	}
+	return replays, 0, nil
+}
+
+// the tunnel whose public url the request was sent to, otherwise
+// any http tunnel
+func tunnelForUrl(tunnels []mvc.Tunnel, rawUrl string) (t mvc.Tunnel, ok bool) {
+	if u, err := url.Parse(rawUrl); err == nil {
+		for _, t := range tunnels {
+			if t.PublicUrl == u.Scheme+"://"+u.Host {
+				return t, true
+			}
+		}
+	}
+
+	for _, t := range tunnels {
+		if t.Protocol.GetName() == "http" {
+			return t, true
+		}
+	}
+	return
+}
+
+// runBulkReplay plays the replays in order, repeatedly, and summarizes
+// their outcomes. At most opts.Concurrency replays are in flight and new
+// ones start no faster than opts.Rate per second.
+func runBulkReplay(ctx context.Context, ctl mvc.Controller, replays []mvc.Replay, opts BulkReplayOptions) BulkReplaySummary {
+	jobs := make(chan mvc.Replay)
+	results := make(chan mvc.ReplayResult)
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for replay := range jobs {
+				replay.Result = make(chan mvc.ReplayResult, 1)
+				ctl.PlayRequest(replay)
+				results <- <-replay.Result
+			}
+		}()
+	}
+
+	go func() {
+		defer func() {
+			close(jobs)
+			wg.Wait()
+			close(results)
+		}()
+
+		var tick <-chan time.Time
+		if opts.Rate > 0 {
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.Rate))
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		for i := 0; i < opts.Repeat; i++ {
+			for j, replay := range replays {
+				// the first request doesn't wait for the rate limit
+				if tick != nil && (i > 0 || j > 0) {
+					select {
+					case <-tick:
+					case <-ctx.Done():
+						return
+					}
+				}
+
+				select {
+				case jobs <- replay:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	summary := BulkReplaySummary{
+		Statuses: make(map[int]int),
+		Errors:   make(map[string]int),
+	}
+
+	start := time.Now()
+	var latencies []time.Duration
+	for result := range results {
+		summary.Requests++
+		if result.Err != nil {
+			summary.Failed++
+			summary.Errors[result.Err.Error()]++
+			continue
+		}
+
+		summary.Statuses[result.Status]++
+		latencies = append(latencies, result.Duration)
+	}
+
+	elapsed := time.Since(start)
+	summary.Duration = elapsed.Nanoseconds()
+	if elapsed > 0 {
+		summary.RequestsPerSecond = float64(summary.Requests) / elapsed.Seconds()
+	}
+	summary.Latency = summarizeLatencies(latencies)
+	return summary
+}
+
+func summarizeLatencies(latencies []time.Duration) (s LatencySummary) {
+	if len(latencies) == 0 {
+		return
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	var total time.Duration
+	for _, l := range latencies {
+		total += l
+	}
+
+	// nearest-rank percentiles
+	percentile := func(p int) int64 {
+		rank := (p*len(latencies) + 99) / 100
+		return latencies[rank-1].Nanoseconds()
+	}
+
+	return LatencySummary{
+		Min:  latencies[0].Nanoseconds(),
+		Mean: (total / time.Duration(len(latencies))).Nanoseconds(),
+		P50:  percentile(50),
+		P90:  percentile(90),
+		P95:  percentile(95),
+		P99:  percentile(99),
+		Max:  latencies[len(latencies)-1].Nanoseconds(),
+	}
+}
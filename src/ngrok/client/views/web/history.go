@@ -0,0 +1,132 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/client/store"
+)
+
+// summary of a stored request, as listed by the history API
+type HistoryEntry struct {
+	Id         string
+	Start      time.Time
+	Duration   int64
+	Tunnel     string
+	ClientAddr string
+	Method     string
+	Url        string
+	Status     int
+	ReplayOf   string
+}
+
+// ServeHistory exposes the durable request history on the inspect address:
+//
+//	GET    /api/v1/history       lists the requests matching the query parameters
+//	                             method, path, status (e.g. 404 or 4xx), header,
+//	                             body, since, until (RFC 3339) and limit
+//	GET    /api/v1/history/{id}  returns a stored request with its response
+//	DELETE /api/v1/history       deletes all of the stored requests
+//
+// GET /api/requests and /api/requests/{id}, where the history was served
+// before the versioned API, are kept for existing callers.
+func (wv *WebView) ServeHistory(s *store.Store) {
+	find := func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseHistoryQuery(r)
+		if err != nil {
+			writeApiError(w, 400, err)
+			return
+		}
+
+		records, err := s.Find(q)
+		if err != nil {
+			wv.Error("Failed to query request history: %v", err)
+			writeApiError(w, 500, err)
+			return
+		}
+
+		entries := make([]HistoryEntry, len(records))
+		for i, rec := range records {
+			entries[i] = HistoryEntry{
+				Id:         rec.Id,
+				Start:      rec.Start,
+				Duration:   rec.Duration.Nanoseconds(),
+				Tunnel:     rec.Tunnel,
+				ClientAddr: rec.ClientAddr,
+				Method:     rec.Method,
+				Url:        rec.Url,
+				Status:     rec.Status,
+				ReplayOf:   rec.ReplayOf,
+			}
+		}
+
+		writeJson(w, map[string]interface{}{"Requests": entries})
+	}
+
+	get := func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		rec, err := s.Get(id)
+		if os.IsNotExist(err) {
+			writeApiError(w, 404, fmt.Errorf("No stored request with id %s", id))
+			return
+		} else if err != nil {
+			wv.Error("Failed to read request %s from history: %v", id, err)
+			writeApiError(w, 500, err)
+			return
+		}
+
+		writeJson(w, rec)
+	}
+
+	http.HandleFunc("GET "+apiPrefix+"/history", find)
+	http.HandleFunc("GET "+apiPrefix+"/history/{id}", get)
+	http.HandleFunc("GET /api/requests", find)
+	http.HandleFunc("GET /api/requests/{id}", get)
+
+	http.HandleFunc("DELETE "+apiPrefix+"/history", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.Clear(); err != nil {
+			wv.Error("Failed to clear request history: %v", err)
+			writeApiError(w, 500, err)
+			return
+		}
+		w.WriteHeader(204)
+	})
+}
+
+func parseHistoryQuery(r *http.Request) (q store.Query, err error) {
+	params := r.URL.Query()
+	q.Method = params.Get("method")
+	q.Path = params.Get("path")
+	q.Header = params.Get("header")
+	q.Body = params.Get("body")
+
+	if status := params.Get("status"); strings.HasSuffix(status, "xx") {
+		q.StatusClass, err = strconv.Atoi(strings.TrimSuffix(status, "xx"))
+	} else if status != "" {
+		q.Status, err = strconv.Atoi(status)
+	}
+	if err != nil {
+		return
+	}
+
+	if since := params.Get("since"); since != "" {
+		if q.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return
+		}
+	}
+
+	if until := params.Get("until"); until != "" {
+		if q.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return
+		}
+	}
+
+	if limit := params.Get("limit"); limit != "" {
+		q.Limit, err = strconv.Atoi(limit)
+	}
+	return
+}
@@ -2,19 +2,28 @@
 package web
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/xml"
+	"fmt"
 	"github.com/inconshreveable/ngrok/src/ngrok/client/assets"
+	"github.com/inconshreveable/ngrok/src/ngrok/client/decode"
+	"github.com/inconshreveable/ngrok/src/ngrok/client/har"
 	"github.com/inconshreveable/ngrok/src/ngrok/client/mvc"
+	"github.com/inconshreveable/ngrok/src/ngrok/client/redact"
 	"github.com/inconshreveable/ngrok/src/ngrok/log"
 	"github.com/inconshreveable/ngrok/src/ngrok/proto"
 	"github.com/inconshreveable/ngrok/src/ngrok/util"
 	"html/template"
+	"io"
 	"net/http"
 	"net/http/httputil"
+	"net/textproto"
 	"net/url"
 	"strings"
+	"sync"
 	"unicode/utf8"
 )
 
@@ -36,6 +45,15 @@ type SerializedBody struct {
 	Error          string
 	ErrorOffset    int
 	Form           url.Values
+
+	// the Content-Encoding which was decoded and the length of the body
+	// as it was sent
+	Encoding      string
+	EncodedLength int
+
+	Binary  bool
+	Parts   []decode.Part
+	Message *decode.Message
 }
 
 type SerializedRequest struct {
@@ -45,14 +63,18 @@ type SerializedRequest struct {
 	Header     http.Header
 	Body       SerializedBody
 	Binary     bool
+	Trailer    http.Header
+	Redacted   []string
 }
 
 type SerializedResponse struct {
-	Raw    string
-	Status string
-	Header http.Header
-	Body   SerializedBody
-	Binary bool
+	Raw      string
+	Status   string
+	Header   http.Header
+	Body     SerializedBody
+	Binary   bool
+	Trailer  http.Header
+	Redacted []string
 }
 
 type WebHttpView struct {
@@ -64,10 +86,14 @@ type WebHttpView struct {
 	state        chan SerializedUiState
 	HttpRequests *util.Ring
 	idToTxn      map[string]*SerializedTxn
+	txnLock      sync.Mutex
 }
 
 type SerializedUiState struct {
 	Tunnels []mvc.Tunnel
+
+	// the upstreams of tunnels with several, keyed by public url
+	Upstreams map[string][]mvc.UpstreamStatus
 }
 
 type SerializedPayload struct {
@@ -75,6 +101,12 @@ type SerializedPayload struct {
 	UiState SerializedUiState
 }
 
+func init() {
+	RegisterView("http", func(wv *WebView, p proto.Protocol) mvc.View {
+		return wv.NewHttpView(p.(*proto.Http))
+	})
+}
+
 func newWebHttpView(ctl mvc.Controller, wv *WebView, proto *proto.Http) *WebHttpView {
 	whv := &WebHttpView{
 		Logger:       log.NewPrefixLogger("view", "web", "http"),
@@ -86,6 +118,7 @@ func newWebHttpView(ctl mvc.Controller, wv *WebView, proto *proto.Http) *WebHttp
 	}
 	ctl.Go(whv.updateHttp)
 	whv.register()
+	whv.registerApi()
 	return whv
 }
 
@@ -93,13 +126,27 @@ type XMLDoc struct {
 	data []byte `xml:",innerxml"`
 }
 
-func makeBody(h http.Header, body []byte) SerializedBody {
-	b := SerializedBody{
-		Length:      len(body),
-		Text:        base64.StdEncoding.EncodeToString(body),
-		ErrorOffset: -1,
+// makeBody serializes the body of the request to path, or of its response,
+// decoding it for display
+func (whv *WebHttpView) makeBody(h http.Header, body []byte, path string, response bool) SerializedBody {
+	b := SerializedBody{ErrorOffset: -1}
+
+	if encoding := h.Get("Content-Encoding"); encoding != "" && len(body) > 0 {
+		decoded, err := decode.ContentEncoding(encoding, body)
+		if err != nil {
+			b.Length, b.Binary = len(body), !utf8.Valid(body)
+			b.Text = base64.StdEncoding.EncodeToString(body)
+			b.RawContentType = h.Get("Content-Type")
+			b.Error = err.Error()
+			return b
+		}
+		b.Encoding, b.EncodedLength, body = encoding, len(body), decoded
 	}
 
+	b.Length = len(body)
+	b.Text = base64.StdEncoding.EncodeToString(body)
+	b.Binary = !utf8.Valid(body)
+
 	// some errors like XML errors only give a line number
 	// and not an exact offset
 	offsetForLine := func(line int) int {
@@ -132,6 +179,14 @@ func makeBody(h http.Header, body []byte) SerializedBody {
 
 		case "application/x-www-form-urlencoded":
 			b.Form, err = url.ParseQuery(string(body))
+
+		case "multipart/form-data", "multipart/mixed", "multipart/related":
+			b.Parts, err = decode.Multipart(b.RawContentType, body)
+
+		default:
+			if whv.webview.protobuf != nil {
+				b.Message, err = whv.webview.protobuf.Decode(b.RawContentType, path, response, body)
+			}
 		}
 	}
 
@@ -160,9 +215,9 @@ func (whv *WebHttpView) updateHttp() {
 				continue
 			}
 
-			body := makeBody(htxn.Req.Header, htxn.Req.BodyBytes)
+			body := whv.makeBody(htxn.Req.Header, htxn.Req.BodyBytes, htxn.Req.URL.Path, false)
 			whtxn := &SerializedTxn{
-				Id:      util.RandId(8),
+				Id:      htxn.Id,
 				HttpTxn: htxn,
 				Req: SerializedRequest{
 					MethodPath: htxn.Req.Method + " " + htxn.Req.URL.Path,
@@ -171,16 +226,15 @@ func (whv *WebHttpView) updateHttp() {
 					Header:     htxn.Req.Header,
 					Body:       body,
 					Binary:     !utf8.Valid(rawReq),
+					Trailer:    htxn.Req.Trailer,
+					Redacted:   htxn.Req.Redacted,
 				},
 				Start:   htxn.Start.Unix(),
 				ConnCtx: htxn.ConnUserCtx.(mvc.ConnectionContext),
 			}
 
 			htxn.UserCtx = whtxn
-			// XXX: unsafe map access from multiple go routines
-			whv.idToTxn[whtxn.Id] = whtxn
-			// XXX: use return value to delete from map so we don't leak memory
-			whv.HttpRequests.Add(whtxn)
+			whv.addTxn(whtxn)
 		} else {
 			rawResp, err := httputil.DumpResponse(htxn.Resp.Response, true)
 			if err != nil {
@@ -189,14 +243,16 @@ func (whv *WebHttpView) updateHttp() {
 			}
 
 			txn := htxn.UserCtx.(*SerializedTxn)
-			body := makeBody(htxn.Resp.Header, htxn.Resp.BodyBytes)
+			body := whv.makeBody(htxn.Resp.Header, htxn.Resp.BodyBytes, htxn.Req.URL.Path, true)
 			txn.Duration = htxn.Duration.Nanoseconds()
 			txn.Resp = SerializedResponse{
-				Status: htxn.Resp.Status,
-				Raw:    base64.StdEncoding.EncodeToString(rawResp),
-				Header: htxn.Resp.Header,
-				Body:   body,
-				Binary: !utf8.Valid(rawResp),
+				Status:   htxn.Resp.Status,
+				Raw:      base64.StdEncoding.EncodeToString(rawResp),
+				Header:   htxn.Resp.Header,
+				Body:     body,
+				Binary:   !utf8.Valid(rawResp),
+				Trailer:  htxn.Resp.Trailer,
+				Redacted: htxn.Resp.Redacted,
 			}
 
 			payload, err := json.Marshal(txn)
@@ -220,18 +276,39 @@ func (whv *WebHttpView) register() {
 
 		r.ParseForm()
 		txnid := r.Form.Get("txnid")
-		if txn, ok := whv.idToTxn[txnid]; ok {
-			reqBytes, err := base64.StdEncoding.DecodeString(txn.Req.Raw)
+		if txn, ok := whv.getTxn(txnid); ok {
+			replay, err := makeReplay(txn, r.Form)
 			if err != nil {
-				panic(err)
+				http.Error(w, err.Error(), 400)
+				return
 			}
-			whv.ctl.PlayRequest(txn.ConnCtx.Tunnel, reqBytes)
+
+			whv.ctl.PlayRequest(replay)
 			w.Write([]byte(http.StatusText(200)))
 		} else {
 			http.Error(w, http.StatusText(400), 400)
 		}
 	})
 
+	http.HandleFunc("/http/in/har", func(w http.ResponseWriter, r *http.Request) {
+		archive := har.New()
+
+		// the ring holds the newest transactions first
+		txns := whv.HttpRequests.Slice()
+		for i := len(txns) - 1; i >= 0; i-- {
+			txn := txns[i].(*SerializedTxn)
+			if txn.HttpTxn.Resp != nil {
+				archive.Log.Entries = append(archive.Log.Entries, har.FromTxn(txn.HttpTxn))
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="ngrok.har"`)
+		if err := json.NewEncoder(w).Encode(archive); err != nil {
+			whv.Warn("Failed to write HAR: %v", err)
+		}
+	})
+
 	http.HandleFunc("/http/in", func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if r := recover(); r != nil {
@@ -250,7 +327,7 @@ func (whv *WebHttpView) register() {
 
 		payloadData := SerializedPayload{
 			Txns:    whv.HttpRequests.Slice(),
-			UiState: SerializedUiState{Tunnels: whv.ctl.State().GetTunnels()},
+			UiState: uiState(whv.ctl.State()),
 		}
 
 		payload, err := json.Marshal(payloadData)
@@ -265,5 +342,151 @@ func (whv *WebHttpView) register() {
 	})
 }
 
+func uiState(state mvc.State) SerializedUiState {
+	s := SerializedUiState{Tunnels: state.GetTunnels(), Upstreams: make(map[string][]mvc.UpstreamStatus)}
+	for _, t := range s.Tunnels {
+		if upstreams := state.GetUpstreams(t); len(upstreams) > 0 {
+			s.Upstreams[t.PublicUrl] = upstreams
+		}
+	}
+	return s
+}
+
 func (whv *WebHttpView) Shutdown() {
 }
+
+func (whv *WebHttpView) addTxn(txn *SerializedTxn) {
+	whv.txnLock.Lock()
+	defer whv.txnLock.Unlock()
+
+	whv.idToTxn[txn.Id] = txn
+	if old := whv.HttpRequests.Add(txn); old != nil {
+		delete(whv.idToTxn, old.(*SerializedTxn).Id)
+	}
+}
+
+func (whv *WebHttpView) getTxn(id string) (*SerializedTxn, bool) {
+	whv.txnLock.Lock()
+	defer whv.txnLock.Unlock()
+
+	txn, ok := whv.idToTxn[id]
+	return txn, ok
+}
+
+// forgets all of the captured transactions
+func (whv *WebHttpView) clearTxns() {
+	whv.txnLock.Lock()
+	defer whv.txnLock.Unlock()
+
+	whv.idToTxn = make(map[string]*SerializedTxn)
+	whv.HttpRequests.Clear()
+}
+
+// makeReplay builds the replay of a captured transaction from the form
+// values posted to a replay endpoint, applying any edits to the request
+func makeReplay(txn *SerializedTxn, form url.Values) (replay mvc.Replay, err error) {
+	payload, err := base64.StdEncoding.DecodeString(txn.Req.Raw)
+	if err != nil {
+		return
+	}
+
+	if isEdited(form) {
+		if payload, err = editRequest(payload, form); err != nil {
+			return
+		}
+	}
+
+	replay = mvc.Replay{
+		Tunnel:   txn.ConnCtx.Tunnel,
+		Payload:  payload,
+		ReplayOf: txn.Id,
+		Target:   strings.TrimSpace(form.Get("target")),
+	}
+	return
+}
+
+// replayWarning explains why the replay of a captured request may not
+// behave like the original, or returns "" if it should
+func replayWarning(txn *SerializedTxn) string {
+	if len(txn.Req.Redacted) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("The captured request was redacted (%s), the replay sends %s in their place",
+		strings.Join(txn.Req.Redacted, ", "), redact.Placeholder)
+}
+
+// the parts of a request which can be edited before it is replayed
+var editableParts = []string{"method", "path", "headers", "body"}
+
+func isEdited(form url.Values) bool {
+	for _, part := range editableParts {
+		if _, ok := form[part]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// editRequest applies the edits submitted from the inspector to a raw
+// request. Each of the method, path, headers and body form values replaces
+// that part of the request when it is present. Headers are given one per
+// line as "Name: value", Content-Length is always recomputed.
+func editRequest(raw []byte, form url.Values) ([]byte, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := form["method"]; ok {
+		req.Method = strings.ToUpper(strings.TrimSpace(form.Get("method")))
+	}
+
+	if _, ok := form["path"]; ok {
+		if req.URL, err = url.ParseRequestURI(strings.TrimSpace(form.Get("path"))); err != nil {
+			return nil, fmt.Errorf("Invalid path: %v", err)
+		}
+	}
+
+	if _, ok := form["headers"]; ok {
+		headers := strings.TrimSpace(form.Get("headers")) + "\r\n\r\n"
+		mimeHeader, err := textproto.NewReader(bufio.NewReader(strings.NewReader(headers))).ReadMIMEHeader()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid headers: %v", err)
+		}
+
+		req.Header = http.Header(mimeHeader)
+		if host := req.Header.Get("Host"); host != "" {
+			req.Host = host
+		}
+		req.Header.Del("Host")
+
+		// an empty User-Agent stops Write from adding its own
+		if _, ok := req.Header["User-Agent"]; !ok {
+			req.Header.Set("User-Agent", "")
+		}
+	}
+
+	if _, ok := form["body"]; ok {
+		body = []byte(form.Get("body"))
+	}
+
+	req.Header.Del("Content-Length")
+	req.Header.Del("Transfer-Encoding")
+	req.TransferEncoding = nil
+	req.ContentLength = int64(len(body))
+	req.Body = nil
+	if len(body) > 0 {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	var buf bytes.Buffer
+	if err = req.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
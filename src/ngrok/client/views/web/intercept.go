@@ -0,0 +1,83 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/client/intercept"
+)
+
+// the message sent to the websocket connections when the paused
+// requests change
+type InterceptsMessage struct {
+	Intercepts []intercept.Pending
+}
+
+// ServeIntercepts exposes the requests paused by intercept rules:
+//
+//	GET  /api/v1/intercepts               lists the paused requests, oldest first
+//	POST /api/v1/intercepts/{id}/forward  forwards a paused request, edited by the
+//	                                      form values method, path, headers and body
+//	POST /api/v1/intercepts/{id}/drop     closes the connection of a paused request
+func (wv *WebView) ServeIntercepts(hub *intercept.Hub) {
+	http.HandleFunc("GET "+apiPrefix+"/intercepts", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, hub.Pending())
+	})
+
+	http.HandleFunc("POST "+apiPrefix+"/intercepts/{id}/forward", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		var d intercept.Decision
+		if r.ParseForm(); isEdited(r.Form) {
+			p, ok := findPending(hub, id)
+			if !ok {
+				writeApiError(w, 404, fmt.Errorf("No paused request with id %s", id))
+				return
+			}
+
+			var err error
+			if d.Payload, err = editRequest(p.Raw, r.Form); err != nil {
+				writeApiError(w, 400, err)
+				return
+			}
+		}
+
+		if err := hub.Resolve(id, d); err != nil {
+			writeApiError(w, 404, err)
+			return
+		}
+		w.WriteHeader(204)
+	})
+
+	http.HandleFunc("POST "+apiPrefix+"/intercepts/{id}/drop", func(w http.ResponseWriter, r *http.Request) {
+		if err := hub.Resolve(r.PathValue("id"), intercept.Decision{Drop: true}); err != nil {
+			writeApiError(w, 404, err)
+			return
+		}
+		w.WriteHeader(204)
+	})
+
+	wv.ctl.Go(func() {
+		updates := hub.Updates.Reg()
+		defer hub.Updates.UnReg(updates)
+
+		for pending := range updates {
+			payload, err := json.Marshal(InterceptsMessage{Intercepts: pending.([]intercept.Pending)})
+			if err != nil {
+				wv.Error("Failed to serialize paused requests: %v", err)
+				continue
+			}
+			wv.wsMessages.In() <- payload
+		}
+	})
+}
+
+func findPending(hub *intercept.Hub, id string) (intercept.Pending, bool) {
+	for _, p := range hub.Pending() {
+		if p.Id == id {
+			return p, true
+		}
+	}
+	return intercept.Pending{}, false
+}
@@ -0,0 +1,102 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/client/mvc"
+	"github.com/inconshreveable/ngrok/src/ngrok/log"
+	"github.com/inconshreveable/ngrok/src/ngrok/proto"
+	"github.com/inconshreveable/ngrok/src/ngrok/util"
+)
+
+type SerializedPgTxn struct {
+	Id         string
+	Kind       string
+	Query      string
+	Truncated  bool
+	Params     map[string]string
+	AuthMethod string
+	Tags       []string
+	Rows       int64
+	Error      *proto.PostgresError
+	Done       bool
+	Start      int64
+	Duration   int64
+	ConnCtx    mvc.ConnectionContext
+}
+
+// WebPostgresView serves the queries captured by the Postgres
+// analyzer as JSON on /postgres/in
+type WebPostgresView struct {
+	log.Logger
+
+	ctl     mvc.Controller
+	pgProto *proto.Postgres
+	Queries *util.Ring
+}
+
+func init() {
+	RegisterView("postgres", func(wv *WebView, p proto.Protocol) mvc.View {
+		return wv.NewPostgresView(p.(*proto.Postgres))
+	})
+}
+
+func (wv *WebView) NewPostgresView(p *proto.Postgres) *WebPostgresView {
+	wpv := &WebPostgresView{
+		Logger:  log.NewPrefixLogger("view", "web", "postgres"),
+		ctl:     wv.ctl,
+		pgProto: p,
+		Queries: util.NewRing(20),
+	}
+	wv.ctl.Go(wpv.updatePostgres)
+	wpv.register()
+	return wpv
+}
+
+func (wpv *WebPostgresView) updatePostgres() {
+	for obj := range wpv.pgProto.Txns.Reg() {
+		// XXX: like the http view, this races with the analyzer filling in the txn
+		txn := obj.(*proto.PostgresTxn)
+		if !txn.Done {
+			txn.UserCtx = util.RandId(8)
+			wpv.Queries.Add(txn)
+		}
+	}
+}
+
+func serializePgTxn(txn *proto.PostgresTxn) SerializedPgTxn {
+	s := SerializedPgTxn{
+		Kind:       txn.Kind,
+		Query:      txn.Query,
+		Truncated:  txn.Truncated,
+		Params:     txn.Params,
+		AuthMethod: txn.AuthMethod,
+		Tags:       txn.Tags,
+		Rows:       txn.Rows,
+		Error:      txn.Error,
+		Done:       txn.Done,
+		Start:      txn.Start.Unix(),
+		Duration:   txn.Duration.Nanoseconds(),
+	}
+	s.Id, _ = txn.UserCtx.(string)
+	s.ConnCtx, _ = txn.ConnUserCtx.(mvc.ConnectionContext)
+	return s
+}
+
+func (wpv *WebPostgresView) register() {
+	http.HandleFunc("/postgres/in", func(w http.ResponseWriter, r *http.Request) {
+		txns := make([]SerializedPgTxn, 0)
+		for _, obj := range wpv.Queries.Slice() {
+			txns = append(txns, serializePgTxn(obj.(*proto.PostgresTxn)))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(txns); err != nil {
+			wpv.Warn("Failed to write postgres queries: %v", err)
+		}
+	})
+}
+
+func (wpv *WebPostgresView) Shutdown() {
+}
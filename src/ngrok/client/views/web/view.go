@@ -4,6 +4,7 @@ package web
 import (
 	"github.com/gorilla/websocket"
 	"github.com/inconshreveable/ngrok/src/ngrok/client/assets"
+	"github.com/inconshreveable/ngrok/src/ngrok/client/decode"
 	"github.com/inconshreveable/ngrok/src/ngrok/client/mvc"
 	"github.com/inconshreveable/ngrok/src/ngrok/log"
 	"github.com/inconshreveable/ngrok/src/ngrok/proto"
@@ -11,20 +12,39 @@ import (
 	"net/http"
 )
 
+// ViewFactory creates the web view for a protocol analyzer
+type ViewFactory func(wv *WebView, p proto.Protocol) mvc.View
+
+// web views of the protocol analyzers, keyed by analyzer name
+var viewFactories = make(map[string]ViewFactory)
+
+// RegisterView makes the web view for the named protocol analyzer
+// available. It should be called from an init() function.
+func RegisterView(name string, factory ViewFactory) {
+	viewFactories[name] = factory
+}
+
 type WebView struct {
 	log.Logger
 
 	ctl mvc.Controller
 
+	// who may use the interface
+	access Access
+
 	// messages sent over this broadcast are sent to all websocket connections
 	wsMessages *util.Broadcast
+
+	// decodes protobuf bodies, if a descriptor set was given
+	protobuf *decode.Protobuf
 }
 
-func NewWebView(ctl mvc.Controller, addr string) *WebView {
+func NewWebView(ctl mvc.Controller, addr string, access Access) *WebView {
 	wv := &WebView{
 		Logger:     log.NewPrefixLogger("view", "web"),
 		wsMessages: util.NewBroadcast(),
 		ctl:        ctl,
+		access:     access,
 	}
 
 	// for now, always redirect to the http view
@@ -64,14 +84,36 @@ func NewWebView(ctl mvc.Controller, addr string) *WebView {
 		w.Write(buf)
 	})
 
+	wv.registerApi()
+
+	if access.Public && !access.authRequired() {
+		wv.Warn("Serving web interface on the non-loopback address %s without authentication", addr)
+	}
+
 	wv.Info("Serving web interface on %s", addr)
-	wv.ctl.Go(func() { http.ListenAndServe(addr, nil) })
+	wv.ctl.Go(func() { http.ListenAndServe(addr, wv.guard(http.DefaultServeMux)) })
 	return wv
 }
 
+// DecodeProtobuf shows the protobuf bodies described by p as JSON. It must
+// be called before the protocol views are created.
+func (wv *WebView) DecodeProtobuf(p *decode.Protobuf) {
+	wv.protobuf = p
+}
+
 func (wv *WebView) NewHttpView(proto *proto.Http) *WebHttpView {
 	return newWebHttpView(wv.ctl, wv, proto)
 }
 
+// NewProtocolView creates the web view registered for the protocol
+// analyzer, or returns nil if it doesn't have one
+func (wv *WebView) NewProtocolView(p proto.Protocol) mvc.View {
+	factory, ok := viewFactories[p.GetName()]
+	if !ok {
+		return nil
+	}
+	return factory(wv, p)
+}
+
 func (wv *WebView) Shutdown() {
 }
@@ -0,0 +1,117 @@
+// Shared state of a cluster of ngrokd nodes
+//
+// Each node of a cluster serves the tunnels of the clients connected to
+// it. The Registry records which node owns each tunnel url and each
+// client's control connection, so that a node receiving a public or proxy
+// connection it can't serve itself knows which node to forward it to.
+//
+// Registries are pluggable: backends register a url scheme with Register
+// and nodes open them with Open. The built in backends are http:// and
+// https://, a registry served by NewHandler which nodes in separate
+// processes share, and memory://test, which lets several nodes share state
+// within one process.
+package cluster
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// how long a node stays a member without renewing its lease, nodes renew
+// it every LeaseTTL/3
+const LeaseTTL = 30 * time.Second
+
+var ErrUnknownNode = errors.New("Not a member of the cluster, the lease expired")
+
+// Node is a member of the cluster
+type Node struct {
+	Id string
+
+	// the address of the node's inter-node link, where other nodes
+	// forward connections to it
+	Addr string
+}
+
+type Registry interface {
+	// Join announces a node, or updates its address. A node which joins
+	// again, e.g. after a restart, no longer owns anything.
+	Join(n Node) error
+
+	// Renew extends the lease of a node. A node whose lease runs out,
+	// e.g. because it crashed, is removed and releases everything it
+	// owned; Renew then fails with ErrUnknownNode and the node must join
+	// again.
+	Renew(nodeId string) error
+
+	// Leave removes a node and releases everything it owned
+	Leave(nodeId string) error
+
+	// Node looks up a node by its id, ok is false if it isn't a member
+	Node(nodeId string) (n Node, ok bool, err error)
+
+	// ClaimTunnel makes a node the owner of a tunnel url, it fails if
+	// another node already owns it, or with ErrUnknownNode if the node
+	// isn't a member
+	ClaimTunnel(url, nodeId string) error
+
+	// ReleaseTunnel gives up a tunnel url, if the node still owns it
+	ReleaseTunnel(url, nodeId string) error
+
+	// TunnelOwner returns the id of the node owning a tunnel url, or ""
+	TunnelOwner(url string) (nodeId string, err error)
+
+	// ClaimControl makes a node the owner of a client's control
+	// connection. Clients reconnect to any node, so the newest claim wins.
+	// It fails with ErrUnknownNode if the node isn't a member.
+	ClaimControl(clientId, nodeId string) error
+
+	// ReleaseControl gives up a control connection, if the node still
+	// owns it
+	ReleaseControl(clientId, nodeId string) error
+
+	// ControlOwner returns the id of the node owning a client's control
+	// connection, or ""
+	ControlOwner(clientId string) (nodeId string, err error)
+}
+
+// how a node connects to its registry
+type Config struct {
+	// the secret shared by the nodes of the cluster
+	Secret string
+
+	// for registries reached over TLS, nil for the defaults
+	TLSConfig *tls.Config
+}
+
+var (
+	backendsLock sync.Mutex
+	backends     = make(map[string]func(u *url.URL, cfg Config) (Registry, error))
+)
+
+// Register makes a registry backend available to Open under a url scheme
+func Register(scheme string, open func(u *url.URL, cfg Config) (Registry, error)) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	backends[scheme] = open
+}
+
+// Open connects to the registry at a url, its scheme picks the backend
+func Open(rawUrl string, cfg Config) (Registry, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	backendsLock.Lock()
+	open, ok := backends[u.Scheme]
+	backendsLock.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("No cluster registry backend for scheme '%s'", u.Scheme)
+	}
+	return open(u, cfg)
+}
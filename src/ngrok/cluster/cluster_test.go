@@ -0,0 +1,148 @@
+package cluster
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClaimTunnel(t *testing.T) {
+	r := NewMemoryRegistry()
+	r.Join(Node{Id: "a", Addr: "10.0.0.1:4444"})
+	r.Join(Node{Id: "b", Addr: "10.0.0.2:4444"})
+
+	const url = "https://demo.example.com"
+	steps := []struct {
+		name      string
+		op        func() error
+		wantErr   bool
+		wantOwner string
+	}{
+		{"claim", func() error { return r.ClaimTunnel(url, "a") }, false, "a"},
+		{"claim again", func() error { return r.ClaimTunnel(url, "a") }, false, "a"},
+		{"conflict", func() error { return r.ClaimTunnel(url, "b") }, true, "a"},
+		{"release by another node", func() error { return r.ReleaseTunnel(url, "b") }, false, "a"},
+		{"release", func() error { return r.ReleaseTunnel(url, "a") }, false, ""},
+		{"claim after the release", func() error { return r.ClaimTunnel(url, "b") }, false, "b"},
+		{"claim by a stranger", func() error { return r.ClaimTunnel("https://other.example.com", "c") }, true, "b"},
+		{"leave", func() error { return r.Leave("b") }, false, ""},
+		{"claim after leaving", func() error { return r.ClaimTunnel(url, "b") }, true, ""},
+	}
+
+	for _, step := range steps {
+		if err := step.op(); (err != nil) != step.wantErr {
+			t.Errorf("%s: error %v, want error %v", step.name, err, step.wantErr)
+		}
+
+		if owner, _ := r.TunnelOwner(url); owner != step.wantOwner {
+			t.Errorf("%s: owner %q, want %q", step.name, owner, step.wantOwner)
+		}
+	}
+}
+
+func TestClaimControl(t *testing.T) {
+	r := NewMemoryRegistry()
+	r.Join(Node{Id: "a"})
+	r.Join(Node{Id: "b"})
+
+	// the newest claim wins, the client reconnected to another node
+	r.ClaimControl("client", "a")
+	r.ClaimControl("client", "b")
+	r.ReleaseControl("client", "a")
+	if owner, _ := r.ControlOwner("client"); owner != "b" {
+		t.Errorf("owner %q, want b", owner)
+	}
+
+	// joining again, after a restart, gives up what the node owned
+	r.Join(Node{Id: "b"})
+	if owner, _ := r.ControlOwner("client"); owner != "" {
+		t.Errorf("owner %q after joining again, want none", owner)
+	}
+}
+
+func TestLease(t *testing.T) {
+	r := NewMemoryRegistry()
+	r.ttl = 50 * time.Millisecond
+
+	r.Join(Node{Id: "a"})
+	r.Join(Node{Id: "b"})
+	r.ClaimTunnel("https://a.example.com", "a")
+	r.ClaimControl("client", "a")
+	r.ClaimTunnel("https://b.example.com", "b")
+
+	// b renews its lease, a has crashed
+	for i := 0; i < 4; i++ {
+		time.Sleep(20 * time.Millisecond)
+		if err := r.Renew("b"); err != nil {
+			t.Fatalf("Renew: %v", err)
+		}
+	}
+
+	if _, ok, _ := r.Node("a"); ok {
+		t.Errorf("node a is still a member after its lease expired")
+	}
+	if owner, _ := r.TunnelOwner("https://a.example.com"); owner != "" {
+		t.Errorf("the tunnel of an expired node is owned by %q", owner)
+	}
+	if owner, _ := r.ControlOwner("client"); owner != "" {
+		t.Errorf("the control of an expired node is owned by %q", owner)
+	}
+	if owner, _ := r.TunnelOwner("https://b.example.com"); owner != "b" {
+		t.Errorf("the tunnel of a live node is owned by %q", owner)
+	}
+
+	// other nodes can take over what a owned, a must join again
+	if err := r.ClaimTunnel("https://a.example.com", "b"); err != nil {
+		t.Errorf("claim of an expired node's tunnel: %v", err)
+	}
+	if err := r.Renew("a"); err != ErrUnknownNode {
+		t.Errorf("Renew of an expired node: %v, want ErrUnknownNode", err)
+	}
+}
+
+func TestHttpRegistry(t *testing.T) {
+	handler, err := NewHandler(NewMemoryRegistry(), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	r, err := Open(server.URL, Config{Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.Join(Node{Id: "a", Addr: "10.0.0.1:4444"}); err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+
+	if n, ok, err := r.Node("a"); err != nil || !ok || n.Addr != "10.0.0.1:4444" {
+		t.Errorf("Node = %+v, %v, %v", n, ok, err)
+	}
+
+	if err = r.ClaimTunnel("https://demo.example.com", "a"); err != nil {
+		t.Errorf("ClaimTunnel: %v", err)
+	}
+
+	if err = r.ClaimTunnel("https://demo.example.com", "b"); err != ErrUnknownNode {
+		t.Errorf("claim by a stranger: %v, want ErrUnknownNode", err)
+	}
+
+	if owner, err := r.TunnelOwner("https://demo.example.com"); err != nil || owner != "a" {
+		t.Errorf("TunnelOwner = %q, %v, want a", owner, err)
+	}
+
+	if err = r.Renew("b"); err != ErrUnknownNode {
+		t.Errorf("Renew of a stranger: %v, want ErrUnknownNode", err)
+	}
+
+	wrong, _ := Open(server.URL, Config{Secret: "wrong"})
+	if err = wrong.Renew("a"); err == nil {
+		t.Errorf("a registry call with the wrong secret succeeded")
+	}
+
+	if _, err = Open(server.URL, Config{}); err == nil {
+		t.Errorf("Open without a secret succeeded")
+	}
+}
@@ -0,0 +1,226 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+func init() {
+	open := func(u *url.URL, cfg Config) (Registry, error) {
+		return NewHttpRegistry(u.String(), cfg)
+	}
+	Register("http", open)
+	Register("https", open)
+}
+
+const (
+	// how long a registry call may take
+	httpTimeout = 10 * time.Second
+
+	// the largest request a registry accepts
+	maxRequestSize = 64 * 1024
+)
+
+// the request and response of every registry call, each call uses the
+// fields it needs
+type httpRequest struct {
+	Node     Node
+	NodeId   string `json:",omitempty"`
+	Url      string `json:",omitempty"`
+	ClientId string `json:",omitempty"`
+}
+
+type httpResponse struct {
+	Error  string `json:",omitempty"`
+	Node   Node
+	Ok     bool   `json:",omitempty"`
+	NodeId string `json:",omitempty"`
+}
+
+// HttpRegistry is a registry served by NewHandler, usually by the ngrokd
+// cluster-registry command, which all nodes of a cluster connect to
+type HttpRegistry struct {
+	base   string
+	secret string
+	client *http.Client
+}
+
+func NewHttpRegistry(rawUrl string, cfg Config) (*HttpRegistry, error) {
+	if cfg.Secret == "" {
+		return nil, fmt.Errorf("A cluster registry needs the cluster secret")
+	}
+
+	return &HttpRegistry{
+		base:   strings.TrimSuffix(rawUrl, "/"),
+		secret: cfg.Secret,
+		client: &http.Client{
+			Timeout:   httpTimeout,
+			Transport: &http.Transport{TLSClientConfig: cfg.TLSConfig},
+		},
+	}, nil
+}
+
+// call runs a registry operation on the server
+func (r *HttpRegistry) call(op string, req httpRequest) (*httpResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest("POST", r.base+"/v1/"+op, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+r.secret)
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := r.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Cluster registry %s failed with status %s", op, httpResp.Status)
+	}
+
+	var resp httpResponse
+	if err = json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("Invalid response of the cluster registry: %v", err)
+	}
+
+	if resp.Error == ErrUnknownNode.Error() {
+		return nil, ErrUnknownNode
+	} else if resp.Error != "" {
+		return nil, fmt.Errorf("%s", resp.Error)
+	}
+	return &resp, nil
+}
+
+func (r *HttpRegistry) Join(n Node) error {
+	_, err := r.call("join", httpRequest{Node: n})
+	return err
+}
+
+func (r *HttpRegistry) Renew(nodeId string) error {
+	_, err := r.call("renew", httpRequest{NodeId: nodeId})
+	return err
+}
+
+func (r *HttpRegistry) Leave(nodeId string) error {
+	_, err := r.call("leave", httpRequest{NodeId: nodeId})
+	return err
+}
+
+func (r *HttpRegistry) Node(nodeId string) (Node, bool, error) {
+	resp, err := r.call("node", httpRequest{NodeId: nodeId})
+	if err != nil {
+		return Node{}, false, err
+	}
+	return resp.Node, resp.Ok, nil
+}
+
+func (r *HttpRegistry) ClaimTunnel(url, nodeId string) error {
+	_, err := r.call("claim-tunnel", httpRequest{Url: url, NodeId: nodeId})
+	return err
+}
+
+func (r *HttpRegistry) ReleaseTunnel(url, nodeId string) error {
+	_, err := r.call("release-tunnel", httpRequest{Url: url, NodeId: nodeId})
+	return err
+}
+
+func (r *HttpRegistry) TunnelOwner(url string) (string, error) {
+	resp, err := r.call("tunnel-owner", httpRequest{Url: url})
+	if err != nil {
+		return "", err
+	}
+	return resp.NodeId, nil
+}
+
+func (r *HttpRegistry) ClaimControl(clientId, nodeId string) error {
+	_, err := r.call("claim-control", httpRequest{ClientId: clientId, NodeId: nodeId})
+	return err
+}
+
+func (r *HttpRegistry) ReleaseControl(clientId, nodeId string) error {
+	_, err := r.call("release-control", httpRequest{ClientId: clientId, NodeId: nodeId})
+	return err
+}
+
+func (r *HttpRegistry) ControlOwner(clientId string) (string, error) {
+	resp, err := r.call("control-owner", httpRequest{ClientId: clientId})
+	if err != nil {
+		return "", err
+	}
+	return resp.NodeId, nil
+}
+
+// NewHandler serves registry to the nodes of a cluster, which must present
+// the secret
+func NewHandler(registry Registry, secret string) (http.Handler, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("A cluster registry needs the cluster secret")
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req httpRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxRequestSize)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		var resp httpResponse
+		var err error
+		switch strings.TrimPrefix(r.URL.Path, "/v1/") {
+		case "join":
+			err = registry.Join(req.Node)
+		case "renew":
+			err = registry.Renew(req.NodeId)
+		case "leave":
+			err = registry.Leave(req.NodeId)
+		case "node":
+			resp.Node, resp.Ok, err = registry.Node(req.NodeId)
+		case "claim-tunnel":
+			err = registry.ClaimTunnel(req.Url, req.NodeId)
+		case "release-tunnel":
+			err = registry.ReleaseTunnel(req.Url, req.NodeId)
+		case "tunnel-owner":
+			resp.NodeId, err = registry.TunnelOwner(req.Url)
+		case "claim-control":
+			err = registry.ClaimControl(req.ClientId, req.NodeId)
+		case "release-control":
+			err = registry.ReleaseControl(req.ClientId, req.NodeId)
+		case "control-owner":
+			resp.NodeId, err = registry.ControlOwner(req.ClientId)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+
+		if err != nil {
+			resp.Error = err.Error()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&resp)
+	}), nil
+}
@@ -0,0 +1,190 @@
+package cluster
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+func init() {
+	Register("memory", func(u *url.URL, cfg Config) (Registry, error) {
+		return Memory(u.Host), nil
+	})
+}
+
+var (
+	memoryLock       sync.Mutex
+	memoryRegistries = make(map[string]*MemoryRegistry)
+)
+
+// MemoryRegistry keeps the state of a cluster whose nodes all run in the
+// same process, which is mostly useful for testing
+type MemoryRegistry struct {
+	sync.Mutex
+	nodes    map[string]Node
+	tunnels  map[string]string
+	controls map[string]string
+
+	// when the lease of each node expires
+	leases map[string]time.Time
+	ttl    time.Duration
+}
+
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{
+		nodes:    make(map[string]Node),
+		tunnels:  make(map[string]string),
+		controls: make(map[string]string),
+		leases:   make(map[string]time.Time),
+		ttl:      LeaseTTL,
+	}
+}
+
+// Memory returns the in-process registry with the given name, nodes which
+// open the same name share it
+func Memory(name string) *MemoryRegistry {
+	memoryLock.Lock()
+	defer memoryLock.Unlock()
+
+	r, ok := memoryRegistries[name]
+	if !ok {
+		r = NewMemoryRegistry()
+		memoryRegistries[name] = r
+	}
+	return r
+}
+
+func (r *MemoryRegistry) Join(n Node) error {
+	r.Lock()
+	defer r.Unlock()
+
+	r.release(n.Id)
+	r.nodes[n.Id] = n
+	r.leases[n.Id] = time.Now().Add(r.ttl)
+	return nil
+}
+
+func (r *MemoryRegistry) Renew(nodeId string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	r.expire()
+	if _, ok := r.nodes[nodeId]; !ok {
+		return ErrUnknownNode
+	}
+
+	r.leases[nodeId] = time.Now().Add(r.ttl)
+	return nil
+}
+
+func (r *MemoryRegistry) Leave(nodeId string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	r.release(nodeId)
+	return nil
+}
+
+// expire removes the nodes whose leases ran out, must hold the lock
+func (r *MemoryRegistry) expire() {
+	now := time.Now()
+	for nodeId, expiry := range r.leases {
+		if now.After(expiry) {
+			r.release(nodeId)
+		}
+	}
+}
+
+// release removes a node and everything it owned, must hold the lock
+func (r *MemoryRegistry) release(nodeId string) {
+	delete(r.nodes, nodeId)
+	delete(r.leases, nodeId)
+
+	for url, owner := range r.tunnels {
+		if owner == nodeId {
+			delete(r.tunnels, url)
+		}
+	}
+
+	for clientId, owner := range r.controls {
+		if owner == nodeId {
+			delete(r.controls, clientId)
+		}
+	}
+}
+
+func (r *MemoryRegistry) Node(nodeId string) (Node, bool, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.expire()
+	n, ok := r.nodes[nodeId]
+	return n, ok, nil
+}
+
+func (r *MemoryRegistry) ClaimTunnel(url, nodeId string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	r.expire()
+	if _, ok := r.nodes[nodeId]; !ok {
+		return ErrUnknownNode
+	}
+
+	if owner, ok := r.tunnels[url]; ok && owner != nodeId {
+		return fmt.Errorf("The tunnel %s is already registered on node %s.", url, owner)
+	}
+
+	r.tunnels[url] = nodeId
+	return nil
+}
+
+func (r *MemoryRegistry) ReleaseTunnel(url, nodeId string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.tunnels[url] == nodeId {
+		delete(r.tunnels, url)
+	}
+	return nil
+}
+
+func (r *MemoryRegistry) TunnelOwner(url string) (string, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.expire()
+	return r.tunnels[url], nil
+}
+
+func (r *MemoryRegistry) ClaimControl(clientId, nodeId string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	r.expire()
+	if _, ok := r.nodes[nodeId]; !ok {
+		return ErrUnknownNode
+	}
+
+	r.controls[clientId] = nodeId
+	return nil
+}
+
+func (r *MemoryRegistry) ReleaseControl(clientId, nodeId string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.controls[clientId] == nodeId {
+		delete(r.controls, clientId)
+	}
+	return nil
+}
+
+func (r *MemoryRegistry) ControlOwner(clientId string) (string, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.expire()
+	return r.controls[clientId], nil
+}
@@ -12,12 +12,17 @@ import (
 	"net/http"
 	"net/url"
 	"sync"
+	"time"
 
 	vhost "github.com/inconshreveable/go-vhost"
 
 	"github.com/inconshreveable/ngrok/src/ngrok/log"
+	"github.com/inconshreveable/ngrok/src/ngrok/proxyproto"
 )
 
+// how long a trusted load balancer has to send the PROXY header
+const proxyHeaderTimeout = 10 * time.Second
+
 type Conn interface {
 	net.Conn
 	log.Logger
@@ -46,16 +51,33 @@ func wrapConn(conn net.Conn, typ string) *loggedConn {
 		return &loggedConn{wrapped.tcp, conn, wrapped.Logger, wrapped.id, wrapped.typ}
 	case *loggedConn:
 		return c
+	case *proxyproto.Conn:
+		tcp, _ := c.Conn.(*net.TCPConn)
+		wrapped := &loggedConn{tcp, conn, log.NewPrefixLogger(), rand.Int31(), typ}
+		wrapped.AddLogPrefix(wrapped.Id())
+		return wrapped
 	case *net.TCPConn:
 		wrapped := &loggedConn{c, conn, log.NewPrefixLogger(), rand.Int31(), typ}
 		wrapped.AddLogPrefix(wrapped.Id())
 		return wrapped
+	case nil:
+		return nil
 	}
 
-	return nil
+	// in-memory connections, e.g. the pipes of intercepted tunnels
+	wrapped := &loggedConn{nil, conn, log.NewPrefixLogger(), rand.Int31(), typ}
+	wrapped.AddLogPrefix(wrapped.Id())
+	return wrapped
 }
 
 func Listen(addr, typ string, tlsCfg *tls.Config) (l *Listener, err error) {
+	return ListenProxied(addr, typ, tlsCfg, nil)
+}
+
+// ListenProxied is Listen for a listener behind load balancers which send
+// PROXY protocol headers. Connections from the trusted networks must start
+// with one, and report the address of the client it names.
+func ListenProxied(addr, typ string, tlsCfg *tls.Config, trusted proxyproto.Trusted) (l *Listener, err error) {
 	// listen for incoming connections
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -67,6 +89,21 @@ func Listen(addr, typ string, tlsCfg *tls.Config) (l *Listener, err error) {
 		Conns: make(chan *loggedConn),
 	}
 
+	accept := func(rawConn net.Conn) {
+		c, err := WrapProxied(rawConn, typ, trusted)
+		if err != nil {
+			log.Warn("Failed to read PROXY header from %v: %v", rawConn.RemoteAddr(), err)
+			rawConn.Close()
+			return
+		}
+
+		if tlsCfg != nil {
+			c.Conn = tls.Server(c.Conn, tlsCfg)
+		}
+		c.Info("New connection from %v", c.RemoteAddr())
+		l.Conns <- c
+	}
+
 	go func() {
 		for {
 			rawConn, err := listener.Accept()
@@ -75,17 +112,31 @@ func Listen(addr, typ string, tlsCfg *tls.Config) (l *Listener, err error) {
 				continue
 			}
 
-			c := wrapConn(rawConn, typ)
-			if tlsCfg != nil {
-				c.Conn = tls.Server(c.Conn, tlsCfg)
+			// don't hold up other connections while waiting for a header
+			if trusted.Contains(rawConn.RemoteAddr()) {
+				go accept(rawConn)
+			} else {
+				accept(rawConn)
 			}
-			c.Info("New connection from %v", c.RemoteAddr())
-			l.Conns <- c
 		}
 	}()
 	return
 }
 
+// WrapProxied wraps a connection which was just accepted, first reading
+// its PROXY header if it comes from one of the trusted networks
+func WrapProxied(rawConn net.Conn, typ string, trusted proxyproto.Trusted) (*loggedConn, error) {
+	if !trusted.Contains(rawConn.RemoteAddr()) {
+		return wrapConn(rawConn, typ), nil
+	}
+
+	proxied, err := proxyproto.Accept(rawConn, proxyHeaderTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return wrapConn(proxied, typ), nil
+}
+
 func Wrap(conn net.Conn, typ string) *loggedConn {
 	return wrapConn(conn, typ)
 }
@@ -209,6 +260,9 @@ func (c *loggedConn) CloseRead() error {
 	// connection termination. Unfortunately, when I've tried that, I've observed
 	// failures where the connection was closed *before* flushing its write buffer,
 	// set with SetLinger() set properly (which it is by default).
+	if c.tcp == nil {
+		return nil
+	}
 	return c.tcp.CloseRead()
 }
 
@@ -0,0 +1,170 @@
+// Error responses written to the public side of tunnels
+//
+// Pages are rendered in the format the request prefers: JSON for API
+// clients, HTML from a Go template for browsers and plain text otherwise.
+package errpage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Data is what a template can render
+type Data struct {
+	Status     int
+	StatusText string
+	Message    string
+
+	// the host the request was sent to
+	Host string
+
+	// the tunnel and its local service, empty on the server
+	PublicUrl string
+	LocalAddr string
+}
+
+type Page struct {
+	Status int
+
+	// extra headers sent with the page, e.g. WWW-Authenticate
+	Header http.Header
+
+	// renders text/html responses, nil to only offer text and JSON
+	html *template.Template
+}
+
+func New(status int, htmlTemplate string) (*Page, error) {
+	p := &Page{Status: status, Header: make(http.Header)}
+	if htmlTemplate != "" {
+		t, err := template.New("page").Parse(htmlTemplate)
+		if err != nil {
+			return nil, err
+		}
+		p.html = t
+	}
+	return p, nil
+}
+
+// Load reads the HTML template of a page from a file
+func Load(status int, file string) (*Page, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := New(status, string(b))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid template %s: %v", file, err)
+	}
+	return p, nil
+}
+
+func Must(p *Page, err error) *Page {
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// Response renders a complete HTTP/1.0 response in the format preferred by
+// accept, the request's Accept header
+func (p *Page) Response(accept string, data Data) []byte {
+	data.Status = p.Status
+	data.StatusText = http.StatusText(p.Status)
+
+	offers := []string{"text/plain", "application/json"}
+	if p.html != nil {
+		// browsers accept */*, so HTML is also the default
+		offers = []string{"text/html", "application/json", "text/plain"}
+	}
+
+	var body []byte
+	contentType := negotiate(accept, offers)
+	switch contentType {
+	case "application/json":
+		body, _ = json.Marshal(struct {
+			Status int    `json:"status"`
+			Error  string `json:"error"`
+		}{data.Status, data.Message})
+		body = append(body, '\n')
+
+	case "text/html":
+		var buf bytes.Buffer
+		if err := p.html.Execute(&buf, data); err != nil {
+			contentType, body = "text/plain", []byte(data.Message+"\n")
+		} else {
+			body = buf.Bytes()
+		}
+
+	default:
+		body = []byte(data.Message + "\n")
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/1.0 %d %s\r\n", data.Status, data.StatusText)
+	header := p.Header.Clone()
+	header.Set("Content-Type", contentType+"; charset=utf-8")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	header.Write(&buf)
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// negotiate picks the offer with the highest quality in an Accept header,
+// preferring earlier offers when they're equal. The first offer is the
+// default when the header is empty or accepts none of them.
+func negotiate(accept string, offers []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+
+	best, bestQ := offers[0], 0.0
+	for _, offer := range offers {
+		if q := quality(accept, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// the quality the Accept header gives a media type, by its most specific
+// matching range
+func quality(accept, mediaType string) float64 {
+	q, specificity := 0.0, -1
+	for _, r := range strings.Split(accept, ",") {
+		params := strings.Split(r, ";")
+		rangeType := strings.ToLower(strings.TrimSpace(params[0]))
+
+		s := -1
+		switch {
+		case rangeType == mediaType:
+			s = 2
+		case strings.HasSuffix(rangeType, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(rangeType, "*")):
+			s = 1
+		case rangeType == "*/*":
+			s = 0
+		}
+
+		if s <= specificity {
+			continue
+		}
+
+		rq := 1.0
+		for _, param := range params[1:] {
+			if k, v, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.TrimSpace(k) == "q" {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					rq = f
+				}
+			}
+		}
+		q, specificity = rq, s
+	}
+	return q
+}
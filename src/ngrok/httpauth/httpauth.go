@@ -0,0 +1,309 @@
+// HTTP basic auth credentials of tunnels
+//
+// Clients don't send the passwords of their tunnels to the server, only
+// bcrypt hashes of them, in the form
+//
+//	user:$2a$10$<salt and hash>
+//
+// A tunnel can have several credentials, so each person sharing it can
+// have their own, which is revoked by removing it.
+package httpauth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// cost of new hashes, the hashes say which cost they were made with
+	Cost = bcrypt.DefaultCost
+
+	// hashes of a higher cost are refused, they'd let a client make the
+	// server spend seconds on every check
+	maxCost = 12
+
+	// how many successful authorizations are remembered, so that each
+	// request doesn't need a bcrypt comparison
+	maxCached = 1024
+
+	// how many failed attempts an address may make per minute, and in a
+	// burst, and how many addresses are tracked
+	failuresPerMinute = 10
+	failureBurst      = 20
+	maxClients        = 4096
+
+	// how many credentials a tunnel may have
+	MaxCredentials = 64
+
+	// bcrypt only hashes this many bytes of a password
+	maxPasswordLength = 72
+)
+
+type Credential struct {
+	User string
+	hash []byte
+}
+
+// Validate checks that user:password can be hashed
+func Validate(userPassword string) error {
+	user, password, ok := strings.Cut(userPassword, ":")
+	if !ok || user == "" {
+		return fmt.Errorf("Invalid http auth, expected 'user:password'")
+	}
+
+	if len(password) > maxPasswordLength {
+		return fmt.Errorf("The http auth password of user '%s' is longer than %d bytes", user, maxPasswordLength)
+	}
+	return nil
+}
+
+// Hash returns the credential of user:password to send to the server
+func Hash(userPassword string) (string, error) {
+	if err := Validate(userPassword); err != nil {
+		return "", err
+	}
+
+	user, password, _ := strings.Cut(userPassword, ":")
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), Cost)
+	if err != nil {
+		return "", fmt.Errorf("Failed to hash the http auth password of user '%s': %v", user, err)
+	}
+	return user + ":" + string(hash), nil
+}
+
+// Parse parses a credential made by Hash
+func Parse(hashed string) (*Credential, error) {
+	user, hash, ok := strings.Cut(hashed, ":")
+	if !ok || user == "" {
+		return nil, fmt.Errorf("Invalid http auth credential, expected 'user:hash'")
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid http auth credential for user '%s': %v", user, err)
+	}
+
+	if cost > maxCost {
+		return nil, fmt.Errorf("Http auth credential for user '%s' has cost %d, more than %d", user, cost, maxCost)
+	}
+	return &Credential{User: user, hash: []byte(hash)}, nil
+}
+
+// matches reports whether password is the credential's
+func (c *Credential) matches(password string) bool {
+	return bcrypt.CompareHashAndPassword(c.hash, []byte(password)) == nil
+}
+
+type Result int
+
+const (
+	Authorized Result = iota
+	Unauthorized
+
+	// too many attempts from the address failed recently, the credentials
+	// weren't checked
+	Limited
+)
+
+// Verifier checks the Authorization headers of a tunnel's requests
+type Verifier struct {
+	credentials map[string]*Credential
+
+	// compared with the passwords of unknown users, so the time taken
+	// doesn't tell which users exist
+	decoy *Credential
+
+	sync.Mutex
+	// SHA-256 hashes of Authorization headers which were authorized, and
+	// the users they're for
+	cache map[[sha256.Size]byte]string
+
+	// the attempts each client address may still fail
+	failures map[string]*allowance
+}
+
+// a token bucket of failed attempts
+type allowance struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the attempts earned since the last refill, must hold the
+// verifier's lock
+func (a *allowance) refill(now time.Time) float64 {
+	a.tokens = min(failureBurst, a.tokens+now.Sub(a.last).Minutes()*failuresPerMinute)
+	a.last = now
+	return a.tokens
+}
+
+// NewVerifier returns the verifier of hashed credentials, nil if there are
+// none
+func NewVerifier(hashed []string) (*Verifier, error) {
+	if len(hashed) == 0 {
+		return nil, nil
+	}
+
+	if len(hashed) > MaxCredentials {
+		return nil, fmt.Errorf("Too many http auth credentials, %d, at most %d are allowed", len(hashed), MaxCredentials)
+	}
+
+	v := &Verifier{
+		credentials: make(map[string]*Credential),
+		cache:       make(map[[sha256.Size]byte]string),
+		failures:    make(map[string]*allowance),
+	}
+
+	for _, h := range hashed {
+		c, err := Parse(h)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := v.credentials[c.User]; ok {
+			return nil, fmt.Errorf("Duplicate http auth credential for user '%s'", c.User)
+		}
+		v.credentials[c.User] = c
+
+		if v.decoy == nil {
+			v.decoy = c
+		}
+	}
+	return v, nil
+}
+
+// Check checks the Authorization header of a request from clientIp, and
+// returns the user it authorizes
+func (v *Verifier) Check(authorization, clientIp string) (string, Result) {
+	sum := sha256.Sum256([]byte(authorization))
+
+	v.Lock()
+	user, ok := v.cache[sum]
+	v.Unlock()
+	if ok {
+		return user, Authorized
+	}
+
+	// requests without credentials are how browsers ask for a prompt,
+	// they're not failed attempts
+	if authorization == "" {
+		return "", Unauthorized
+	}
+
+	// take the attempt from the address's allowance before hashing, so
+	// concurrent attempts can't all get past the limit
+	a, ok := v.take(clientIp)
+	if !ok {
+		return "", Limited
+	}
+
+	user, password, ok := basicAuth(authorization)
+	if ok {
+		// only the user's credential is compared, one bcrypt comparison
+		// per attempt
+		c, known := v.credentials[user]
+		if !known {
+			c = v.decoy
+		}
+
+		if c.matches(password) && known {
+			// successful attempts don't count
+			v.Lock()
+			a.tokens = min(failureBurst, a.tokens+1)
+			v.Unlock()
+
+			v.remember(sum, c.User)
+			return c.User, Authorized
+		}
+	}
+	return "", Unauthorized
+}
+
+// Users returns the sorted users which have a credential, none for a nil
+// verifier
+func (v *Verifier) Users() []string {
+	if v == nil {
+		return nil
+	}
+
+	users := make([]string, 0, len(v.credentials))
+	for user := range v.credentials {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// take takes an attempt from the allowance of an address, it returns false
+// if there's none left
+func (v *Verifier) take(clientIp string) (*allowance, bool) {
+	v.Lock()
+	defer v.Unlock()
+
+	now := time.Now()
+	a, ok := v.failures[clientIp]
+	if !ok {
+		a = v.newAllowance(clientIp, now)
+	}
+
+	if a.refill(now) < 1 {
+		return a, false
+	}
+	a.tokens--
+	return a, true
+}
+
+// newAllowance returns the allowance of an address which has none yet,
+// must hold the lock
+func (v *Verifier) newAllowance(clientIp string, now time.Time) *allowance {
+	if len(v.failures) >= maxClients {
+		// forget the addresses which haven't failed lately
+		for ip, a := range v.failures {
+			if a.refill(now) >= failureBurst {
+				delete(v.failures, ip)
+			}
+		}
+	}
+
+	if len(v.failures) >= maxClients {
+		// too many addresses are failing, they share an allowance
+		clientIp = ""
+		if a, ok := v.failures[clientIp]; ok {
+			return a
+		}
+	}
+
+	a := &allowance{tokens: failureBurst, last: now}
+	v.failures[clientIp] = a
+	return a
+}
+
+func (v *Verifier) remember(sum [sha256.Size]byte, user string) {
+	v.Lock()
+	defer v.Unlock()
+
+	if len(v.cache) >= maxCached {
+		// forget everything rather than track which are the oldest
+		v.cache = make(map[[sha256.Size]byte]string)
+	}
+	v.cache[sum] = user
+}
+
+func basicAuth(authorization string) (user, password string, ok bool) {
+	const prefix = "Basic "
+	if len(authorization) < len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return
+	}
+
+	b, err := base64.StdEncoding.DecodeString(authorization[len(prefix):])
+	if err != nil {
+		return
+	}
+	return strings.Cut(string(b), ":")
+}
@@ -0,0 +1,217 @@
+package httpauth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// credentials of the minimum cost, so the tests don't spend seconds hashing
+func credential(t *testing.T, user, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user + ":" + string(hash)
+}
+
+func basic(userPassword string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(userPassword))
+}
+
+func TestHash(t *testing.T) {
+	hashed, err := Hash("alice:s3cret:with:colons")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(hashed, "alice:$2a$") || strings.Contains(hashed, "s3cret") {
+		t.Errorf("Hash = %s, want a bcrypt hash for alice", hashed)
+	}
+
+	c, err := Parse(hashed)
+	if err != nil {
+		t.Fatalf("Parse of a hash: %v", err)
+	}
+
+	if c.User != "alice" || !c.matches("s3cret:with:colons") || c.matches("s3cret") {
+		t.Errorf("the parsed credential doesn't match its password")
+	}
+
+	for _, invalid := range []string{"alice", ":password", "", "alice:" + strings.Repeat("x", maxPasswordLength+1)} {
+		if _, err := Hash(invalid); err == nil {
+			t.Errorf("Hash(%q) succeeded", invalid)
+		} else if strings.Contains(err.Error(), "password") && strings.Contains(invalid, "password") && !strings.Contains(err.Error(), "user:password") {
+			t.Errorf("Hash(%q) error leaks the password: %v", invalid, err)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	// the cost is read from the hash, it doesn't need to be made with it
+	expensive := strings.Replace(credential(t, "bob", "pw"), "$04$", fmt.Sprintf("$%02d$", maxCost+1), 1)
+
+	tests := []struct {
+		name    string
+		hashed  string
+		wantErr bool
+	}{
+		{"valid", credential(t, "bob", "pw"), false},
+		{"password instead of a hash", "bob:pw", true},
+		{"no user", ":" + strings.SplitN(credential(t, "bob", "pw"), ":", 2)[1], true},
+		{"no separator", "bob", true},
+		{"truncated hash", credential(t, "bob", "pw")[:20], true},
+		{"cost too high", expensive, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse(tt.hashed); (err != nil) != tt.wantErr {
+				t.Errorf("Parse error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewVerifier(t *testing.T) {
+	if v, err := NewVerifier(nil); v != nil || err != nil {
+		t.Errorf("NewVerifier(nil) = %v, %v, want nil", v, err)
+	}
+
+	if _, err := NewVerifier([]string{credential(t, "bob", "a"), credential(t, "bob", "b")}); err == nil {
+		t.Errorf("NewVerifier accepted two credentials for one user")
+	}
+
+	if _, err := NewVerifier([]string{"bob:plain"}); err == nil {
+		t.Errorf("NewVerifier accepted an unhashed credential")
+	}
+
+	var many []string
+	for i := 0; i <= MaxCredentials; i++ {
+		many = append(many, credential(t, fmt.Sprint("user", i), "pw"))
+	}
+	if _, err := NewVerifier(many); err == nil {
+		t.Errorf("NewVerifier accepted %d credentials", len(many))
+	}
+}
+
+func TestCheck(t *testing.T) {
+	v, err := NewVerifier([]string{credential(t, "alice", "a-pass"), credential(t, "bob", "b-pass")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantUser      string
+		want          Result
+	}{
+		{"first user", basic("alice:a-pass"), "alice", Authorized},
+		{"second user", basic("bob:b-pass"), "bob", Authorized},
+		{"cached", basic("bob:b-pass"), "bob", Authorized},
+		{"case insensitive scheme", "basic " + base64.StdEncoding.EncodeToString([]byte("alice:a-pass")), "alice", Authorized},
+		{"another user's password", basic("alice:b-pass"), "", Unauthorized},
+		{"wrong password", basic("alice:nope"), "", Unauthorized},
+		{"unknown user", basic("carol:a-pass"), "", Unauthorized},
+		{"no credentials", "", "", Unauthorized},
+		{"bearer token", "Bearer a-pass", "", Unauthorized},
+		{"invalid base64", "Basic !!!", "", Unauthorized},
+		{"no password", basic("alice"), "", Unauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, result := v.Check(tt.authorization, "192.0.2.1")
+			if user != tt.wantUser || result != tt.want {
+				t.Errorf("Check = %q, %v, want %q, %v", user, result, tt.wantUser, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckLockout(t *testing.T) {
+	v, err := NewVerifier([]string{credential(t, "alice", "a-pass")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attacker, other := "198.51.100.7", "203.0.113.9"
+	for i := 0; i < failureBurst-1; i++ {
+		if _, result := v.Check(basic("alice:guess"), attacker); result != Unauthorized {
+			t.Fatalf("attempt %d: %v, want Unauthorized", i, result)
+		}
+	}
+
+	// a successful attempt doesn't use up the allowance
+	if _, result := v.Check(basic("alice:a-pass"), attacker); result != Authorized {
+		t.Fatalf("correct password: %v, want Authorized", result)
+	}
+
+	if _, result := v.Check(basic("alice:guess"), attacker); result != Unauthorized {
+		t.Fatalf("last allowed attempt: %v, want Unauthorized", result)
+	}
+
+	// the allowance is used up, even the right password isn't checked
+	if _, result := v.Check(basic("alice:guess"), attacker); result != Limited {
+		t.Errorf("attempt past the limit: %v, want Limited", result)
+	}
+
+	if _, result := v.Check("Basic "+base64.StdEncoding.EncodeToString([]byte("alice:a-pass "))[:len("Basic ")+4], attacker); result != Limited {
+		t.Errorf("attempt past the limit: %v, want Limited", result)
+	}
+
+	// headers which were authorized before still are
+	if user, result := v.Check(basic("alice:a-pass"), attacker); result != Authorized || user != "alice" {
+		t.Errorf("cached credentials: %q, %v, want alice, Authorized", user, result)
+	}
+
+	// other addresses aren't locked out
+	if _, result := v.Check(basic("alice:guess"), other); result != Unauthorized {
+		t.Errorf("another address: %v, want Unauthorized", result)
+	}
+}
+
+func TestAllowanceEviction(t *testing.T) {
+	v, err := NewVerifier([]string{credential(t, "alice", "a-pass")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// addresses which haven't failed lately are forgotten when there are
+	// too many
+	for i := 0; i < maxClients; i++ {
+		v.failures[fmt.Sprint(i)] = &allowance{tokens: failureBurst, last: time.Now()}
+	}
+	v.take("new")
+	if len(v.failures) > maxClients {
+		t.Errorf("%d allowances, want at most %d", len(v.failures), maxClients)
+	}
+
+	// when every tracked address has failed, new ones share an allowance
+	for i := 0; i < maxClients; i++ {
+		v.failures[fmt.Sprint(i)] = &allowance{tokens: 0, last: time.Now()}
+	}
+	a1, _ := v.take("new-1")
+	a2, _ := v.take("new-2")
+	if a1 != a2 || v.failures[""] != a1 {
+		t.Errorf("addresses past the limit don't share an allowance")
+	}
+}
+
+func TestAllowanceRefill(t *testing.T) {
+	start := time.Now()
+	a := &allowance{tokens: 0, last: start}
+
+	if got := a.refill(start.Add(time.Minute)); got != failuresPerMinute {
+		t.Errorf("after a minute %v attempts, want %v", got, failuresPerMinute)
+	}
+
+	if got := a.refill(start.Add(time.Hour)); got != failureBurst {
+		t.Errorf("after an hour %v attempts, want at most %v", got, failureBurst)
+	}
+}
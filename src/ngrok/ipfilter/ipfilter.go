@@ -0,0 +1,225 @@
+// Allow and deny lists of IP networks
+//
+// Tunnels can be restricted to the networks on an allow list, and refuse
+// those on a deny list. The server also has a deny list of its own, read
+// from a file which is reloaded whenever it changes.
+package ipfilter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often a list file is checked for changes at most
+const reloadInterval = time.Second
+
+// List is a set of networks
+type List []*net.IPNet
+
+// Parse parses IP addresses and CIDR networks, e.g. 10.0.0.0/8 or
+// 192.168.1.5
+func Parse(entries []string) (List, error) {
+	var l List
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid IP address '%s'", entry)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			l = append(l, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR network '%s'", entry)
+		}
+		l = append(l, network)
+	}
+	return l, nil
+}
+
+func (l List) Contains(ip net.IP) bool {
+	for _, network := range l {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter admits the addresses on its allow list, or any address when the
+// list is empty, unless they're on its deny list
+type Filter struct {
+	allow, deny List
+}
+
+// New returns the filter of the lists, nil if both are empty
+func New(allow, deny []string) (*Filter, error) {
+	a, err := Parse(allow)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := Parse(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(a) == 0 && len(d) == 0 {
+		return nil, nil
+	}
+	return &Filter{allow: a, deny: d}, nil
+}
+
+// Allowed reports whether the filter admits ip. A nil filter admits
+// everything.
+func (f *Filter) Allowed(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+
+	if ip == nil || f.deny.Contains(ip) {
+		return false
+	}
+	return len(f.allow) == 0 || f.allow.Contains(ip)
+}
+
+// Equal reports whether two filters admit the same addresses, by comparing
+// their lists. Nil filters are equal.
+func (f *Filter) Equal(o *Filter) bool {
+	if f == nil || o == nil {
+		return f == o
+	}
+	return f.allow.equal(o.allow) && f.deny.equal(o.deny)
+}
+
+// equal reports whether the lists have the same networks, in any order
+func (l List) equal(o List) bool {
+	count := make(map[string]int)
+	for _, network := range l {
+		count[network.String()]++
+	}
+	for _, network := range o {
+		count[network.String()]--
+	}
+
+	for _, n := range count {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// File is a deny list kept in a file, one address or network per line,
+// with comments starting with #
+type File struct {
+	path string
+
+	sync.Mutex
+	list List
+
+	// when the file was last checked for changes, and its modification
+	// time when it was last read
+	checked time.Time
+	modTime time.Time
+}
+
+// Open reads a deny list file, which must exist
+func Open(path string) (*File, error) {
+	f := &File{path: path}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Denied reports whether ip is on the list. A nil file denies nothing. An
+// invalid edit of the file keeps the list which was read before it.
+func (f *File) Denied(ip net.IP) (bool, error) {
+	if f == nil || ip == nil {
+		return false, nil
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	var err error
+	if time.Since(f.checked) >= reloadInterval {
+		err = f.reload()
+	}
+	return f.list.Contains(ip), err
+}
+
+// reload reads the file again if it changed since it was last read, must
+// hold the lock
+func (f *File) reload() error {
+	f.checked = time.Now()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	if info.ModTime().Equal(f.modTime) {
+		return nil
+	}
+
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	var entries []string
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		entries = append(entries, line)
+	}
+
+	list, err := Parse(entries)
+	if err != nil {
+		// don't read the broken file again until it changes
+		f.modTime = info.ModTime()
+		return fmt.Errorf("Invalid deny list %s: %v", f.path, err)
+	}
+
+	f.list, f.modTime = list, info.ModTime()
+	return nil
+}
+
+// IP returns the IP address of a connection's remote address, nil if it
+// has none
+func IP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
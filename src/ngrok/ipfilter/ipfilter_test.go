@@ -0,0 +1,188 @@
+package ipfilter
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		entries []string
+		want    []string
+		wantErr bool
+	}{
+		{[]string{"10.0.0.0/8", " 192.168.1.5 ", ""}, []string{"10.0.0.0/8", "192.168.1.5/32"}, false},
+		{[]string{"2001:db8::/32", "2001:db8::1"}, []string{"2001:db8::/32", "2001:db8::1/128"}, false},
+		{[]string{"10.1.2.3/8"}, []string{"10.0.0.0/8"}, false},
+		{nil, nil, false},
+		{[]string{"10.0.0.0/33"}, nil, true},
+		{[]string{"10.0.0"}, nil, true},
+		{[]string{"example.com"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		l, err := Parse(tt.entries)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Parse(%q) error %v, want error %v", tt.entries, err, tt.wantErr)
+			continue
+		}
+
+		var got []string
+		for _, network := range l {
+			got = append(got, network.String())
+		}
+
+		if len(got) != len(tt.want) {
+			t.Errorf("Parse(%q) = %v, want %v", tt.entries, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("Parse(%q) = %v, want %v", tt.entries, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		name        string
+		allow, deny []string
+		ip          string
+		want        bool
+	}{
+		{"allowed", []string{"10.0.0.0/8"}, nil, "10.1.2.3", true},
+		{"not on the allow list", []string{"10.0.0.0/8"}, nil, "192.168.1.5", false},
+		{"denied", nil, []string{"192.168.1.0/24"}, "192.168.1.5", false},
+		{"not on the deny list", nil, []string{"192.168.1.0/24"}, "192.168.2.5", true},
+		{"deny wins over allow", []string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}, "10.1.2.3", false},
+		{"allowed outside the denied part", []string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}, "10.2.0.1", true},
+		{"single address denied", []string{"10.0.0.0/8"}, []string{"10.1.2.3"}, "10.1.2.3", false},
+		{"ipv6 allowed", []string{"2001:db8::/32"}, nil, "2001:db8::7", true},
+		{"ipv4 isn't in an ipv6 network", []string{"2001:db8::/32"}, nil, "10.1.2.3", false},
+		{"mapped ipv4 matches ipv4", []string{"10.0.0.0/8"}, nil, "::ffff:10.1.2.3", true},
+		{"no address", []string{"10.0.0.0/8"}, nil, "", false},
+		{"no address with only a deny list", nil, []string{"10.0.0.0/8"}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := New(tt.allow, tt.deny)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := f.Allowed(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("Allowed(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNilFilter(t *testing.T) {
+	f, err := New(nil, []string{" "})
+	if err != nil || f != nil {
+		t.Fatalf("New of empty lists = %v, %v, want nil", f, err)
+	}
+
+	if !f.Allowed(net.ParseIP("10.1.2.3")) {
+		t.Errorf("a nil filter must admit everything")
+	}
+
+	if _, err = New([]string{"bogus"}, nil); err == nil {
+		t.Errorf("New accepted an invalid allow list")
+	}
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "denylist")
+	write := func(content string, modTime time.Time) {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	denied := func(f *File, ip string) bool {
+		// let the file be checked for changes again
+		f.checked = time.Time{}
+		d, err := f.Denied(net.ParseIP(ip))
+		if err != nil {
+			t.Errorf("Denied(%s): %v", ip, err)
+		}
+		return d
+	}
+
+	start := time.Now().Add(-time.Hour)
+	write("# bad actors\n203.0.113.0/24 # a whole network\n\n198.51.100.7\n", start)
+
+	f, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"203.0.113.9", true},
+		{"198.51.100.7", true},
+		{"198.51.100.8", false},
+	}
+	for _, tt := range tests {
+		if got := denied(f, tt.ip); got != tt.want {
+			t.Errorf("Denied(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	// an edit is picked up
+	write("198.51.100.8\n", start.Add(time.Minute))
+	if !denied(f, "198.51.100.8") || denied(f, "203.0.113.9") {
+		t.Errorf("the edited list wasn't reloaded")
+	}
+
+	// a broken edit keeps the list read before it
+	write("not an address\n", start.Add(2*time.Minute))
+	f.checked = time.Time{}
+	if d, err := f.Denied(net.ParseIP("198.51.100.8")); err == nil || !d {
+		t.Errorf("Denied after a broken edit = %v, %v, want true and an error", d, err)
+	}
+
+	// nil files and addresses deny nothing
+	var none *File
+	if d, err := none.Denied(net.ParseIP("198.51.100.8")); d || err != nil {
+		t.Errorf("a nil file denied an address")
+	}
+	if d, _ := f.Denied(nil); d {
+		t.Errorf("a missing address was denied")
+	}
+
+	if _, err = Open(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("Open of a missing file succeeded")
+	}
+}
+
+func TestIP(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 80}, "10.1.2.3"},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::7"), Port: 53}, "2001:db8::7"},
+		{&net.IPAddr{IP: net.ParseIP("10.1.2.3")}, "10.1.2.3"},
+		{&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, "<nil>"},
+		{nil, "<nil>"},
+	}
+
+	for _, tt := range tests {
+		if got := IP(tt.addr).String(); got != tt.want {
+			t.Errorf("IP(%v) = %s, want %s", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -20,6 +20,8 @@ func init() {
 	TypeMap["StartProxy"] = t((*StartProxy)(nil))
 	TypeMap["Ping"] = t((*Ping)(nil))
 	TypeMap["Pong"] = t((*Pong)(nil))
+	TypeMap["NodeForward"] = t((*NodeForward)(nil))
+	TypeMap["NodeProxy"] = t((*NodeProxy)(nil))
 }
 
 type Message interface{}
@@ -56,6 +58,10 @@ type AuthResp struct {
 	MmVersion string
 	ClientId  string
 	Error     string
+
+	// set by servers which accept ReqTunnel.HttpAuthUsers, older ones
+	// would ignore them and serve the tunnels without auth
+	HttpAuthHashes bool
 }
 
 // A client sends this message to the server over the control channel
@@ -69,10 +75,26 @@ type ReqTunnel struct {
 	// http only
 	Hostname  string
 	Subdomain string
-	HttpAuth  string
 
-	// tcp only
+	// http basic auth credentials hashed by the httpauth package, any
+	// of which is accepted
+	HttpAuthUsers []string
+
+	// a plaintext user:password, sent by older clients
+	HttpAuth string
+
+	// share the url with the other tunnels of the same auth token
+	// and pool, which take turns handling its connections
+	Pool       string
+	PoolPolicy string // round_robin or least_conns
+
+	// tcp and udp only
 	RemotePort uint16
+
+	// IP addresses and CIDR networks allowed to connect, any when empty,
+	// and those which are refused
+	IpAllow []string
+	IpDeny  []string
 }
 
 // When the server opens a new tunnel on behalf of
@@ -118,3 +140,21 @@ type Ping struct {
 // it received a Ping.
 type Pong struct {
 }
+
+// Sent by an ngrokd node to another over an inter-node link to hand it a
+// public connection for a tunnel the other node owns. After this message
+// the link carries the bytes of the public connection, starting with the
+// request the first node read to find the tunnel.
+type NodeForward struct {
+	Secret     string // the cluster's shared secret
+	Url        string // URL of the tunnel
+	ClientAddr string // Network address of the client initiating the connection to the tunnel
+}
+
+// Sent by an ngrokd node to another over an inter-node link to hand it a
+// proxy connection for a control connection the other node owns. After
+// this message the link carries the bytes of the proxy connection.
+type NodeProxy struct {
+	Secret   string
+	ClientId string
+}
@@ -22,14 +22,21 @@ import (
 type HttpRequest struct {
 	*http.Request
 	BodyBytes []byte
+
+	// what was redacted from the captured request
+	Redacted []string
 }
 
 type HttpResponse struct {
 	*http.Response
 	BodyBytes []byte
+
+	// what was redacted from the captured response
+	Redacted []string
 }
 
 type HttpTxn struct {
+	Id          string
 	Req         *HttpRequest
 	Resp        *HttpResponse
 	Start       time.Time
@@ -39,12 +46,26 @@ type HttpTxn struct {
 }
 
 type Http struct {
-	Txns     *util.Broadcast
+	Txns *util.Broadcast
+
+	// if set, called with each transaction before it is broadcast, once
+	// when the request was read and again when the response was read
+	Redact func(txn *HttpTxn)
+
 	reqGauge metrics.Gauge
 	reqMeter metrics.Meter
 	reqTimer metrics.Timer
 }
 
+func init() {
+	Register(Registration{
+		Name:    "http",
+		Tunnels: []string{"http", "https"},
+		Default: true,
+		New:     func() Protocol { return NewHttp() },
+	})
+}
+
 func NewHttp() *Http {
 	return &Http{
 		Txns:     util.NewBroadcast(),
@@ -93,7 +114,7 @@ func (h *Http) readRequests(tee *conn.Tee, lastTxn chan *HttpTxn, connCtx interf
 		req.URL.Scheme = "http"
 		req.URL.Host = req.Host
 
-		txn := &HttpTxn{Start: time.Now(), ConnUserCtx: connCtx}
+		txn := &HttpTxn{Id: util.RandId(8), Start: time.Now(), ConnUserCtx: connCtx}
 		txn.Req = &HttpRequest{Request: req}
 		if req.Body != nil {
 			txn.Req.BodyBytes, txn.Req.Body, err = extractBody(req.Body)
@@ -102,6 +123,10 @@ func (h *Http) readRequests(tee *conn.Tee, lastTxn chan *HttpTxn, connCtx interf
 			}
 		}
 
+		if h.Redact != nil {
+			h.Redact(txn)
+		}
+
 		lastTxn <- txn
 		h.Txns.In() <- txn
 	}
@@ -130,6 +155,10 @@ func (h *Http) readResponses(tee *conn.Tee, lastTxn chan *HttpTxn) {
 			}
 		}
 
+		if h.Redact != nil {
+			h.Redact(txn)
+		}
+
 		h.Txns.In() <- txn
 
 		// XXX: remove web socket shim in favor of a real websocket protocol analyzer
@@ -0,0 +1,575 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/conn"
+	"github.com/inconshreveable/ngrok/src/ngrok/util"
+)
+
+const (
+	// message bodies longer than this are truncated when captured
+	pgMaxCapture = 8192
+
+	// frontend messages pipelined ahead of the backend's responses
+	// before we stop pairing them
+	pgMaxPipeline = 256
+
+	// backend messages read ahead of pairing them with the frontend's
+	// before we stop inspecting the connection
+	pgMaxBacklog = 1024
+
+	// how long we wait to learn which frontend message a backend
+	// message responds to before giving up on attributing it
+	pgPairTimeout = 5 * time.Second
+
+	// protocol codes of the untyped messages a connection starts with
+	pgProtocolV3  = 196608
+	pgSSLRequest  = 80877103
+	pgGSSRequest  = 80877104
+	pgCancelCode  = 80877102
+	pgTLSRecordID = 0x16
+)
+
+// Kinds of transactions captured by the Postgres analyzer
+const (
+	PgStartup = "startup" // connection startup and authentication
+	PgQuery   = "query"   // simple query protocol
+	PgExecute = "execute" // execution of a portal with the extended query protocol
+)
+
+var pgAuthMethods = map[uint32]string{
+	0:  "ok",
+	2:  "kerberos",
+	3:  "password",
+	5:  "md5",
+	7:  "gss",
+	9:  "sspi",
+	10: "sasl",
+}
+
+type PostgresError struct {
+	Severity string
+	Code     string
+	Message  string
+	Detail   string
+	Hint     string
+}
+
+func (e *PostgresError) Error() string {
+	return fmt.Sprintf("%s: %s (SQLSTATE %s)", e.Severity, e.Message, e.Code)
+}
+
+// A PostgresTxn is a startup handshake, a simple query or the execution
+// of a prepared statement. Password messages are never captured.
+type PostgresTxn struct {
+	Kind        string
+	Query       string
+	Truncated   bool
+	Params      map[string]string // startup parameters, e.g. user and database
+	AuthMethod  string
+	Tags        []string // command tags of the completed statements, e.g. "INSERT 0 1"
+	Rows        int64    // number of data rows returned
+	Error       *PostgresError
+	Done        bool
+	Start       time.Time
+	Duration    time.Duration
+	UserCtx     interface{}
+	ConnUserCtx interface{}
+}
+
+// a frontend message the backend is going to respond to
+type pgOp struct {
+	txn  *PostgresTxn
+	sync bool // Sync or FunctionCall, answered with ReadyForQuery
+	ssl  bool // SSLRequest or GSSENCRequest, answered with a single byte
+}
+
+// Postgres is a protocol analyzer for the PostgreSQL frontend/backend
+// protocol (version 3). Connections that negotiate TLS can't be inspected.
+type Postgres struct {
+	Txns     *util.Broadcast
+	reqMeter metrics.Meter
+	reqTimer metrics.Timer
+}
+
+func init() {
+	Register(Registration{
+		Name:    "postgres",
+		Tunnels: []string{"tcp"},
+		New:     func() Protocol { return NewPostgres() },
+	})
+}
+
+func NewPostgres() *Postgres {
+	return &Postgres{
+		Txns:     util.NewBroadcast(),
+		reqMeter: metrics.NewMeter(),
+		reqTimer: metrics.NewTimer(),
+	}
+}
+
+func (p *Postgres) GetName() string { return "postgres" }
+
+func (p *Postgres) WrapConn(ctx context.Context, c conn.Conn, connCtx interface{}) conn.Conn {
+	tee := conn.NewTee(c)
+	pending := make(chan *pgOp, pgMaxPipeline)
+	go p.readFrontend(tee, pending, connCtx)
+	go p.readBackend(tee, pending)
+	return tee
+}
+
+func (p *Postgres) readFrontend(tee *conn.Tee, pending chan *pgOp, connCtx interface{}) {
+	rd := tee.WriteBuffer()
+
+	// whatever happens, keep consuming so we never block the real traffic,
+	// but let the backend reader know there are no more messages first
+	defer io.Copy(io.Discard, rd)
+
+	// never wait for the backend reader, the real traffic would wait with
+	// us. When too many messages are pipelined, the rest of the
+	// connection isn't paired.
+	paired := true
+	queue := func(op *pgOp) {
+		if !paired {
+			return
+		}
+
+		select {
+		case pending <- op:
+		default:
+			tee.Warn("More than %d postgres messages are waiting for responses, no longer pairing them", pgMaxPipeline)
+			paired = false
+			close(pending)
+		}
+	}
+	defer func() {
+		if paired {
+			close(pending)
+		}
+	}()
+
+	newTxn := func(kind string) *PostgresTxn {
+		return &PostgresTxn{Kind: kind, Start: time.Now(), ConnUserCtx: connCtx}
+	}
+
+	// the connection starts with untyped messages until it's set up
+	for {
+		b, err := rd.Peek(1)
+		if err != nil {
+			return
+		}
+
+		if b[0] == pgTLSRecordID {
+			tee.Info("Postgres connection switched to TLS, no longer inspecting")
+			return
+		}
+
+		body, _, err := readPgMessage(rd, false)
+		if err != nil {
+			tee.Warn("Failed to read postgres startup message: %v", err)
+			return
+		}
+
+		if len(body) < 4 {
+			tee.Warn("Postgres startup message is too short")
+			return
+		}
+
+		code := binary.BigEndian.Uint32(body)
+		switch code {
+		case pgSSLRequest, pgGSSRequest:
+			queue(&pgOp{ssl: true})
+			continue
+
+		case pgCancelCode:
+			return
+
+		case pgProtocolV3:
+			txn := newTxn(PgStartup)
+			txn.Params = make(map[string]string)
+
+			// name, value pairs terminated by an empty name
+			fields := pgStrings(body[4:], len(body))
+			for i := 0; i+1 < len(fields) && fields[i] != ""; i += 2 {
+				txn.Params[fields[i]] = fields[i+1]
+			}
+			queue(&pgOp{txn: txn})
+			p.Txns.In() <- txn
+
+		default:
+			tee.Warn("Unsupported postgres protocol version %d.%d", code>>16, code&0xffff)
+			return
+		}
+		break
+	}
+
+	// prepared statements and the portals bound to them
+	statements := make(map[string]string)
+	portals := make(map[string]string)
+	truncated := make(map[string]bool)
+
+	for {
+		typ, body, trunc, err := readPgTypedMessage(rd)
+		if err != nil {
+			if err != io.EOF {
+				tee.Warn("Failed to read postgres message: %v", err)
+			}
+			return
+		}
+
+		switch typ {
+		case 'Q':
+			txn := newTxn(PgQuery)
+			txn.Query, txn.Truncated = pgString(body), trunc
+			p.reqMeter.Mark(1)
+			queue(&pgOp{txn: txn})
+			p.Txns.In() <- txn
+
+		case 'P':
+			if fields := pgStrings(body, 2); len(fields) == 2 {
+				statements[fields[0]] = fields[1]
+				truncated[fields[0]] = trunc
+			}
+
+		case 'B':
+			if fields := pgStrings(body, 2); len(fields) == 2 {
+				portals[fields[0]] = fields[1]
+			}
+
+		case 'E':
+			stmt := portals[pgString(body)]
+			txn := newTxn(PgExecute)
+			txn.Query, txn.Truncated = statements[stmt], truncated[stmt]
+			p.reqMeter.Mark(1)
+			queue(&pgOp{txn: txn})
+			p.Txns.In() <- txn
+
+		case 'C':
+			if len(body) > 1 && body[0] == 'S' {
+				delete(statements, pgString(body[1:]))
+				delete(truncated, pgString(body[1:]))
+			} else if len(body) > 1 {
+				delete(portals, pgString(body[1:]))
+			}
+
+		case 'S', 'F':
+			queue(&pgOp{sync: true})
+
+		case 'X':
+			return
+
+			// 'p' are password, SASL and GSS responses: they are deliberately
+			// never looked at. Flush, Describe and the COPY messages don't
+			// need to be paired with a response.
+		}
+	}
+}
+
+// a backend message, handed from the reader to pairBackend
+type pgBackendMsg struct {
+	typ  byte
+	body []byte
+}
+
+func (p *Postgres) readBackend(tee *conn.Tee, pending chan *pgOp) {
+	rd := tee.ReadBuffer()
+
+	// whatever happens, keep consuming so we never block the real traffic
+	defer io.Copy(io.Discard, rd)
+
+	// the backend sends nothing before the frontend's first message, the
+	// answers to SSLRequest and GSSENCRequest are a single byte
+	var first *pgOp
+	for {
+		if first = nextPgOp(pending); first == nil || !first.ssl {
+			break
+		}
+
+		b, err := rd.ReadByte()
+		if err != nil {
+			first = nil
+			break
+		}
+
+		if b != 'N' {
+			tee.Info("Postgres connection switched to encryption, no longer inspecting")
+			first = nil
+			break
+		}
+	}
+
+	if first == nil {
+		go drainPgOps(pending)
+		return
+	}
+
+	// the messages are paired with the frontend's in another goroutine,
+	// which may wait for the frontend reader, so the real traffic never
+	// waits for it
+	msgs := make(chan pgBackendMsg, pgMaxBacklog)
+	defer close(msgs)
+	go p.pairBackend(tee, first, pending, msgs)
+
+	for {
+		typ, body, _, err := readPgTypedMessage(rd)
+		if err != nil {
+			if err != io.EOF {
+				tee.Warn("Failed to read postgres message: %v", err)
+			}
+			return
+		}
+
+		// only data rows are counted, their values aren't needed
+		if typ == 'D' {
+			body = nil
+		}
+
+		select {
+		case msgs <- pgBackendMsg{typ: typ, body: body}:
+		default:
+			tee.Warn("More than %d postgres messages are waiting to be paired, no longer inspecting", pgMaxBacklog)
+			return
+		}
+	}
+}
+
+// nextPgOp waits for the frontend reader to parse a message, it returns nil
+// if there's none or it took too long
+func nextPgOp(pending chan *pgOp) *pgOp {
+	select {
+	case op := <-pending:
+		return op
+	case <-time.After(pgPairTimeout):
+		return nil
+	}
+}
+
+// drainPgOps lets the frontend reader finish
+func drainPgOps(pending chan *pgOp) {
+	for range pending {
+	}
+}
+
+// pairBackend pairs the backend's messages with the frontend messages they
+// respond to, starting with the startup message
+func (p *Postgres) pairBackend(tee *conn.Tee, first *pgOp, pending chan *pgOp, msgs chan pgBackendMsg) {
+	defer func() {
+		go drainPgOps(pending)
+		for range msgs {
+		}
+	}()
+
+	queue := []*pgOp{first}
+
+	// returns the oldest frontend message awaiting a response, waiting
+	// for the frontend reader to parse it if we're ahead of it
+	head := func() *pgOp {
+		if len(queue) == 0 {
+			op := nextPgOp(pending)
+			if op == nil {
+				return nil
+			}
+			queue = append(queue, op)
+		}
+		return queue[0]
+	}
+
+	pop := func() {
+		queue = queue[1:]
+	}
+
+	complete := func(txn *PostgresTxn) {
+		txn.Done = true
+		txn.Duration = time.Since(txn.Start)
+		if txn.Kind != PgStartup {
+			p.reqTimer.Update(txn.Duration)
+		}
+		p.Txns.In() <- txn
+	}
+
+	for m := range msgs {
+		typ, body := m.typ, m.body
+
+		switch typ {
+		case 'R':
+			if op := head(); op != nil && op.txn != nil && op.txn.Kind == PgStartup && len(body) >= 4 {
+				code := binary.BigEndian.Uint32(body)
+				if method, ok := pgAuthMethods[code]; ok && code != 0 {
+					op.txn.AuthMethod = method
+				}
+			}
+
+		case 'D':
+			if op := head(); op != nil && op.txn != nil {
+				op.txn.Rows++
+			}
+
+		case 'C':
+			op := head()
+			if op == nil || op.txn == nil {
+				continue
+			}
+
+			tag := pgString(body)
+			op.txn.Tags = append(op.txn.Tags, tag)
+
+			// INSERT, UPDATE, DELETE, etc. report their row count in the tag
+			if parts := strings.Fields(tag); op.txn.Rows == 0 && len(parts) > 1 {
+				if n, err := strconv.ParseInt(parts[len(parts)-1], 10, 64); err == nil {
+					op.txn.Rows = n
+				}
+			}
+
+			if op.txn.Kind == PgExecute {
+				pop()
+				complete(op.txn)
+			}
+
+		case 'I', 's':
+			if op := head(); op != nil && op.txn != nil && op.txn.Kind == PgExecute {
+				pop()
+				complete(op.txn)
+			}
+
+		case 'E':
+			op := head()
+			if op == nil || op.txn == nil {
+				continue
+			}
+
+			op.txn.Error = parsePgError(body)
+
+			// after an error, the backend discards the frontend's extended
+			// protocol messages until the next Sync, the simple protocol
+			// and startup finish with ReadyForQuery or a closed connection
+			if op.txn.Kind == PgExecute {
+				pop()
+				complete(op.txn)
+			} else if op.txn.Kind == PgStartup {
+				pop()
+				complete(op.txn)
+				return
+			}
+
+		case 'Z':
+			// finish everything up to and including the Sync or query that
+			// asked for it, executes still pending were skipped after an error
+			for op := head(); op != nil; op = head() {
+				pop()
+				if op.sync {
+					break
+				}
+
+				if op.txn != nil && op.txn.Kind != PgExecute {
+					complete(op.txn)
+					break
+				}
+			}
+
+			// everything else: parameter status, notices, notifications,
+			// row descriptions and the completion of parse, bind and close
+		}
+	}
+}
+
+func parsePgError(body []byte) *PostgresError {
+	e := new(PostgresError)
+	for len(body) > 1 {
+		code := body[0]
+		value := pgString(body[1:])
+		body = body[1+len(value):]
+		if len(body) > 0 {
+			body = body[1:]
+		}
+
+		switch code {
+		case 'S':
+			e.Severity = value
+		case 'C':
+			e.Code = value
+		case 'M':
+			e.Message = value
+		case 'D':
+			e.Detail = value
+		case 'H':
+			e.Hint = value
+		}
+	}
+	return e
+}
+
+// reads a message that starts with a type byte
+func readPgTypedMessage(rd *bufio.Reader) (typ byte, body []byte, truncated bool, err error) {
+	if typ, err = rd.ReadByte(); err != nil {
+		return
+	}
+
+	body, truncated, err = readPgMessage(rd, true)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// reads the length prefixed body of a message, capturing at most pgMaxCapture bytes
+func readPgMessage(rd *bufio.Reader, typed bool) (body []byte, truncated bool, err error) {
+	var length int32
+	if err = binary.Read(rd, binary.BigEndian, &length); err != nil {
+		if err == io.EOF && typed {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+
+	if length < 4 {
+		err = fmt.Errorf("invalid message length %d", length)
+		return
+	}
+
+	n := int(length) - 4
+	capture := n
+	if capture > pgMaxCapture {
+		capture, truncated = pgMaxCapture, true
+	}
+
+	body = make([]byte, capture)
+	if _, err = io.ReadFull(rd, body); err != nil {
+		return
+	}
+
+	_, err = io.CopyN(io.Discard, rd, int64(n-capture))
+	return
+}
+
+// returns the null terminated string at the start of b
+func pgString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return string(b[:i])
+	}
+	return string(b)
+}
+
+// returns up to n of the null terminated strings at the start of b
+func pgStrings(b []byte, n int) []string {
+	var fields []string
+	for len(fields) < n && len(b) > 0 {
+		s := pgString(b)
+		fields = append(fields, s)
+		if len(s) == len(b) {
+			break
+		}
+		b = b[len(s)+1:]
+	}
+	return fields
+}
@@ -0,0 +1,269 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/conn"
+)
+
+// a message with a type byte, or without one when typ is 0
+func pgMessage(typ byte, body string) []byte {
+	var b []byte
+	if typ != 0 {
+		b = append(b, typ)
+	}
+	b = binary.BigEndian.AppendUint32(b, uint32(len(body)+4))
+	return append(b, body...)
+}
+
+var pgMessageTests = []struct {
+	name string
+	typ  byte
+	body string
+}{
+	{"query", 'Q', "SELECT 1\x00"},
+	{"empty body", 'S', ""},
+	{"ready for query", 'Z', "I"},
+	{"error response", 'E', "SERROR\x00C42P01\x00Mrelation \"t\" does not exist\x00\x00"},
+	{"binary body", 'D', "\x00\x01\x00\x00\x00\x04\xff\x00\x10\x7f"},
+}
+
+func TestReadPgTypedMessage(t *testing.T) {
+	for _, tt := range pgMessageTests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a second message follows, which must be left unread
+			frame := append(pgMessage(tt.typ, tt.body), pgMessage('Z', "I")...)
+			rd := bufio.NewReader(bytes.NewReader(frame))
+
+			typ, body, truncated, err := readPgTypedMessage(rd)
+			if err != nil {
+				t.Fatalf("readPgTypedMessage: %v", err)
+			}
+			if typ != tt.typ || string(body) != tt.body || truncated {
+				t.Errorf("read %c %q truncated %v, want %c %q", typ, body, truncated, tt.typ, tt.body)
+			}
+
+			if typ, _, _, err = readPgTypedMessage(rd); err != nil || typ != 'Z' {
+				t.Errorf("the next message %c, %v, want Z", typ, err)
+			}
+
+			if _, _, _, err = readPgTypedMessage(rd); err != io.EOF {
+				t.Errorf("after the last message %v, want EOF", err)
+			}
+		})
+	}
+}
+
+func TestReadPgTruncated(t *testing.T) {
+	for _, tt := range pgMessageTests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := pgMessage(tt.typ, tt.body)
+
+			// every prefix of a message is incomplete, only an empty
+			// stream is a clean end
+			for i := 1; i < len(frame); i++ {
+				_, body, _, err := readPgTypedMessage(bufio.NewReader(bytes.NewReader(frame[:i])))
+				if err != io.ErrUnexpectedEOF {
+					t.Errorf("%q read as %q, %v, want an unexpected EOF", frame[:i], body, err)
+				}
+			}
+
+			untyped := pgMessage(0, tt.body)
+			for i := 1; i < len(untyped); i++ {
+				if body, _, err := readPgMessage(bufio.NewReader(bytes.NewReader(untyped[:i])), false); err == nil {
+					t.Errorf("untyped %q read as %q, want an error", untyped[:i], body)
+				}
+			}
+		})
+	}
+}
+
+func TestReadPgMessageMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"length shorter than itself", []byte{'Q', 0, 0, 0, 3}},
+		{"negative length", []byte{'Q', 0xff, 0xff, 0xff, 0xf0}},
+		{"body shorter than its length", append([]byte{'Q', 0, 0, 0, 20}, "SELECT 1\x00"...)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, body, _, err := readPgTypedMessage(bufio.NewReader(bytes.NewReader(tt.frame))); err == nil {
+				t.Errorf("read %q, want an error", body)
+			}
+		})
+	}
+}
+
+func TestReadPgStartup(t *testing.T) {
+	startup := binary.BigEndian.AppendUint32(nil, pgProtocolV3)
+	startup = append(startup, "user\x00alice\x00database\x00app\x00\x00"...)
+
+	body, truncated, err := readPgMessage(bufio.NewReader(bytes.NewReader(pgMessage(0, string(startup)))), false)
+	if err != nil || truncated {
+		t.Fatalf("readPgMessage: %v, truncated %v", err, truncated)
+	}
+
+	if code := binary.BigEndian.Uint32(body); code != pgProtocolV3 {
+		t.Errorf("protocol code %d, want %d", code, pgProtocolV3)
+	}
+
+	if got, want := pgStrings(body[4:], 10), []string{"user", "alice", "database", "app", ""}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parameters %q, want %q", got, want)
+	}
+
+	// a connection which closes before its startup message ends cleanly
+	if _, _, err = readPgMessage(bufio.NewReader(bytes.NewReader(nil)), false); err != io.EOF {
+		t.Errorf("empty stream: %v, want EOF", err)
+	}
+}
+
+func TestReadPgLongMessage(t *testing.T) {
+	long := strings.Repeat("x", pgMaxCapture+100)
+	frame := append(pgMessage('D', long), pgMessage('Z', "I")...)
+	rd := bufio.NewReader(bytes.NewReader(frame))
+
+	_, body, truncated, err := readPgTypedMessage(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated || len(body) != pgMaxCapture {
+		t.Errorf("captured %d bytes, truncated %v", len(body), truncated)
+	}
+
+	// the rest of the long message is skipped
+	if typ, _, _, err := readPgTypedMessage(rd); err != nil || typ != 'Z' {
+		t.Errorf("the next message %c, %v, want Z", typ, err)
+	}
+}
+
+func TestParsePgError(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want PostgresError
+	}{
+		{
+			"complete",
+			"SERROR\x00C42P01\x00Mrelation \"t\" does not exist\x00HCreate it first\x00\x00",
+			PostgresError{Severity: "ERROR", Code: "42P01", Message: `relation "t" does not exist`, Hint: "Create it first"},
+		},
+		{"unknown fields are skipped", "VERROR\x00C23505\x00Dkey exists\x00\x00", PostgresError{Code: "23505", Detail: "key exists"}},
+		{"truncated in a field", "SERROR\x00C42P01\x00Mrelation \"t\" do", PostgresError{Severity: "ERROR", Code: "42P01", Message: `relation "t" do`}},
+		{"truncated after a field code", "SERROR\x00M", PostgresError{Severity: "ERROR"}},
+		{"empty", "", PostgresError{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parsePgError([]byte(tt.body)); *got != tt.want {
+				t.Errorf("parsePgError = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPgStrings(t *testing.T) {
+	tests := []struct {
+		b    string
+		n    int
+		want []string
+	}{
+		{"a\x00b\x00c\x00", 2, []string{"a", "b"}},
+		{"a\x00b\x00", 5, []string{"a", "b"}},
+		{"unterminated", 2, []string{"unterminated"}},
+		{"", 2, nil},
+	}
+
+	for _, tt := range tests {
+		if got := pgStrings([]byte(tt.b), tt.n); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("pgStrings(%q, %d) = %q, want %q", tt.b, tt.n, got, tt.want)
+		}
+	}
+}
+
+func pgMessages(msgs ...[]byte) []byte {
+	return bytes.Join(msgs, nil)
+}
+
+func TestPostgresSession(t *testing.T) {
+	p := NewPostgres()
+	updates := p.Txns.Reg()
+
+	// a query is broadcast when it's sent, and again once it's complete
+	completed := make(chan *PostgresTxn, 1)
+	go func() {
+		seen := make(map[*PostgresTxn]bool)
+		for obj := range updates {
+			if txn := obj.(*PostgresTxn); seen[txn] && txn.Kind == PgQuery {
+				completed <- txn
+			} else {
+				seen[txn] = true
+			}
+		}
+	}()
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	tee := p.WrapConn(context.Background(), conn.Wrap(local, "test"), nil)
+	defer tee.Close()
+	go io.Copy(io.Discard, remote)
+
+	startup := binary.BigEndian.AppendUint32(nil, pgProtocolV3)
+	startup = append(startup, "user\x00alice\x00\x00"...)
+	frontend := pgMessages(pgMessage(0, string(startup)), pgMessage('Q', "SELECT 1\x00"))
+
+	// notices, notifications and errors arrive while nothing waits for a
+	// response, they mustn't hold up the connection
+	unsolicited := pgMessages(
+		pgMessage('S', "TimeZone\x00UTC\x00"),
+		pgMessage('N', "SNOTICE\x00C00000\x00Mhello\x00\x00"),
+		pgMessage('A', "\x00\x00\x00\x01channel\x00payload\x00"),
+	)
+	backend := pgMessages(
+		pgMessage('R', "\x00\x00\x00\x00"),
+		pgMessage('Z', "I"),
+		unsolicited,
+		pgMessage('T', "\x00\x00"),
+		pgMessage('D', "\x00\x01\x00\x00\x00\x011"),
+		pgMessage('C', "SELECT 1\x00"),
+		pgMessage('Z', "I"),
+		pgMessage('E', "SERROR\x00C57014\x00Mcanceling statement due to user request\x00\x00"),
+		bytes.Repeat(unsolicited, 200),
+	)
+
+	if _, err := tee.Write(frontend); err != nil {
+		t.Fatal(err)
+	}
+
+	go remote.Write(backend)
+	start := time.Now()
+	if _, err := io.ReadFull(tee, make([]byte, len(backend))); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("reading the backend's messages took %v", elapsed)
+	}
+
+	var query *PostgresTxn
+	select {
+	case query = <-completed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the query wasn't completed")
+	}
+
+	if query.Query != "SELECT 1" || query.Rows != 1 || !reflect.DeepEqual(query.Tags, []string{"SELECT 1"}) {
+		t.Errorf("query %q, %d rows, tags %q", query.Query, query.Rows, query.Tags)
+	}
+}
@@ -0,0 +1,466 @@
+package proto
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/conn"
+	"github.com/inconshreveable/ngrok/src/ngrok/util"
+)
+
+const (
+	// bulk strings longer than this are truncated when captured
+	redisMaxCapture = 1024
+
+	// aggregates with more elements than this are truncated when captured
+	redisMaxElems = 128
+
+	// maximum nesting of aggregate values we're willing to parse
+	redisMaxDepth = 32
+
+	// commands pipelined ahead of their replies before we stop pairing them
+	redisMaxPipeline = 64
+)
+
+// RespValue is a value of the Redis serialization protocol (RESP2 or RESP3)
+// as captured by the analyzer. Long strings and aggregates are truncated,
+// Len always holds the real number of elements of an aggregate.
+type RespValue struct {
+	Type      byte // the RESP type marker, e.g. '+', '-', '$', '*'
+	Str       string
+	Elems     []RespValue
+	Len       int
+	Null      bool
+	Truncated bool
+}
+
+// IsError reports whether the value is a simple or bulk error
+func (v RespValue) IsError() bool {
+	return v.Type == '-' || v.Type == '!'
+}
+
+// String renders the value the way redis-cli would summarize it
+func (v RespValue) String() string {
+	if v.Null {
+		return "(nil)"
+	}
+
+	switch v.Type {
+	case '+':
+		return v.Str
+	case '-', '!':
+		return "(error) " + v.Str
+	case ':', '(':
+		return "(integer) " + v.Str
+	case ',':
+		return "(double) " + v.Str
+	case '#':
+		if v.Str == "t" {
+			return "(true)"
+		}
+		return "(false)"
+	case '=':
+		// verbatim strings are prefixed with their 3 letter format, e.g. "txt:"
+		if len(v.Str) >= 4 {
+			return strconv.Quote(v.Str[4:])
+		}
+		return strconv.Quote(v.Str)
+	case '$':
+		s := strconv.Quote(v.Str)
+		if v.Truncated {
+			s += "..."
+		}
+		return s
+	case '%':
+		return fmt.Sprintf("(map of %d)", v.Len)
+	case '~':
+		return fmt.Sprintf("(set of %d)", v.Len)
+	default:
+		if v.Len == 0 {
+			return "(empty array)"
+		}
+		return fmt.Sprintf("(array of %d)", v.Len)
+	}
+}
+
+type RedisTxn struct {
+	Command     []string
+	Reply       *RespValue
+	Start       time.Time
+	Duration    time.Duration
+	UserCtx     interface{}
+	ConnUserCtx interface{}
+}
+
+// Name returns the upper-cased name of the command
+func (t *RedisTxn) Name() string {
+	if len(t.Command) == 0 {
+		return ""
+	}
+	return strings.ToUpper(t.Command[0])
+}
+
+// Redis is a protocol analyzer for the Redis serialization protocol. It
+// pairs the commands written to the local server with the server's replies.
+type Redis struct {
+	Txns     *util.Broadcast
+	reqMeter metrics.Meter
+	reqTimer metrics.Timer
+}
+
+func init() {
+	Register(Registration{
+		Name:    "redis",
+		Tunnels: []string{"tcp"},
+		New:     func() Protocol { return NewRedis() },
+	})
+}
+
+func NewRedis() *Redis {
+	return &Redis{
+		Txns:     util.NewBroadcast(),
+		reqMeter: metrics.NewMeter(),
+		reqTimer: metrics.NewTimer(),
+	}
+}
+
+func (r *Redis) GetName() string { return "redis" }
+
+func (r *Redis) WrapConn(ctx context.Context, c conn.Conn, connCtx interface{}) conn.Conn {
+	tee := conn.NewTee(c)
+	pending := make(chan *RedisTxn, redisMaxPipeline)
+	go r.readCommands(tee, pending, connCtx)
+	go r.readReplies(tee, pending)
+	return tee
+}
+
+func (r *Redis) readCommands(tee *conn.Tee, pending chan *RedisTxn, connCtx interface{}) {
+	rd := tee.WriteBuffer()
+
+	// whatever happens, keep consuming so we never block the real traffic,
+	// but let the reply reader know there are no more commands first
+	defer io.Copy(io.Discard, rd)
+
+	// whether commands are still paired with their replies
+	paired := true
+	unpair := func() {
+		if paired {
+			paired = false
+			close(pending)
+		}
+	}
+	defer unpair()
+
+	// CLIENT REPLY OFF silences the replies until CLIENT REPLY ON, SKIP
+	// silences the reply of the next command
+	var replyOff, skipNext bool
+
+	for {
+		cmd, err := readRespCommand(rd)
+		if err != nil {
+			if err != io.EOF {
+				tee.Warn("Failed to parse redis command: %v", err)
+			}
+			return
+		}
+
+		r.reqMeter.Mark(1)
+		txn := &RedisTxn{Command: cmd, Start: time.Now(), ConnUserCtx: connCtx}
+
+		mode := clientReplyMode(cmd)
+		replied := !replyOff && !skipNext && mode != "OFF" && mode != "SKIP"
+		skipNext = false
+		switch mode {
+		case "ON":
+			replyOff, replied = false, true
+		case "OFF":
+			replyOff = true
+		case "SKIP":
+			skipNext = !replyOff
+		}
+
+		// never wait for the reply reader, the real traffic would wait
+		// with us. Commands without replies, e.g. in a long pipeline,
+		// fill the queue, then the rest of the connection isn't paired.
+		if replied && paired {
+			select {
+			case pending <- txn:
+			default:
+				tee.Warn("More than %d redis commands are waiting for replies, no longer pairing them", redisMaxPipeline)
+				unpair()
+			}
+		}
+		r.Txns.In() <- txn
+
+		// a monitoring connection streams replies which don't belong
+		// to any command, there's nothing more we can pair up
+		if txn.Name() == "MONITOR" {
+			tee.Info("Connection entered MONITOR mode, no longer inspecting")
+			return
+		}
+	}
+}
+
+// clientReplyMode returns ON, OFF or SKIP for a CLIENT REPLY command, or ""
+func clientReplyMode(cmd []string) string {
+	if len(cmd) == 3 && strings.EqualFold(cmd[0], "CLIENT") && strings.EqualFold(cmd[1], "REPLY") {
+		return strings.ToUpper(cmd[2])
+	}
+	return ""
+}
+
+func (r *Redis) readReplies(tee *conn.Tee, pending chan *RedisTxn) {
+	rd := tee.ReadBuffer()
+
+	// whatever happens, keep consuming so we never block the real traffic
+	defer func() {
+		go func() {
+			for range pending {
+			}
+		}()
+		io.Copy(io.Discard, rd)
+	}()
+
+	var (
+		txn        *RedisTxn
+		remaining  int
+		subscribed bool
+	)
+
+	for {
+		reply, err := readRespValue(rd, 0)
+		if err != nil {
+			if err != io.EOF {
+				tee.Warn("Failed to parse redis reply: %v", err)
+			}
+			return
+		}
+
+		// attributes decorate the reply which follows them
+		if reply.Type == '|' {
+			continue
+		}
+
+		kind := respPubSubKind(reply)
+		if isRespUnsolicited(reply, kind, subscribed) {
+			continue
+		}
+
+		if remaining == 0 {
+			var ok bool
+			if txn, ok = <-pending; !ok {
+				return
+			}
+			remaining = expectedRespReplies(txn.Command)
+		}
+		remaining--
+
+		switch kind {
+		case "subscribe", "psubscribe", "ssubscribe":
+			subscribed = true
+		case "unsubscribe", "punsubscribe", "sunsubscribe":
+			// the last element is the number of remaining subscriptions
+			subscribed = reply.Elems[len(reply.Elems)-1].Str != "0"
+		}
+
+		// only the first reply of commands with many replies is captured
+		if txn.Reply == nil {
+			txn.Duration = time.Since(txn.Start)
+			r.reqTimer.Update(txn.Duration)
+			txn.Reply = &reply
+			r.Txns.In() <- txn
+		}
+
+		if txn.Name() == "MONITOR" {
+			return
+		}
+	}
+}
+
+// returns the kind of pub/sub message an array or push value is, if any
+func respPubSubKind(v RespValue) string {
+	if (v.Type != '*' && v.Type != '>') || len(v.Elems) < 3 {
+		return ""
+	}
+
+	switch kind := strings.ToLower(v.Elems[0].Str); kind {
+	case "subscribe", "psubscribe", "ssubscribe",
+		"unsubscribe", "punsubscribe", "sunsubscribe",
+		"message", "pmessage", "smessage":
+		return kind
+	}
+	return ""
+}
+
+// reports whether a value was sent by the server without a command
+// asking for it, i.e. RESP3 pushes and pub/sub messages
+func isRespUnsolicited(v RespValue, kind string, subscribed bool) bool {
+	switch kind {
+	case "message", "pmessage", "smessage":
+		return subscribed || v.Type == '>'
+	case "":
+		return v.Type == '>'
+	}
+	return false
+}
+
+// the number of replies the server sends to a command. (un)subscribe
+// commands are confirmed once per channel. Without arguments, unsubscribe
+// commands are confirmed for every channel, which we can't know, so pairing
+// is best effort in that case.
+func expectedRespReplies(cmd []string) int {
+	if len(cmd) < 2 {
+		return 1
+	}
+
+	switch strings.ToUpper(cmd[0]) {
+	case "SUBSCRIBE", "PSUBSCRIBE", "SSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "SUNSUBSCRIBE":
+		return len(cmd) - 1
+	}
+	return 1
+}
+
+// reads a command sent by a client, either as an array of bulk strings
+// or in the inline format used by telnet sessions
+func readRespCommand(rd *bufio.Reader) ([]string, error) {
+	for {
+		b, err := rd.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+
+		if b[0] == '*' {
+			v, err := readRespValue(rd, 0)
+			if err != nil {
+				return nil, err
+			}
+
+			cmd := make([]string, len(v.Elems))
+			for i, e := range v.Elems {
+				cmd[i] = e.Str
+			}
+			return cmd, nil
+		}
+
+		line, err := readRespLine(rd)
+		if err != nil {
+			return nil, err
+		}
+
+		// empty inline commands are ignored by the server
+		if cmd := strings.Fields(line); len(cmd) > 0 {
+			return cmd, nil
+		}
+	}
+}
+
+func readRespValue(rd *bufio.Reader, depth int) (v RespValue, err error) {
+	if depth > redisMaxDepth {
+		err = fmt.Errorf("RESP value nested more than %d levels deep", redisMaxDepth)
+		return
+	}
+
+	line, err := readRespLine(rd)
+	if err != nil {
+		return
+	}
+
+	if line == "" {
+		err = fmt.Errorf("empty RESP value")
+		return
+	}
+
+	v.Type, line = line[0], line[1:]
+	switch v.Type {
+	case '+', '-', ':', ',', '(', '#':
+		v.Str = line
+
+	case '_':
+		v.Null = true
+
+	case '$', '!', '=':
+		var n int
+		if n, err = strconv.Atoi(line); err != nil {
+			return
+		}
+
+		if n < 0 {
+			v.Null = true
+			return
+		}
+
+		v.Str, v.Truncated, err = readRespBulk(rd, n)
+
+	case '*', '~', '>', '%', '|':
+		if v.Len, err = strconv.Atoi(line); err != nil {
+			return
+		}
+
+		if v.Len < 0 {
+			v.Null = true
+			return
+		}
+
+		// maps and attributes are sent as key, value pairs
+		n := v.Len
+		if v.Type == '%' || v.Type == '|' {
+			n *= 2
+		}
+
+		for i := 0; i < n; i++ {
+			var e RespValue
+			if e, err = readRespValue(rd, depth+1); err != nil {
+				return
+			}
+
+			if len(v.Elems) < redisMaxElems {
+				v.Elems = append(v.Elems, e)
+			} else {
+				v.Truncated = true
+			}
+		}
+
+	default:
+		err = fmt.Errorf("unknown RESP type %q", v.Type)
+	}
+
+	return
+}
+
+// reads a bulk string of length n and its trailing CRLF, capturing
+// at most redisMaxCapture bytes of it
+func readRespBulk(rd *bufio.Reader, n int) (s string, truncated bool, err error) {
+	capture := n
+	if capture > redisMaxCapture {
+		capture, truncated = redisMaxCapture, true
+	}
+
+	buf := make([]byte, capture)
+	if _, err = io.ReadFull(rd, buf); err != nil {
+		return
+	}
+
+	if _, err = io.CopyN(io.Discard, rd, int64(n-capture)+2); err != nil {
+		return
+	}
+
+	return string(buf), truncated, nil
+}
+
+func readRespLine(rd *bufio.Reader) (string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && line != "" {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
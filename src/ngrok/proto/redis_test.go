@@ -0,0 +1,294 @@
+package proto
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/conn"
+)
+
+var respValueTests = []struct {
+	name  string
+	frame string
+	want  string
+}{
+	{"simple string", "+OK\r\n", "OK"},
+	{"error", "-ERR unknown command\r\n", "(error) ERR unknown command"},
+	{"integer", ":42\r\n", "(integer) 42"},
+	{"bulk string", "$5\r\nhello\r\n", `"hello"`},
+	{"empty bulk string", "$0\r\n\r\n", `""`},
+	{"bulk string with CRLF", "$7\r\nfoo\r\nba\r\n", `"foo\r\nba"`},
+	{"null bulk string", "$-1\r\n", "(nil)"},
+	{"array", "*2\r\n$3\r\nfoo\r\n:1\r\n", "(array of 2)"},
+	{"empty array", "*0\r\n", "(empty array)"},
+	{"null array", "*-1\r\n", "(nil)"},
+	{"nested array", "*2\r\n*1\r\n+a\r\n*0\r\n", "(array of 2)"},
+	{"resp3 null", "_\r\n", "(nil)"},
+	{"resp3 double", ",3.14\r\n", "(double) 3.14"},
+	{"resp3 boolean", "#t\r\n", "(true)"},
+	{"resp3 big number", "(3492890328409238509324850943850943825024385\r\n", "(integer) 3492890328409238509324850943850943825024385"},
+	{"resp3 bulk error", "!21\r\nSYNTAX invalid syntax\r\n", "(error) SYNTAX invalid syntax"},
+	{"resp3 verbatim string", "=15\r\ntxt:Some string\r\n", `"Some string"`},
+	{"resp3 map", "%2\r\n+a\r\n:1\r\n+b\r\n:2\r\n", "(map of 2)"},
+	{"resp3 set", "~2\r\n+a\r\n+b\r\n", "(set of 2)"},
+	{"resp3 push", ">3\r\n+message\r\n+news\r\n+hi\r\n", "(array of 3)"},
+}
+
+func readResp(s string) (RespValue, error) {
+	return readRespValue(bufio.NewReader(strings.NewReader(s)), 0)
+}
+
+func TestReadRespValue(t *testing.T) {
+	for _, tt := range respValueTests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a second value follows, which must be left unread
+			rd := bufio.NewReader(strings.NewReader(tt.frame + "+NEXT\r\n"))
+			v, err := readRespValue(rd, 0)
+			if err != nil {
+				t.Fatalf("readRespValue: %v", err)
+			}
+
+			if got := v.String(); got != tt.want {
+				t.Errorf("String() = %s, want %s", got, tt.want)
+			}
+
+			if next, err := readRespValue(rd, 0); err != nil || next.Str != "NEXT" {
+				t.Errorf("the next value %+v, %v, want NEXT", next, err)
+			}
+		})
+	}
+}
+
+func TestReadRespTruncated(t *testing.T) {
+	for _, tt := range respValueTests {
+		t.Run(tt.name, func(t *testing.T) {
+			// every prefix of a frame is incomplete
+			for i := 0; i < len(tt.frame); i++ {
+				if v, err := readResp(tt.frame[:i]); err == nil {
+					t.Errorf("%q read as %+v, want an error", tt.frame[:i], v)
+				}
+			}
+		})
+	}
+}
+
+func TestReadRespMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame string
+	}{
+		{"empty line", "\r\n"},
+		{"unknown type", "?what\r\n"},
+		{"invalid bulk length", "$abc\r\nfoo\r\n"},
+		{"invalid array length", "*two\r\n"},
+		{"bulk string shorter than its length", "$10\r\nfoo\r\n"},
+		{"array with fewer elements", "*3\r\n:1\r\n:2\r\n"},
+		{"too deeply nested", strings.Repeat("*1\r\n", redisMaxDepth+2) + ":1\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if v, err := readResp(tt.frame); err == nil {
+				t.Errorf("read %+v, want an error", v)
+			}
+		})
+	}
+}
+
+func TestReadRespLimits(t *testing.T) {
+	long := strings.Repeat("x", redisMaxCapture+10)
+	v, err := readResp("$" + strconv.Itoa(len(long)) + "\r\n" + long + "\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.Truncated || len(v.Str) != redisMaxCapture {
+		t.Errorf("long bulk string captured %d bytes, truncated %v", len(v.Str), v.Truncated)
+	}
+
+	frame := "*" + strconv.Itoa(redisMaxElems+5) + "\r\n" + strings.Repeat(":1\r\n", redisMaxElems+5)
+	if v, err = readResp(frame); err != nil {
+		t.Fatal(err)
+	}
+	if !v.Truncated || len(v.Elems) != redisMaxElems || v.Len != redisMaxElems+5 {
+		t.Errorf("long array captured %d of %d elements, truncated %v", len(v.Elems), v.Len, v.Truncated)
+	}
+}
+
+func TestReadRespCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{"array", "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n", []string{"SET", "key", "value"}, false},
+		{"inline", "PING\r\n", []string{"PING"}, false},
+		{"inline with arguments", "GET  key\n", []string{"GET", "key"}, false},
+		{"empty inline commands are skipped", "\r\n \r\nPING\r\n", []string{"PING"}, false},
+		{"truncated array", "*2\r\n$3\r\nGET\r\n", nil, true},
+		{"truncated inline", "PING", nil, true},
+		{"nothing", "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, err := readRespCommand(bufio.NewReader(strings.NewReader(tt.input)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(cmd, tt.want) {
+				t.Errorf("command %q, want %q", cmd, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpectedRespReplies(t *testing.T) {
+	tests := []struct {
+		cmd  []string
+		want int
+	}{
+		{[]string{"GET", "key"}, 1},
+		{[]string{"subscribe", "a", "b", "c"}, 3},
+		{[]string{"PSUBSCRIBE", "news.*"}, 1},
+		{[]string{"UNSUBSCRIBE"}, 1},
+		{nil, 1},
+	}
+
+	for _, tt := range tests {
+		if got := expectedRespReplies(tt.cmd); got != tt.want {
+			t.Errorf("expectedRespReplies(%q) = %d, want %d", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+// redisSession sends commands through the analyzer to a local server which
+// answers with replies. It returns the reply reported for each command, ""
+// for those without one, once wantReplies replies were reported.
+func redisSession(t *testing.T, commands, replies string, wantReplies int) map[string]string {
+	r := NewRedis()
+	reported := make(map[string]string)
+	updates := r.Txns.Reg()
+	collected := make(chan int)
+	go func() {
+		defer close(collected)
+
+		// a transaction is broadcast for its command, and again once its
+		// reply is set
+		seen := make(map[*RedisTxn]bool)
+		end, paired := false, 0
+		for obj := range updates {
+			txn := obj.(*RedisTxn)
+			command := strings.Join(txn.Command, " ")
+			if seen[txn] {
+				reported[command] = txn.Reply.String()
+				paired++
+			} else if _, ok := reported[command]; !ok {
+				reported[command] = ""
+			}
+			seen[txn] = true
+
+			end = end || command == "END"
+			if end && paired >= wantReplies {
+				return
+			}
+		}
+	}()
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	tee := r.WrapConn(context.Background(), conn.Wrap(local, "test"), nil)
+	defer tee.Close()
+	go io.Copy(io.Discard, remote)
+	go io.Copy(io.Discard, tee)
+
+	// the commands must pass even though no replies come for them
+	written := make(chan error)
+	go func() {
+		_, err := tee.Write([]byte(commands + "END\r\n"))
+		written <- err
+	}()
+
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the commands were held up waiting for replies")
+	}
+
+	if _, err := remote.Write([]byte(replies)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-collected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the replies weren't reported")
+	}
+	return reported
+}
+
+func TestRedisClientReply(t *testing.T) {
+	commands := "CLIENT REPLY OFF\r\n" + strings.Repeat("SET k v\r\n", redisMaxPipeline*2) +
+		"CLIENT REPLY ON\r\nCLIENT REPLY SKIP\r\nINCR a\r\nGET k\r\n"
+	reported := redisSession(t, commands, "+OK\r\n$1\r\nv\r\n", 2)
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"CLIENT REPLY OFF", ""},
+		{"SET k v", ""},
+		{"CLIENT REPLY ON", "OK"},
+		{"CLIENT REPLY SKIP", ""},
+		{"INCR a", ""},
+		{"GET k", `"v"`},
+	}
+
+	for _, tt := range tests {
+		if got, ok := reported[tt.command]; !ok {
+			t.Errorf("%s wasn't reported", tt.command)
+		} else if got != tt.want {
+			t.Errorf("%s: reply %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestRedisLongPipeline(t *testing.T) {
+	// more commands are pipelined than can wait for their replies, the
+	// ones which could are still paired
+	commands := strings.Repeat("PING\r\n", redisMaxPipeline*2)
+	reported := redisSession(t, commands, strings.Repeat("+PONG\r\n", redisMaxPipeline*2), 1)
+
+	if reported["PING"] != "PONG" {
+		t.Errorf("PING: reply %q, want PONG", reported["PING"])
+	}
+}
+
+func TestClientReplyMode(t *testing.T) {
+	tests := []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"client", "reply", "off"}, "OFF"},
+		{[]string{"CLIENT", "REPLY", "Skip"}, "SKIP"},
+		{[]string{"CLIENT", "LIST"}, ""},
+		{[]string{"CLIENT", "REPLY"}, ""},
+		{[]string{"GET", "reply"}, ""},
+	}
+
+	for _, tt := range tests {
+		if got := clientReplyMode(tt.cmd); got != tt.want {
+			t.Errorf("clientReplyMode(%q) = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package proto
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Registration describes a protocol analyzer and the tunnel
+// protocols whose traffic it knows how to inspect. Analyzers register
+// themselves from an init() function so that the client can discover
+// them without having to know about each implementation.
+type Registration struct {
+	// name of the analyzer, must match the Protocol's GetName()
+	Name string
+
+	// tunnel protocols (as requested from the server) that this
+	// analyzer can be attached to
+	Tunnels []string
+
+	// whether this analyzer is used for its tunnel protocols when
+	// the configuration doesn't ask for a specific one
+	Default bool
+
+	// constructs a new instance of the analyzer
+	New func() Protocol
+
+	// optional hook to validate the configuration of a tunnel
+	// which uses this analyzer
+	Validate func(tunnelProto, localAddr string) error
+}
+
+var registry = struct {
+	sync.RWMutex
+	regs map[string]Registration
+}{
+	regs: make(map[string]Registration),
+}
+
+// Register makes a protocol analyzer available by its name.
+// It panics if the registration is incomplete or if an analyzer
+// with the same name was already registered.
+func Register(r Registration) {
+	if r.Name == "" || r.New == nil || len(r.Tunnels) == 0 {
+		panic(fmt.Sprintf("proto: invalid registration for analyzer %q", r.Name))
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	if _, ok := registry.regs[r.Name]; ok {
+		panic(fmt.Sprintf("proto: analyzer %s registered twice", r.Name))
+	}
+
+	registry.regs[r.Name] = r
+}
+
+// Lookup returns the registration for the named analyzer
+func Lookup(name string) (r Registration, ok bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	r, ok = registry.regs[name]
+	return
+}
+
+// Registrations returns all of the registered analyzers, sorted by name
+func Registrations() []Registration {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	regs := make([]Registration, 0, len(registry.regs))
+	for _, r := range registry.regs {
+		regs = append(regs, r)
+	}
+
+	sort.Slice(regs, func(i, j int) bool { return regs[i].Name < regs[j].Name })
+	return regs
+}
+
+// DefaultFor returns the analyzer used for a tunnel protocol when the
+// configuration does not select one explicitly
+func DefaultFor(tunnelProto string) (Registration, bool) {
+	for _, r := range Registrations() {
+		if r.Default && r.Supports(tunnelProto) {
+			return r, true
+		}
+	}
+	return Registration{}, false
+}
+
+// Supports reports whether the analyzer can be attached to the tunnel protocol
+func (r Registration) Supports(tunnelProto string) bool {
+	for _, t := range r.Tunnels {
+		if t == tunnelProto {
+			return true
+		}
+	}
+	return false
+}
+
+// the '+' separated tunnel protocols a client can ask for, a tunnel can't
+// combine any others
+var combinations = map[string]bool{
+	"http+https": true,
+}
+
+// ValidTunnelProtocol returns an error unless a tunnel protocol is handled
+// by a registered analyzer, or is a valid combination of protocols (e.g.
+// "http+https") which each are.
+func ValidTunnelProtocol(tunnelProto string) error {
+	if strings.Contains(tunnelProto, "+") && !combinations[tunnelProto] {
+		return fmt.Errorf("protocols %s can't be combined", tunnelProto)
+	}
+
+	for _, p := range strings.Split(tunnelProto, "+") {
+		if _, ok := DefaultFor(p); !ok {
+			return fmt.Errorf("no analyzer registered for protocol %s", p)
+		}
+	}
+	return nil
+}
@@ -8,6 +8,15 @@ import (
 
 type Tcp struct{}
 
+func init() {
+	Register(Registration{
+		Name:    "tcp",
+		Tunnels: []string{"tcp"},
+		Default: true,
+		New:     func() Protocol { return NewTcp() },
+	})
+}
+
 func NewTcp() *Tcp {
 	return new(Tcp)
 }
@@ -0,0 +1,30 @@
+package proto
+
+import (
+	"context"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/conn"
+)
+
+// Udp tunnels carry framed datagrams rather than a stream, so there's
+// nothing to analyze
+type Udp struct{}
+
+func init() {
+	Register(Registration{
+		Name:    "udp",
+		Tunnels: []string{"udp"},
+		Default: true,
+		New:     func() Protocol { return NewUdp() },
+	})
+}
+
+func NewUdp() *Udp {
+	return new(Udp)
+}
+
+func (h *Udp) GetName() string { return "udp" }
+
+func (h *Udp) WrapConn(ctx context.Context, c conn.Conn, connCtx interface{}) conn.Conn {
+	return c
+}
@@ -0,0 +1,295 @@
+// The PROXY protocol, versions 1 and 2
+//
+// A proxy which accepts a connection on behalf of a server sends a PROXY
+// header before the data of the connection, so the server learns the
+// address of the client rather than the proxy's. Version 1 is a line of
+// text, version 2 a binary header. See
+// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/ipfilter"
+)
+
+const (
+	// the longest version 1 header, including the CRLF
+	maxV1Length = 107
+
+	v1Prefix = "PROXY "
+
+	// commands and families of version 2 headers
+	v2Local  = 0x20
+	v2Proxy  = 0x21
+	v2Unspec = 0x00
+	v2Tcp4   = 0x11
+	v2Udp4   = 0x12
+	v2Tcp6   = 0x21
+	v2Udp6   = 0x22
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+type Header struct {
+	// 1 or 2
+	Version int
+
+	// the addresses of the client and of the server it connected to, nil
+	// when the proxy didn't know them, e.g. for its own health checks
+	Src, Dst *net.TCPAddr
+}
+
+// NewHeader returns the header of a connection from src to dst. The
+// addresses are left out if either of them isn't a known TCP address.
+func NewHeader(version int, src, dst net.Addr) *Header {
+	h := &Header{Version: version}
+
+	s, ok1 := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	if ok1 && ok2 && s != nil && d != nil && s.IP != nil && d.IP != nil {
+		h.Src, h.Dst = s, d
+	}
+	return h
+}
+
+// Format encodes the header in its version
+func (h *Header) Format() ([]byte, error) {
+	switch h.Version {
+	case 1:
+		return h.formatV1(), nil
+	case 2:
+		return h.formatV2(), nil
+	default:
+		return nil, fmt.Errorf("Unsupported PROXY protocol version %d", h.Version)
+	}
+}
+
+func (h *Header) formatV1() []byte {
+	if h.Src == nil || h.Dst == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	src, dst, family := ips(h.Src.IP, h.Dst.IP)
+	proto := "TCP4"
+	if family == v2Tcp6 {
+		proto = "TCP6"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, src, dst, h.Src.Port, h.Dst.Port))
+}
+
+func (h *Header) formatV2() []byte {
+	var buf bytes.Buffer
+	buf.Write(v2Signature)
+
+	if h.Src == nil || h.Dst == nil {
+		buf.Write([]byte{v2Local, v2Unspec, 0, 0})
+		return buf.Bytes()
+	}
+
+	src, dst, family := ips(h.Src.IP, h.Dst.IP)
+	buf.Write([]byte{v2Proxy, family})
+	binary.Write(&buf, binary.BigEndian, uint16(2*len(src)+4))
+	buf.Write(src)
+	buf.Write(dst)
+	binary.Write(&buf, binary.BigEndian, uint16(h.Src.Port))
+	binary.Write(&buf, binary.BigEndian, uint16(h.Dst.Port))
+	return buf.Bytes()
+}
+
+// ips returns both addresses in the same family, IPv6 if either of them is
+func ips(src, dst net.IP) (net.IP, net.IP, byte) {
+	if s, d := src.To4(), dst.To4(); s != nil && d != nil {
+		return s, d, v2Tcp4
+	}
+	return src.To16(), dst.To16(), v2Tcp6
+}
+
+// Write sends the header of a connection from src to dst
+func Write(w io.Writer, version int, src, dst net.Addr) error {
+	b, err := NewHeader(version, src, dst).Format()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+// Read reads a header of either version
+func Read(r *bufio.Reader) (*Header, error) {
+	// the shortest header is "PROXY UNKNOWN\r\n"
+	prefix, err := r.Peek(len(v1Prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	if string(prefix) == v1Prefix {
+		return readV1(r)
+	}
+
+	if prefix, err = r.Peek(len(v2Signature)); err == nil && bytes.Equal(prefix, v2Signature) {
+		return readV2(r)
+	}
+	return nil, fmt.Errorf("Missing PROXY protocol header")
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	line := make([]byte, 0, maxV1Length)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+
+		if len(line) == maxV1Length {
+			return nil, fmt.Errorf("PROXY protocol header is too long")
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("PROXY protocol header doesn't end with CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &Header{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("Invalid PROXY protocol header '%s'", strings.TrimSpace(string(line)))
+	}
+
+	var err error
+	if h.Src, err = parseAddr(fields[2], fields[4]); err != nil {
+		return nil, err
+	}
+
+	if h.Dst, err = parseAddr(fields[3], fields[5]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func parseAddr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil {
+		return nil, fmt.Errorf("Invalid address '%s' in PROXY protocol header", ip)
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return nil, fmt.Errorf("Invalid port '%s' in PROXY protocol header", port)
+	}
+	addr.Port = p
+	return addr, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	head := make([]byte, len(v2Signature)+4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+
+	command, family := head[12], head[13]
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	h := &Header{Version: 2}
+	switch command {
+	case v2Local:
+		return h, nil
+	case v2Proxy:
+	default:
+		return nil, fmt.Errorf("Invalid PROXY protocol command 0x%x", command)
+	}
+
+	size := 0
+	switch family {
+	case v2Tcp4, v2Udp4:
+		size = net.IPv4len
+	case v2Tcp6, v2Udp6:
+		size = net.IPv6len
+	default:
+		// unix sockets and unknown families, the addresses are of no use
+		return h, nil
+	}
+
+	// what follows the addresses are TLVs, which we don't need
+	if len(body) < 2*size+4 {
+		return nil, fmt.Errorf("PROXY protocol header is too short for its addresses")
+	}
+
+	h.Src = &net.TCPAddr{IP: net.IP(body[:size]), Port: int(binary.BigEndian.Uint16(body[2*size:]))}
+	h.Dst = &net.TCPAddr{IP: net.IP(body[size : 2*size]), Port: int(binary.BigEndian.Uint16(body[2*size+2:]))}
+	return h, nil
+}
+
+// Conn is a connection whose PROXY header has been read. It reports the
+// client's address from the header as its remote address.
+type Conn struct {
+	net.Conn
+	rd     *bufio.Reader
+	Header *Header
+}
+
+// Accept reads the PROXY header the proxy sent on c, waiting at most
+// timeout for it
+func Accept(c net.Conn, timeout time.Duration) (*Conn, error) {
+	c.SetReadDeadline(time.Now().Add(timeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	rd := bufio.NewReader(c)
+	h, err := Read(rd)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: c, rd: rd, Header: h}, nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.rd.Read(b)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.Header.Src == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.Header.Src
+}
+
+// Trusted are the networks of the proxies whose headers are believed
+type Trusted ipfilter.List
+
+// ParseTrusted parses a comma separated list of IP addresses and CIDR
+// networks, e.g. 10.0.0.0/8,192.168.1.5
+func ParseTrusted(s string) (Trusted, error) {
+	l, err := ipfilter.Parse(strings.Split(s, ","))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid trusted proxy: %v", err)
+	}
+	return Trusted(l), nil
+}
+
+// Contains reports whether a connection from addr comes from a trusted
+// proxy. Nothing is trusted when the list is empty.
+func (t Trusted) Contains(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && ipfilter.List(t).Contains(tcpAddr.IP)
+}
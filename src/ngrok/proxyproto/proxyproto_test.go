@@ -0,0 +1,177 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func tcpAddr(s string) *net.TCPAddr {
+	addr, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		panic(err)
+	}
+	return addr
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  int
+		src, dst net.Addr
+		wantSrc  string
+		wantDst  string
+	}{
+		{"v1 ipv4", 1, tcpAddr("203.0.113.7:51000"), tcpAddr("10.0.0.1:8080"), "203.0.113.7:51000", "10.0.0.1:8080"},
+		{"v1 ipv6", 1, tcpAddr("[2001:db8::7]:51000"), tcpAddr("[2001:db8::1]:443"), "[2001:db8::7]:51000", "[2001:db8::1]:443"},
+		{"v1 mixed families", 1, tcpAddr("203.0.113.7:1"), tcpAddr("[2001:db8::1]:2"), "203.0.113.7:1", "[2001:db8::1]:2"},
+		{"v1 unknown", 1, nil, tcpAddr("10.0.0.1:8080"), "", ""},
+		{"v2 ipv4", 2, tcpAddr("203.0.113.7:51000"), tcpAddr("10.0.0.1:8080"), "203.0.113.7:51000", "10.0.0.1:8080"},
+		{"v2 ipv6", 2, tcpAddr("[2001:db8::7]:65535"), tcpAddr("[2001:db8::1]:0"), "[2001:db8::7]:65535", "[2001:db8::1]:0"},
+		{"v2 local", 2, &net.UDPAddr{}, tcpAddr("10.0.0.1:8080"), "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := Write(&buf, tt.version, tt.src, tt.dst); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+
+			// the data after the header must be left for the application
+			buf.WriteString("GET / HTTP/1.1\r\n")
+
+			rd := bufio.NewReader(&buf)
+			h, err := Read(rd)
+			if err != nil {
+				t.Fatalf("Read: %v", err)
+			}
+
+			if h.Version != tt.version {
+				t.Errorf("version %d, want %d", h.Version, tt.version)
+			}
+
+			if tt.wantSrc == "" {
+				if h.Src != nil || h.Dst != nil {
+					t.Errorf("addresses %v %v, want none", h.Src, h.Dst)
+				}
+			} else {
+				if h.Src == nil || h.Src.String() != tt.wantSrc {
+					t.Errorf("source %v, want %s", h.Src, tt.wantSrc)
+				}
+				if h.Dst == nil || h.Dst.String() != tt.wantDst {
+					t.Errorf("destination %v, want %s", h.Dst, tt.wantDst)
+				}
+			}
+
+			if rest, _ := rd.ReadString('\n'); rest != "GET / HTTP/1.1\r\n" {
+				t.Errorf("data after the header %q", rest)
+			}
+		})
+	}
+}
+
+func TestReadMalformed(t *testing.T) {
+	v2 := func(command, family byte, length uint16, body string) string {
+		return string(v2Signature) + string([]byte{command, family, byte(length >> 8), byte(length)}) + body
+	}
+
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{"empty", ""},
+		{"no header", "GET / HTTP/1.1\r\n\r\n"},
+		{"v1 truncated", "PROXY TCP4 203.0.113.7"},
+		{"v1 without CRLF", "PROXY TCP4 203.0.113.7 10.0.0.1 51000 8080\n"},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", maxV1Length) + "\r\n"},
+		{"v1 unknown protocol", "PROXY UDP4 203.0.113.7 10.0.0.1 51000 8080\r\n"},
+		{"v1 missing field", "PROXY TCP4 203.0.113.7 10.0.0.1 51000\r\n"},
+		{"v1 invalid address", "PROXY TCP4 203.0.113.300 10.0.0.1 51000 8080\r\n"},
+		{"v1 invalid port", "PROXY TCP4 203.0.113.7 10.0.0.1 51000 80800\r\n"},
+		{"v1 negative port", "PROXY TCP4 203.0.113.7 10.0.0.1 -1 8080\r\n"},
+		{"v2 truncated signature", string(v2Signature[:8])},
+		{"v2 truncated head", string(v2Signature) + "\x21"},
+		{"v2 truncated body", v2(v2Proxy, v2Tcp4, 12, "\xcb\x00\x71")},
+		{"v2 invalid command", v2(0x22, v2Tcp4, 12, strings.Repeat("\x00", 12))},
+		{"v2 body too short for ipv4", v2(v2Proxy, v2Tcp4, 4, "\xcb\x00\x71\x07")},
+		{"v2 body too short for ipv6", v2(v2Proxy, v2Tcp6, 12, strings.Repeat("\x00", 12))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if h, err := Read(bufio.NewReader(strings.NewReader(tt.header))); err == nil {
+				t.Errorf("read %+v, want an error", h)
+			}
+		})
+	}
+}
+
+func TestReadV2Families(t *testing.T) {
+	tests := []struct {
+		name    string
+		family  byte
+		body    []byte
+		wantSrc string
+	}{
+		{"udp4", v2Udp4, []byte{203, 0, 113, 7, 10, 0, 0, 1, 0xc7, 0x38, 0x1f, 0x90}, "203.0.113.7:51000"},
+		{"tlvs after the addresses", v2Tcp4, []byte{203, 0, 113, 7, 10, 0, 0, 1, 0xc7, 0x38, 0x1f, 0x90, 0x04, 0x00, 0x01, 0x00}, "203.0.113.7:51000"},
+		{"unix sockets", 0x31, make([]byte, 216), ""},
+		{"unspecified", v2Unspec, nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := append([]byte{}, v2Signature...)
+			b = append(b, v2Proxy, tt.family, byte(len(tt.body)>>8), byte(len(tt.body)))
+			b = append(b, tt.body...)
+
+			h, err := Read(bufio.NewReader(bytes.NewReader(b)))
+			if err != nil {
+				t.Fatalf("Read: %v", err)
+			}
+
+			got := ""
+			if h.Src != nil {
+				got = h.Src.String()
+			}
+			if got != tt.wantSrc {
+				t.Errorf("source %q, want %q", got, tt.wantSrc)
+			}
+		})
+	}
+}
+
+func TestTrusted(t *testing.T) {
+	trusted, err := ParseTrusted("10.0.0.0/8, 192.168.1.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{tcpAddr("10.1.2.3:1234"), true},
+		{tcpAddr("192.168.1.5:1234"), true},
+		{tcpAddr("192.168.1.6:1234"), false},
+		{&net.UDPAddr{IP: net.ParseIP("10.1.2.3")}, false},
+		{nil, false},
+	}
+
+	for _, tt := range tests {
+		if got := trusted.Contains(tt.addr); got != tt.want {
+			t.Errorf("Contains(%v) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	if empty, _ := ParseTrusted(""); empty.Contains(tcpAddr("10.1.2.3:1")) {
+		t.Errorf("an empty list trusts nothing")
+	}
+
+	if _, err := ParseTrusted("10.0.0.0/33"); err == nil {
+		t.Errorf("ParseTrusted accepted an invalid network")
+	}
+}
@@ -0,0 +1,310 @@
+// Subdomains, hostnames and TCP and UDP ports reserved for an auth token
+//
+// Reservations are kept in a JSON file which the admin commands of ngrokd
+// edit while the server is running. The server reloads the file whenever
+// it changes and refuses reserved names to other tokens, even while the
+// owner of a reservation isn't connected. Tokens are stored as SHA-256
+// hashes so the file doesn't reveal them.
+package reservations
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	Subdomain = "subdomain"
+	Hostname  = "hostname"
+	TcpPort   = "tcp_port"
+	UdpPort   = "udp_port"
+
+	// the version of the file format
+	version = 1
+)
+
+type Reservation struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+
+	// hex SHA-256 hash of the auth token owning the reservation
+	TokenHash string    `json:"token_hash"`
+	Created   time.Time `json:"created"`
+}
+
+type file struct {
+	Version      int            `json:"version"`
+	Reservations []*Reservation `json:"reservations"`
+}
+
+type Store struct {
+	path string
+
+	sync.Mutex
+	reservations map[string]*Reservation
+
+	// the modification time of the file when it was last read
+	modTime time.Time
+}
+
+// Open reads the reservations in a file, which doesn't need to exist yet
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, reservations: make(map[string]*Reservation)}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Normalize validates a name of the given kind and returns it in the form
+// it's stored in
+func Normalize(kind, name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	switch kind {
+	case Subdomain, Hostname:
+		if name == "" || strings.ContainsAny(name, "/: ") {
+			return "", fmt.Errorf("Invalid %s '%s'", kind, name)
+		}
+		return name, nil
+
+	case TcpPort, UdpPort:
+		port, err := strconv.Atoi(name)
+		if err != nil || port < 1 || port > 65535 {
+			return "", fmt.Errorf("Invalid port '%s'", name)
+		}
+		return strconv.Itoa(port), nil
+
+	default:
+		return "", fmt.Errorf("Unknown kind of reservation '%s', use %s, %s, %s or %s", kind, Subdomain, Hostname, TcpPort, UdpPort)
+	}
+}
+
+func key(kind, name string) string {
+	return kind + ":" + name
+}
+
+// Check returns an error if the name is reserved for another token. A nil
+// store has no reservations.
+func (s *Store) Check(kind, name, token string) error {
+	if s == nil {
+		return nil
+	}
+
+	name, err := Normalize(kind, name)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.reload(); err != nil {
+		return fmt.Errorf("Failed to read reservations: %v", err)
+	}
+
+	r, ok := s.reservations[key(kind, name)]
+	if ok && r.TokenHash != HashToken(token) {
+		return fmt.Errorf("The %s %s is reserved.", strings.Replace(kind, "_", " ", 1), name)
+	}
+	return nil
+}
+
+// Reserved returns the names of the given kind which are reserved for other
+// tokens than token, reading the reservations once. A nil store has no
+// reservations.
+func (s *Store) Reserved(kind, token string) (map[string]bool, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.reload(); err != nil {
+		return nil, fmt.Errorf("Failed to read reservations: %v", err)
+	}
+
+	hash := HashToken(token)
+	reserved := make(map[string]bool)
+	for _, r := range s.reservations {
+		if r.Kind == kind && r.TokenHash != hash {
+			reserved[r.Name] = true
+		}
+	}
+	return reserved, nil
+}
+
+// Reserve binds a name to a token. It fails if the name is reserved for
+// another token, unless force is set.
+func (s *Store) Reserve(kind, name, token string, force bool) (*Reservation, error) {
+	name, err := Normalize(kind, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if token == "" {
+		return nil, fmt.Errorf("Reservations need an auth token")
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	hash := HashToken(token)
+	if r, ok := s.reservations[key(kind, name)]; ok && r.TokenHash != hash && !force {
+		return nil, fmt.Errorf("The %s %s is already reserved for another token", kind, name)
+	}
+
+	r := &Reservation{Kind: kind, Name: name, TokenHash: hash, Created: time.Now().UTC()}
+	s.reservations[key(kind, name)] = r
+	return r, s.save()
+}
+
+// Release removes a reservation
+func (s *Store) Release(kind, name string) error {
+	name, err := Normalize(kind, name)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.reload(); err != nil {
+		return err
+	}
+
+	if _, ok := s.reservations[key(kind, name)]; !ok {
+		return fmt.Errorf("The %s %s isn't reserved", kind, name)
+	}
+
+	delete(s.reservations, key(kind, name))
+	return s.save()
+}
+
+// List returns the reservations ordered by kind and name
+func (s *Store) List() ([]Reservation, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	list := make([]Reservation, 0, len(s.reservations))
+	for _, r := range s.reservations {
+		list = append(list, *r)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Kind != list[j].Kind {
+			return list[i].Kind < list[j].Kind
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list, nil
+}
+
+// reload reads the file again if it changed since it was last read,
+// must hold the lock
+func (s *Store) reload() error {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		s.reservations, s.modTime = make(map[string]*Reservation), time.Time{}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	var f file
+	if err = json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("Invalid reservations file %s: %v", s.path, err)
+	}
+
+	if f.Version != version {
+		return fmt.Errorf("Unsupported version %d of reservations file %s", f.Version, s.path)
+	}
+
+	reservations := make(map[string]*Reservation, len(f.Reservations))
+	for _, r := range f.Reservations {
+		reservations[key(r.Kind, r.Name)] = r
+	}
+
+	s.reservations, s.modTime = reservations, info.ModTime()
+	return nil
+}
+
+// save writes the reservations to a temporary file and renames it over
+// the old one, so the server never reads a partly written file. Must hold
+// the lock.
+func (s *Store) save() error {
+	f := file{Version: version, Reservations: make([]*Reservation, 0, len(s.reservations))}
+	for _, r := range s.reservations {
+		f.Reservations = append(f.Reservations, r)
+	}
+
+	sort.Slice(f.Reservations, func(i, j int) bool {
+		return key(f.Reservations[i].Kind, f.Reservations[i].Name) < key(f.Reservations[j].Kind, f.Reservations[j].Name)
+	})
+
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(append(b, '\n')); err == nil {
+		err = tmp.Sync()
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err = os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
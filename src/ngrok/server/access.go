@@ -0,0 +1,24 @@
+package server
+
+import (
+	"net"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/ipfilter"
+	"github.com/inconshreveable/ngrok/src/ngrok/log"
+)
+
+// denied reports whether connections from addr are refused by the
+// server-wide deny list
+func denied(addr net.Addr) bool {
+	deny, err := ipDenylist.Denied(ipfilter.IP(addr))
+	if err != nil {
+		log.Warn("Failed to reload the IP deny list: %v", err)
+	}
+	return deny
+}
+
+// admits reports whether the tunnel accepts connections from addr, which
+// must not be on the server's deny list either
+func (t *Tunnel) admits(addr net.Addr) bool {
+	return !denied(addr) && t.filter.Allowed(ipfilter.IP(addr))
+}
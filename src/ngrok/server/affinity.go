@@ -0,0 +1,262 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/cache"
+	"github.com/inconshreveable/ngrok/src/ngrok/log"
+)
+
+// the version of the affinity snapshot and journal encoding
+const affinityVersion = 1
+
+type affinityEntry struct {
+	Version int    `json:"v,omitempty"`
+	Key     string `json:"key"`
+	Url     string `json:"url"`
+
+	// unix time when the affinity expires, 0 if it never does
+	Expires int64 `json:"expires,omitempty"`
+}
+
+type affinitySnapshot struct {
+	Version int       `json:"version"`
+	Saved   time.Time `json:"saved"`
+
+	// oldest first, so loading them in order restores which are the
+	// least recently used
+	Entries []affinityEntry `json:"entries"`
+}
+
+/**
+ * affinityFile: Persists the affinity cache so that clients get their urls
+ *               back after ngrokd restarts. Every change is appended to a
+ *               journal as it happens, and the whole cache is periodically
+ *               written to a snapshot, which replaces the old one
+ *               atomically and empties the journal. After a crash, the
+ *               snapshot is loaded and the journal replayed on top of it.
+ */
+type affinityFile struct {
+	log.Logger
+
+	path  string
+	cache *cache.LRUCache
+
+	// how long affinities last after they're set, 0 for forever
+	ttl time.Duration
+
+	sync.Mutex
+	journal *os.File
+}
+
+// openAffinityFile loads the snapshot at path and its journal into the
+// cache, then opens the journal for appending
+func openAffinityFile(path string, c *cache.LRUCache, ttl time.Duration) (*affinityFile, error) {
+	f := &affinityFile{
+		Logger: log.NewPrefixLogger("affinity"),
+		path:   path,
+		cache:  c,
+		ttl:    ttl,
+	}
+
+	if err := f.loadSnapshot(); err != nil {
+		return nil, err
+	}
+
+	if err := f.replayJournal(); err != nil {
+		return nil, err
+	}
+
+	journal, err := os.OpenFile(f.journalPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.journal = journal
+	return f, nil
+}
+
+func (f *affinityFile) journalPath() string {
+	return f.path + ".journal"
+}
+
+func (f *affinityFile) loadSnapshot() error {
+	b, err := os.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var snapshot affinitySnapshot
+	if err = json.Unmarshal(b, &snapshot); err != nil {
+		// files written by older versions are gob encoded cache items
+		if legacyErr := f.cache.LoadItems(bytes.NewReader(b)); legacyErr == nil {
+			f.Info("Migrated the affinity cache in %s from the gob encoding", f.path)
+			return nil
+		}
+		return fmt.Errorf("Invalid affinity snapshot %s: %v", f.path, err)
+	}
+
+	if snapshot.Version != affinityVersion {
+		return fmt.Errorf("Unsupported version %d of affinity snapshot %s", snapshot.Version, f.path)
+	}
+
+	for _, e := range snapshot.Entries {
+		f.set(e)
+	}
+	f.Info("Loaded %d affinities saved at %v", len(snapshot.Entries), snapshot.Saved)
+	return nil
+}
+
+func (f *affinityFile) replayJournal() error {
+	rd, err := os.Open(f.journalPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	replayed := 0
+	scanner := bufio.NewScanner(rd)
+	for scanner.Scan() {
+		var e affinityEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// the last entry is cut short if we crashed while appending it
+			f.Warn("Skipping invalid journal entry: %v", err)
+			continue
+		}
+
+		if e.Version != affinityVersion {
+			return fmt.Errorf("Unsupported version %d of affinity journal %s", e.Version, f.journalPath())
+		}
+
+		f.set(e)
+		replayed++
+	}
+
+	if replayed > 0 {
+		f.Info("Replayed %d affinities from the journal", replayed)
+	}
+	return scanner.Err()
+}
+
+// set loads an entry into the cache, unless it has expired
+func (f *affinityFile) set(e affinityEntry) {
+	if e.Expires == 0 {
+		f.cache.Set(e.Key, cacheUrl(e.Url))
+	} else if ttl := time.Until(time.Unix(e.Expires, 0)); ttl > 0 {
+		f.cache.SetWithTTL(e.Key, cacheUrl(e.Url), ttl)
+	}
+}
+
+// Append records in the journal that the keys now map to a url
+func (f *affinityFile) Append(url string, keys ...string) {
+	var expires int64
+	if f.ttl > 0 {
+		expires = time.Now().Add(f.ttl).Unix()
+	}
+
+	var buf bytes.Buffer
+	for _, key := range keys {
+		b, err := json.Marshal(affinityEntry{Version: affinityVersion, Key: key, Url: url, Expires: expires})
+		if err != nil {
+			f.Error("Failed to encode affinity: %v", err)
+			return
+		}
+		buf.Write(append(b, '\n'))
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	_, err := f.journal.Write(buf.Bytes())
+	if err == nil {
+		err = f.journal.Sync()
+	}
+
+	if err != nil {
+		f.Error("Failed to append to affinity journal: %v", err)
+	}
+}
+
+// Save writes a snapshot of the cache and empties the journal. The
+// snapshot is written to a temporary file which is renamed over the old
+// one, so a crash leaves either the old or the new snapshot in place.
+func (f *affinityFile) Save() error {
+	f.Lock()
+	defer f.Unlock()
+
+	items := f.cache.LRUCacheGeneric.Items()
+	snapshot := affinitySnapshot{
+		Version: affinityVersion,
+		Saved:   time.Now().UTC(),
+		Entries: make([]affinityEntry, 0, len(items)),
+	}
+
+	for i := len(items) - 1; i >= 0; i-- {
+		url, ok := items[i].Value.(cacheUrl)
+		if !ok {
+			continue
+		}
+
+		e := affinityEntry{Key: items[i].Key, Url: string(url)}
+		if !items[i].Expires.IsZero() {
+			e.Expires = items[i].Expires.Unix()
+		}
+		snapshot.Entries = append(snapshot.Entries, e)
+	}
+
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	if err = writeFileAtomic(f.path, b); err != nil {
+		return err
+	}
+
+	// everything in the journal is in the snapshot now
+	return f.journal.Truncate(0)
+}
+
+// writeFileAtomic replaces a file with new contents by writing them to a
+// temporary file in the same directory, syncing it and renaming it
+func writeFileAtomic(path string, b []byte) (err error) {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(b); err == nil {
+		err = tmp.Sync()
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return
+	}
+
+	// make the rename itself durable
+	if d, dirErr := os.Open(dir); dirErr == nil {
+		d.Sync()
+		d.Close()
+	}
+	return
+}
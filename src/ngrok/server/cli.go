@@ -2,6 +2,7 @@ package server
 
 import (
 	"flag"
+	"time"
 )
 
 type Options struct {
@@ -13,6 +14,39 @@ type Options struct {
 	tlsKey     string
 	logto      string
 	loglevel   string
+
+	// HTML templates of the error pages
+	notFoundPage string
+	authPage     string
+
+	// where tcp and udp tunnels listen
+	tcpBindAddr string
+	tcpPorts    string
+	udpBindAddr string
+	udpPorts    string
+
+	// where the affinity cache is saved, and how long affinities last
+	affinityFile string
+	affinityTTL  time.Duration
+
+	// file of the addresses refused by the server
+	ipDenylist string
+
+	// load balancers whose PROXY protocol headers are trusted
+	proxyProtocolFrom string
+
+	// subdomains, hostnames and ports reserved for auth tokens
+	reservations string
+
+	// cluster mode
+	clusterRegistry string
+	clusterAddr     string
+	clusterPeerAddr string
+	clusterSecret   string
+	clusterTlsCrt   string
+	clusterTlsKey   string
+	clusterTlsCA    string
+	nodeId          string
 }
 
 func parseArgs() *Options {
@@ -24,6 +58,25 @@ func parseArgs() *Options {
 	tlsKey := flag.String("tlsKey", "", "Path to a TLS key file")
 	logto := flag.String("log", "stdout", "Write log messages to this file. 'stdout' and 'none' have special meanings")
 	loglevel := flag.String("log-level", "DEBUG", "The level of messages to log. One of: DEBUG, INFO, WARNING, ERROR")
+	notFoundPage := flag.String("notFoundPage", "", "Path to an HTML template shown for requests to unknown tunnels")
+	authPage := flag.String("authPage", "", "Path to an HTML template shown when a tunnel's http auth is required")
+	tcpBindAddr := flag.String("tcpBindAddr", "0.0.0.0", "IP address tcp tunnels listen on")
+	tcpPorts := flag.String("tcpPorts", "", "Range of ports for tcp tunnels, e.g. 10000-20000, empty string for any port")
+	udpBindAddr := flag.String("udpBindAddr", "0.0.0.0", "IP address udp tunnels listen on")
+	udpPorts := flag.String("udpPorts", "", "Range of ports for udp tunnels, e.g. 10000-20000, empty string for any port")
+	affinityFile := flag.String("affinityFile", "", "Path where the urls of clients are saved, so they get them back after a restart")
+	affinityTTL := flag.Duration("affinityTTL", 30*24*time.Hour, "How long clients can be away and still get their urls back, 0 to keep them until the cache is full")
+	ipDenylist := flag.String("ipDenylist", "", "Path to a file of IP addresses and CIDR networks refused by all listeners, reloaded when it changes")
+	proxyProtocolFrom := flag.String("proxyProtocolFrom", "", "Comma separated IPs or CIDR networks of load balancers which send PROXY protocol headers, empty string to trust none")
+	reservations := flag.String("reservations", "", "Path to the file of names reserved for auth tokens, managed with 'ngrokd reservations'")
+	clusterRegistry := flag.String("clusterRegistry", "", "URL of the registry shared by the nodes of a cluster, served by 'ngrokd cluster-registry', empty string to run on its own")
+	clusterAddr := flag.String("clusterAddr", "", "Address listening for connections forwarded by other nodes of the cluster")
+	clusterPeerAddr := flag.String("clusterPeerAddr", "", "Address other nodes use to reach this one, defaults to clusterAddr")
+	clusterSecret := flag.String("clusterSecret", "", "Secret shared by the nodes of the cluster and their registry, required in cluster mode")
+	clusterTlsCrt := flag.String("clusterTlsCrt", "", "Path to the TLS certificate of this node, encrypts the links between nodes")
+	clusterTlsKey := flag.String("clusterTlsKey", "", "Path to the TLS key of this node")
+	clusterTlsCA := flag.String("clusterTlsCA", "", "Path to the CA certificate which signed the certificates of the nodes and the registry, empty string to use the system's")
+	nodeId := flag.String("nodeId", "", "Name of this node in the cluster, defaults to the hostname")
 	flag.Parse()
 
 	return &Options{
@@ -35,5 +88,28 @@ func parseArgs() *Options {
 		tlsKey:     *tlsKey,
 		logto:      *logto,
 		loglevel:   *loglevel,
+
+		notFoundPage: *notFoundPage,
+		authPage:     *authPage,
+
+		tcpBindAddr:  *tcpBindAddr,
+		tcpPorts:     *tcpPorts,
+		udpBindAddr:  *udpBindAddr,
+		udpPorts:     *udpPorts,
+		affinityFile: *affinityFile,
+		affinityTTL:  *affinityTTL,
+		reservations: *reservations,
+
+		ipDenylist:        *ipDenylist,
+		proxyProtocolFrom: *proxyProtocolFrom,
+
+		clusterRegistry: *clusterRegistry,
+		clusterAddr:     *clusterAddr,
+		clusterPeerAddr: *clusterPeerAddr,
+		clusterSecret:   *clusterSecret,
+		clusterTlsCrt:   *clusterTlsCrt,
+		clusterTlsKey:   *clusterTlsKey,
+		clusterTlsCA:    *clusterTlsCA,
+		nodeId:          *nodeId,
 	}
 }
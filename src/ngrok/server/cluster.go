@@ -0,0 +1,452 @@
+package server
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/cluster"
+	"github.com/inconshreveable/ngrok/src/ngrok/conn"
+	"github.com/inconshreveable/ngrok/src/ngrok/log"
+	"github.com/inconshreveable/ngrok/src/ngrok/msg"
+)
+
+/**
+ * ClusterNode: This ngrokd's membership of a cluster. Nodes record the
+ *              tunnels and controls they own in the shared registry and
+ *              forward the public and proxy connections they can't serve
+ *              over inter-node links to the nodes which own them.
+ *
+ * A nil *ClusterNode is a node on its own, which owns everything.
+ */
+type ClusterNode struct {
+	log.Logger
+
+	node     cluster.Node
+	registry cluster.Registry
+
+	// links between nodes must present this
+	secret string
+
+	// encrypt the links between nodes, nil when they're plain TCP
+	serverTLS *tls.Config
+	clientTLS *tls.Config
+}
+
+func startClusterNode(opts *Options) *ClusterNode {
+	if opts.clusterAddr == "" {
+		panic("Cluster mode needs an address for the inter-node link, set -clusterAddr")
+	}
+
+	if opts.clusterSecret == "" {
+		panic("Cluster mode needs a secret shared by the nodes, set -clusterSecret")
+	}
+
+	if strings.HasPrefix(opts.clusterRegistry, "memory:") {
+		panic("The memory cluster registry is only shared within one process, run 'ngrokd cluster-registry' and set -clusterRegistry to its url")
+	}
+
+	serverTLS, clientTLS, err := loadClusterTLS(opts)
+	if err != nil {
+		panic(err)
+	}
+
+	registry, err := cluster.Open(opts.clusterRegistry, cluster.Config{Secret: opts.clusterSecret, TLSConfig: clientTLS})
+	if err != nil {
+		panic(err)
+	}
+
+	n := &ClusterNode{
+		Logger:    log.NewPrefixLogger("cluster"),
+		node:      cluster.Node{Id: opts.nodeId, Addr: opts.clusterPeerAddr},
+		registry:  registry,
+		secret:    opts.clusterSecret,
+		serverTLS: serverTLS,
+	}
+
+	// the registry may be served over https when the links aren't encrypted
+	if serverTLS != nil {
+		n.clientTLS = clientTLS
+	}
+
+	if n.node.Id == "" {
+		if n.node.Id, err = os.Hostname(); err != nil {
+			panic(err)
+		}
+	}
+
+	if n.node.Addr == "" {
+		n.node.Addr = opts.clusterAddr
+	}
+
+	listener, err := conn.Listen(opts.clusterAddr, "node", n.serverTLS)
+	if err != nil {
+		panic(err)
+	}
+
+	if err = registry.Join(n.node); err != nil {
+		panic(err)
+	}
+
+	n.Info("Joined cluster as node %s, listening for other nodes on %s", n.node.Id, listener.Addr.String())
+	go func() {
+		for c := range listener.Conns {
+			go n.handleLink(c)
+		}
+	}()
+
+	go n.renewLease()
+	return n
+}
+
+// renewLease keeps this node a member of the cluster, nodes which stop
+// renewing are removed along with everything they owned
+func (n *ClusterNode) renewLease() {
+	ticker := time.NewTicker(cluster.LeaseTTL / 3)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := n.registry.Renew(n.node.Id)
+		if err == cluster.ErrUnknownNode {
+			n.Warn("The lease of node %s expired, joining the cluster again", n.node.Id)
+			err = n.rejoin()
+		}
+
+		if err != nil {
+			n.Error("Failed to renew the lease of node %s: %v", n.node.Id, err)
+		}
+	}
+}
+
+// rejoin joins the cluster again and claims what this node serves, which
+// was released when its lease expired
+func (n *ClusterNode) rejoin() error {
+	if err := n.registry.Join(n.node); err != nil {
+		return err
+	}
+
+	for _, url := range tunnelRegistry.urls() {
+		if err := n.registry.ClaimTunnel(url, n.node.Id); err != nil {
+			n.Error("Failed to claim tunnel %s again: %v", url, err)
+		}
+	}
+
+	for _, clientId := range controlRegistry.ids() {
+		n.claimControl(clientId)
+	}
+	return nil
+}
+
+// leave gives up everything this node owns, when it shuts down
+func (n *ClusterNode) leave() {
+	if n == nil {
+		return
+	}
+
+	if err := n.registry.Leave(n.node.Id); err != nil {
+		n.Error("Failed to leave the cluster: %v", err)
+	} else {
+		n.Info("Left the cluster")
+	}
+}
+
+// claimTunnel records that this node owns a tunnel url
+func (n *ClusterNode) claimTunnel(url string) error {
+	if n == nil {
+		return nil
+	}
+	return n.registry.ClaimTunnel(url, n.node.Id)
+}
+
+func (n *ClusterNode) releaseTunnel(url string) {
+	if n == nil {
+		return
+	}
+
+	if err := n.registry.ReleaseTunnel(url, n.node.Id); err != nil {
+		n.Error("Failed to release tunnel %s: %v", url, err)
+	}
+}
+
+// claimControl records that this node owns a client's control connection
+func (n *ClusterNode) claimControl(clientId string) {
+	if n == nil {
+		return
+	}
+
+	if err := n.registry.ClaimControl(clientId, n.node.Id); err != nil {
+		n.Error("Failed to claim control %s: %v", clientId, err)
+	}
+}
+
+func (n *ClusterNode) releaseControl(clientId string) {
+	if n == nil {
+		return
+	}
+
+	if err := n.registry.ReleaseControl(clientId, n.node.Id); err != nil {
+		n.Error("Failed to release control %s: %v", clientId, err)
+	}
+}
+
+// dial opens an inter-node link to another node of the cluster
+func (n *ClusterNode) dial(nodeId string) (conn.Conn, error) {
+	peer, ok, err := n.registry.Node(nodeId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("Node %s isn't a member of the cluster", nodeId)
+	}
+
+	var tlsCfg *tls.Config
+	if n.clientTLS != nil {
+		tlsCfg = n.clientTLS.Clone()
+		if tlsCfg.ServerName, _, err = net.SplitHostPort(peer.Addr); err != nil {
+			return nil, err
+		}
+	}
+
+	link, err := conn.Dial(peer.Addr, "node", tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// forwardPublic hands a public connection for a tunnel owned by another
+// node to that node. It returns false if no other node owns the tunnel or
+// it can't be reached.
+func (n *ClusterNode) forwardPublic(publicConn conn.Conn, url string) bool {
+	if n == nil {
+		return false
+	}
+
+	owner, err := n.registry.TunnelOwner(url)
+	if err != nil {
+		publicConn.Error("Failed to look up the owner of %s: %v", url, err)
+		return false
+	}
+
+	if owner == "" || owner == n.node.Id {
+		return false
+	}
+
+	link, err := n.dial(owner)
+	if err != nil {
+		publicConn.Warn("Failed to reach node %s, which owns %s: %v", owner, url, err)
+		return false
+	}
+	defer link.Close()
+
+	forward := &msg.NodeForward{
+		Secret:     n.secret,
+		Url:        url,
+		ClientAddr: publicConn.RemoteAddr().String(),
+	}
+
+	if err = msg.WriteMsg(link, forward); err != nil {
+		publicConn.Warn("Failed to forward to node %s: %v", owner, err)
+		return false
+	}
+
+	publicConn.Info("Forwarding to node %s, which owns %s", owner, url)
+	publicConn.SetDeadline(time.Time{})
+	conn.Join(publicConn, link)
+	return true
+}
+
+// forwardProxy hands a proxy connection for a control connection owned by
+// another node to that node
+func (n *ClusterNode) forwardProxy(pxyConn conn.Conn, clientId string) error {
+	owner, err := n.registry.ControlOwner(clientId)
+	if err != nil {
+		return err
+	}
+
+	if owner == "" || owner == n.node.Id {
+		return fmt.Errorf("No client found for identifier: %s", clientId)
+	}
+
+	link, err := n.dial(owner)
+	if err != nil {
+		return err
+	}
+	defer link.Close()
+
+	if err = msg.WriteMsg(link, &msg.NodeProxy{Secret: n.secret, ClientId: clientId}); err != nil {
+		return err
+	}
+
+	pxyConn.Info("Forwarding to node %s, which owns control %s", owner, clientId)
+	conn.Join(pxyConn, link)
+	return nil
+}
+
+// handleLink serves a connection forwarded by another node
+func (n *ClusterNode) handleLink(link conn.Conn) {
+	defer func() {
+		if r := recover(); r != nil {
+			link.Info("handleLink failed with error %v: %s", r, debug.Stack())
+			link.Close()
+		}
+	}()
+
+	link.SetReadDeadline(time.Now().Add(connReadTimeout))
+	rawMsg, err := msg.ReadMsg(link)
+	if err != nil {
+		link.Warn("Failed to read message: %v", err)
+		link.Close()
+		return
+	}
+	link.SetReadDeadline(time.Time{})
+
+	switch m := rawMsg.(type) {
+	case *msg.NodeForward:
+		if !n.authorized(m.Secret) {
+			link.Warn("Refusing forwarded connection with the wrong cluster secret")
+			link.Close()
+			return
+		}
+
+		proto, _, _ := strings.Cut(m.Url, "://")
+		httpHandler(link, proto, m)
+
+	case *msg.NodeProxy:
+		if !n.authorized(m.Secret) {
+			link.Warn("Refusing forwarded proxy with the wrong cluster secret")
+			link.Close()
+			return
+		}
+
+		link.SetType("pxy")
+		ctl := controlRegistry.Get(m.ClientId)
+		if ctl == nil {
+			link.Warn("No client found for identifier: %s", m.ClientId)
+			link.Close()
+			return
+		}
+		ctl.RegisterProxy(link)
+
+	default:
+		link.Close()
+	}
+}
+
+func (n *ClusterNode) authorized(secret string) bool {
+	return n.secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(n.secret)) == 1
+}
+
+// loadClusterTLS returns the TLS configurations of a node accepting and
+// dialing links. With a certificate, the links are encrypted and nodes
+// present it to each other; with a CA, the certificates of the nodes and
+// the registry must be signed by it, otherwise the system's CAs are used.
+func loadClusterTLS(opts *Options) (serverTLS, clientTLS *tls.Config, err error) {
+	clientTLS = &tls.Config{MinVersion: tls.VersionTLS12}
+
+	var pool *x509.CertPool
+	if opts.clusterTlsCA != "" {
+		ca, err := os.ReadFile(opts.clusterTlsCA)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, nil, fmt.Errorf("No certificates found in %s", opts.clusterTlsCA)
+		}
+		clientTLS.RootCAs = pool
+	}
+
+	if (opts.clusterTlsCrt == "") != (opts.clusterTlsKey == "") {
+		return nil, nil, fmt.Errorf("Encrypted cluster links need both -clusterTlsCrt and -clusterTlsKey")
+	}
+
+	if opts.clusterTlsCrt == "" {
+		return nil, clientTLS, nil
+	}
+
+	if serverTLS, err = LoadTLSConfig(opts.clusterTlsCrt, opts.clusterTlsKey); err != nil {
+		return nil, nil, err
+	}
+	clientTLS.Certificates = serverTLS.Certificates
+
+	if pool != nil {
+		serverTLS.ClientCAs = pool
+		serverTLS.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return serverTLS, clientTLS, nil
+}
+
+const clusterRegistryUsage = `Usage: ngrokd cluster-registry -secret=SECRET [-addr=ADDR] [-tlsCrt=PATH -tlsKey=PATH]
+
+Serves the registry shared by the nodes of a cluster, which set
+-clusterRegistry to its url, e.g. https://registry.internal:4445. Its
+state is kept in memory, the nodes join again when it restarts.
+`
+
+// clusterRegistryCommand runs the registry of a cluster, e.g.
+// ngrokd cluster-registry -secret=SECRET -tlsCrt=registry.crt -tlsKey=registry.key
+func clusterRegistryCommand(args []string) int {
+	fs := flag.NewFlagSet("cluster-registry", flag.ExitOnError)
+	addr := fs.String("addr", ":4445", "Address listening for the nodes of the cluster")
+	secret := fs.String("secret", "", "Secret shared by the nodes of the cluster")
+	tlsCrt := fs.String("tlsCrt", "", "Path to a TLS certificate file, serves plain HTTP when not set")
+	tlsKey := fs.String("tlsKey", "", "Path to a TLS key file")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, clusterRegistryUsage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	fail := func(err error) int {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	handler, err := cluster.NewHandler(cluster.NewMemoryRegistry(), *secret)
+	if err != nil {
+		return fail(err)
+	}
+
+	if (*tlsCrt == "") != (*tlsKey == "") {
+		return fail(fmt.Errorf("Serving over TLS needs both -tlsCrt and -tlsKey"))
+	}
+
+	server := &http.Server{Addr: *addr, Handler: handler, ReadHeaderTimeout: connReadTimeout}
+	if *tlsCrt == "" {
+		fmt.Printf("Serving the cluster registry on http://%s\n", *addr)
+		return fail(server.ListenAndServe())
+	}
+
+	if server.TLSConfig, err = LoadTLSConfig(*tlsCrt, *tlsKey); err != nil {
+		return fail(err)
+	}
+	fmt.Printf("Serving the cluster registry on https://%s\n", *addr)
+	return fail(server.ListenAndServeTLS("", ""))
+}
+
+// forwardedConn is a public connection forwarded by another node, which
+// reports the address of the client rather than the node's
+type forwardedConn struct {
+	conn.Conn
+	clientAddr string
+}
+
+func (c *forwardedConn) RemoteAddr() net.Addr {
+	return clientAddr(c.clientAddr)
+}
+
+type clientAddr string
+
+func (a clientAddr) Network() string { return "tcp" }
+func (a clientAddr) String() string  { return string(a) }
@@ -9,6 +9,7 @@ import (
 	"io"
 	"runtime/debug"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,8 +36,10 @@ type Control struct {
 	// to us over conn by the client
 	in chan (msg.Message)
 
-	// the last time we received a ping from the client - for heartbeats
-	lastPing time.Time
+	// the last time we received a ping from the client - for heartbeats,
+	// in unix nanoseconds and accessed atomically because tunnel pools
+	// check it when picking a member
+	lastPing int64
 
 	// all of the tunnels this control connection handles
 	tunnels []*Tunnel
@@ -70,7 +73,7 @@ func NewControl(ctlConn conn.Conn, authMsg *msg.Auth) {
 		out:             make(chan msg.Message),
 		in:              make(chan msg.Message),
 		proxies:         make(chan conn.Conn, 10),
-		lastPing:        time.Now(),
+		lastPing:        time.Now().UnixNano(),
 		writerShutdown:  util.NewShutdown(),
 		readerShutdown:  util.NewShutdown(),
 		managerShutdown: util.NewShutdown(),
@@ -114,6 +117,8 @@ func NewControl(ctlConn conn.Conn, authMsg *msg.Auth) {
 		Version:   version.Proto,
 		MmVersion: version.MajorMinor(),
 		ClientId:  c.id,
+
+		HttpAuthHashes: true,
 	}
 
 	// As a performance optimization, ask for a proxy connection up front
@@ -178,7 +183,7 @@ func (c *Control) manager() {
 	for {
 		select {
 		case <-reap.C:
-			if time.Since(c.lastPing) > pingTimeoutInterval {
+			if time.Since(time.Unix(0, atomic.LoadInt64(&c.lastPing))) > pingTimeoutInterval {
 				c.conn.Info("Lost heartbeat")
 				c.shutdown.Begin()
 			}
@@ -194,7 +199,7 @@ func (c *Control) manager() {
 				c.registerTunnel(m)
 
 			case *msg.Ping:
-				c.lastPing = time.Now()
+				atomic.StoreInt64(&c.lastPing, time.Now().UnixNano())
 				c.out <- &msg.Pong{}
 			}
 		}
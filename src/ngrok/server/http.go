@@ -6,25 +6,16 @@ import (
 	vhost "github.com/inconshreveable/go-vhost"
 	//"net"
 	"github.com/inconshreveable/ngrok/src/ngrok/conn"
+	"github.com/inconshreveable/ngrok/src/ngrok/errpage"
+	"github.com/inconshreveable/ngrok/src/ngrok/httpauth"
+	"github.com/inconshreveable/ngrok/src/ngrok/ipfilter"
 	"github.com/inconshreveable/ngrok/src/ngrok/log"
+	"github.com/inconshreveable/ngrok/src/ngrok/msg"
 	"strings"
 	"time"
 )
 
 const (
-	NotAuthorized = `HTTP/1.0 401 Not Authorized
-WWW-Authenticate: Basic realm="ngrok"
-Content-Length: 23
-
-Authorization required
-`
-
-	NotFound = `HTTP/1.0 404 Not Found
-Content-Length: %d
-
-Tunnel %s not found
-`
-
 	BadRequest = `HTTP/1.0 400 Bad Request
 Content-Length: 12
 
@@ -32,11 +23,42 @@ Bad Request
 `
 )
 
+// the pages for requests to unknown tunnels and tunnels which require http
+// auth, they're plain text or JSON unless an HTML template is given
+var (
+	notFoundPage        = errpage.Must(errpage.New(404, ""))
+	notAuthorizedPage   = errpage.Must(errpage.New(401, ""))
+	forbiddenPage       = errpage.Must(errpage.New(403, ""))
+	tooManyAttemptsPage = errpage.Must(errpage.New(429, ""))
+)
+
+func init() {
+	notAuthorizedPage.Header.Set("WWW-Authenticate", `Basic realm="ngrok"`)
+}
+
+// loadErrorPages replaces the default error pages with the HTML templates
+// given on the command line
+func loadErrorPages(opts *Options) (err error) {
+	if opts.notFoundPage != "" {
+		if notFoundPage, err = errpage.Load(404, opts.notFoundPage); err != nil {
+			return
+		}
+	}
+
+	if opts.authPage != "" {
+		if notAuthorizedPage, err = errpage.Load(401, opts.authPage); err != nil {
+			return
+		}
+		notAuthorizedPage.Header.Set("WWW-Authenticate", `Basic realm="ngrok"`)
+	}
+	return
+}
+
 // Listens for new http(s) connections from the public internet
 func startHttpListener(addr string, tlsCfg *tls.Config) (listener *conn.Listener) {
 	// bind/listen for incoming connections
 	var err error
-	if listener, err = conn.Listen(addr, "pub", tlsCfg); err != nil {
+	if listener, err = conn.ListenProxied(addr, "pub", tlsCfg, trustedProxies); err != nil {
 		panic(err)
 	}
 
@@ -48,15 +70,16 @@ func startHttpListener(addr string, tlsCfg *tls.Config) (listener *conn.Listener
 	log.Info("Listening for public %s connections on %v", proto, listener.Addr.String())
 	go func() {
 		for conn := range listener.Conns {
-			go httpHandler(conn, proto)
+			go httpHandler(conn, proto, nil)
 		}
 	}()
 
 	return
 }
 
-// Handles a new http connection from the public internet
-func httpHandler(c conn.Conn, proto string) {
+// Handles a new http connection from the public internet, or one forwarded
+// by another node of the cluster
+func httpHandler(c conn.Conn, proto string, forwarded *msg.NodeForward) {
 	defer c.Close()
 	defer func() {
 		// recover from failures
@@ -65,6 +88,12 @@ func httpHandler(c conn.Conn, proto string) {
 		}
 	}()
 
+	// refuse clients on the deny list before reading anything from them
+	if forwarded == nil && denied(c.RemoteAddr()) {
+		c.Info("Refused connection from %v", c.RemoteAddr())
+		return
+	}
+
 	// Make sure we detect dead connections while we decide how to multiplex
 	c.SetDeadline(time.Now().Add(connReadTimeout))
 
@@ -79,31 +108,73 @@ func httpHandler(c conn.Conn, proto string) {
 	// read out the Host header and auth from the request
 	host := strings.ToLower(vhostConn.Host())
 	auth := vhostConn.Request.Header.Get("Authorization")
+	accept := vhostConn.Request.Header.Get("Accept")
 
 	// done reading mux data, free up the request memory
 	vhostConn.Free()
 
 	// We need to read from the vhost conn now since it mucked around reading the stream
 	c = conn.Wrap(vhostConn, "pub")
+	if forwarded != nil {
+		c = &forwardedConn{c, forwarded.ClientAddr}
+	}
 
 	// multiplex to find the right backend host
 	c.Debug("Found hostname %s in request", host)
-	tunnel := tunnelRegistry.Get(fmt.Sprintf("%s://%s", proto, host))
+	url := fmt.Sprintf("%s://%s", proto, host)
+	tunnel := tunnelRegistry.Get(url)
+
+	// another node of the cluster may own the tunnel, but connections
+	// forwarded by other nodes are never forwarded again
+	if tunnel == nil && forwarded == nil && clusterNode.forwardPublic(c, url) {
+		return
+	}
+
 	if tunnel == nil {
 		c.Info("No tunnel found for hostname %s", host)
-		c.Write([]byte(fmt.Sprintf(NotFound, len(host)+18, host)))
+		c.Write(notFoundPage.Response(accept, errpage.Data{
+			Message: fmt.Sprintf("Tunnel %s not found", host),
+			Host:    host,
+		}))
 		return
 	}
 
-	// If the client specified http auth and it doesn't match this request's auth
-	// then fail the request with 401 Not Authorized and request the client reissue the
-	// request with basic authdeny the request
-	if tunnel.req.HttpAuth != "" && auth != tunnel.req.HttpAuth {
-		c.Info("Authentication failed: %s", auth)
-		c.Write([]byte(NotAuthorized))
+	// the tunnel may only accept requests from some networks
+	if !tunnel.admits(c.RemoteAddr()) {
+		c.Info("Refused request from %v", c.RemoteAddr())
+		c.Write(forbiddenPage.Response(accept, errpage.Data{
+			Message: "Access denied",
+			Host:    host,
+		}))
 		return
 	}
 
+	// If the client specified http auth and this request doesn't match any of
+	// its credentials then fail the request with 401 Not Authorized and request
+	// the client reissue the request with basic auth
+	if tunnel.auth != nil {
+		switch user, result := tunnel.auth.Check(auth, ipfilter.IP(c.RemoteAddr()).String()); result {
+		case httpauth.Authorized:
+			c.Debug("Authenticated as %s", user)
+
+		case httpauth.Limited:
+			c.Warn("Too many failed authentication attempts")
+			c.Write(tooManyAttemptsPage.Response(accept, errpage.Data{
+				Message: "Too many failed authentication attempts, try again later",
+				Host:    host,
+			}))
+			return
+
+		default:
+			c.Info("Authentication failed")
+			c.Write(notAuthorizedPage.Response(accept, errpage.Data{
+				Message: "Authorization required",
+				Host:    host,
+			}))
+			return
+		}
+	}
+
 	// dead connections will now be handled by tunnel heartbeating and the client
 	c.SetDeadline(time.Time{})
 
@@ -3,14 +3,19 @@ package server
 import (
 	"crypto/tls"
 	"github.com/inconshreveable/ngrok/src/ngrok/conn"
+	"github.com/inconshreveable/ngrok/src/ngrok/ipfilter"
 	log "github.com/inconshreveable/ngrok/src/ngrok/log"
 	"github.com/inconshreveable/ngrok/src/ngrok/msg"
+	"github.com/inconshreveable/ngrok/src/ngrok/proxyproto"
 	"github.com/inconshreveable/ngrok/src/ngrok/ratelimit"
+	"github.com/inconshreveable/ngrok/src/ngrok/reservations"
 	"github.com/inconshreveable/ngrok/src/ngrok/util"
 	"math/rand"
 	"net"
 	"os"
+	"os/signal"
 	"runtime/debug"
+	"syscall"
 	"time"
 )
 
@@ -24,6 +29,22 @@ var (
 	tunnelRegistry  *TunnelRegistry
 	controlRegistry *ControlRegistry
 
+	// the cluster this node belongs to, nil when it runs on its own
+	clusterNode *ClusterNode
+
+	// names reserved for auth tokens, nil when there are no reservations
+	reservationStore *reservations.Store
+
+	// binds the listeners of tcp and udp tunnels
+	tcpPorts *portAllocator
+	udpPorts *portAllocator
+
+	// addresses refused by every listener, nil when there's no deny list
+	ipDenylist *ipfilter.File
+
+	// networks of the load balancers which send PROXY headers
+	trustedProxies proxyproto.Trusted
+
 	// XXX: kill these global variables - they're only used in tunnel.go for constructing forwarding URLs
 	opts      *Options
 	listeners map[string]*conn.Listener
@@ -50,6 +71,13 @@ func NewProxy(pxyConn conn.Conn, regPxy *msg.RegProxy) {
 	ctl := controlRegistry.Get(regPxy.ClientId)
 
 	if ctl == nil {
+		// the control may be connected to another node of the cluster
+		if clusterNode != nil {
+			if err := clusterNode.forwardProxy(pxyConn, regPxy.ClientId); err != nil {
+				panic(err)
+			}
+			return
+		}
 		panic("No client found for identifier: " + regPxy.ClientId)
 	}
 
@@ -63,7 +91,7 @@ func NewProxy(pxyConn conn.Conn, regPxy *msg.RegProxy) {
 // restrictive firewalls.
 func tunnelListener(addr string, tlsConfig *tls.Config) {
 	// listen for incoming connections
-	listener, err := conn.Listen(addr, "tun", tlsConfig)
+	listener, err := conn.ListenProxied(addr, "tun", tlsConfig, trustedProxies)
 	if err != nil {
 		panic(err)
 	}
@@ -74,6 +102,12 @@ func tunnelListener(addr string, tlsConfig *tls.Config) {
 		remoteAddr := c.RemoteAddr().String()
 		ip, _, _ := net.SplitHostPort(remoteAddr)
 
+		if denied(c.RemoteAddr()) {
+			c.Info("Refused connection from %s", ip)
+			c.Close()
+			continue
+		}
+
 		// Apply rate limiting
 		if ipRateLimiter != nil && !ipRateLimiter.AllowIP(ip) {
 			c.Warn("Rate limit exceeded for IP: %s", ip)
@@ -126,6 +160,15 @@ func tunnelListener(addr string, tlsConfig *tls.Config) {
 }
 
 func Main() {
+	// admin commands
+	if len(os.Args) > 1 && os.Args[1] == "reservations" {
+		os.Exit(reservationsCommand(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "cluster-registry" {
+		os.Exit(clusterRegistryCommand(os.Args[2:]))
+	}
+
 	// parse options
 	opts = parseArgs()
 
@@ -140,10 +183,58 @@ func Main() {
 	rand.Seed(seed)
 
 	// init tunnel/control registry
-	registryCacheFile := os.Getenv("REGISTRY_CACHE_FILE")
-	tunnelRegistry = NewTunnelRegistry(registryCacheSize, registryCacheFile)
+	affinityFile := opts.affinityFile
+	if env := os.Getenv("REGISTRY_CACHE_FILE"); env != "" && affinityFile == "" {
+		log.Warn("REGISTRY_CACHE_FILE is deprecated, use -affinityFile instead")
+		affinityFile = env
+	}
+	tunnelRegistry = NewTunnelRegistry(registryCacheSize, affinityFile, opts.affinityTTL)
+
+	// save the affinity cache and leave the cluster before exiting
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		sig := <-signals
+		log.Info("Received %v, shutting down", sig)
+		tunnelRegistry.SaveCache()
+		clusterNode.leave()
+		os.Exit(0)
+	}()
 	controlRegistry = NewControlRegistry()
 
+	// load the reserved names
+	if opts.reservations != "" {
+		if reservationStore, err = reservations.Open(opts.reservations); err != nil {
+			panic(err)
+		}
+	}
+
+	// allocate ports for tcp and udp tunnels
+	if tcpPorts, err = newPortAllocator("tcp", opts.tcpBindAddr, opts.tcpPorts); err != nil {
+		panic(err)
+	}
+
+	if udpPorts, err = newPortAllocator("udp", opts.udpBindAddr, opts.udpPorts); err != nil {
+		panic(err)
+	}
+
+	// trust the PROXY headers of the load balancers in front of us
+	if trustedProxies, err = proxyproto.ParseTrusted(opts.proxyProtocolFrom); err != nil {
+		panic(err)
+	}
+
+	// refuse the addresses on the deny list
+	if opts.ipDenylist != "" {
+		if ipDenylist, err = ipfilter.Open(opts.ipDenylist); err != nil {
+			panic(err)
+		}
+	}
+
+	// join a cluster of ngrokd nodes
+	if opts.clusterRegistry != "" {
+		clusterNode = startClusterNode(opts)
+	}
+
 	// initialize rate limiters
 	// 10 connections per second per IP, burst of 20
 	ipRateLimiter = ratelimit.NewIPRateLimiter(10, 20)
@@ -153,6 +244,11 @@ func Main() {
 	// start listeners
 	listeners = make(map[string]*conn.Listener)
 
+	// load custom error pages
+	if err = loadErrorPages(opts); err != nil {
+		panic(err)
+	}
+
 	// load tls configuration
 	tlsConfig, err := LoadTLSConfig(opts.tlsCrt, opts.tlsKey)
 	if err != nil {
@@ -282,7 +282,7 @@ func (k *KeenIoMetrics) CloseConnection(t *Tunnel, c conn.Conn, start time.Time,
 		Url:                t.url,
 		User:               t.ctl.auth.User,
 		Version:            t.ctl.auth.MmVersion,
-		HttpAuth:           t.req.HttpAuth != "",
+		HttpAuth:           t.auth != nil,
 		Subdomain:          t.req.Subdomain != "",
 		TunnelDuration:     time.Since(t.start).Seconds(),
 		ConnectionDuration: time.Since(start).Seconds(),
@@ -325,7 +325,7 @@ func (k *KeenIoMetrics) CloseTunnel(t *Tunnel) {
 		Version:  t.ctl.auth.MmVersion,
 		//Reason: reason,
 		Duration:  time.Since(t.start).Seconds(),
-		HttpAuth:  t.req.HttpAuth != "",
+		HttpAuth:  t.auth != nil,
 		Subdomain: t.req.Subdomain != "",
 	}
 
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"fmt"
+	"github.com/inconshreveable/ngrok/src/ngrok/httpauth"
+	"github.com/inconshreveable/ngrok/src/ngrok/ipfilter"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// spread public connections over the members in turn
+	poolRoundRobin = "round_robin"
+
+	// send public connections to the member with the fewest open ones
+	poolLeastConns = "least_conns"
+)
+
+/**
+ * TunnelPool: Tunnels of several control connections which serve the same
+ *             url. Controls join a pool by requesting the same url with the
+ *             same auth token and pool name, which lets a service behind a
+ *             tunnel be redeployed without downtime. Every member has the
+ *             http auth and IP filters of the first.
+ */
+type TunnelPool struct {
+	// the auth token and pool name every member presented
+	token string
+	name  string
+
+	policy string
+
+	// the edge settings of the first member, which every member uses
+	auth   *httpauth.Verifier
+	filter *ipfilter.Filter
+
+	sync.Mutex
+	members []*Tunnel
+
+	// the next member for round robin
+	next int
+}
+
+func newTunnelPool(t *Tunnel) (*TunnelPool, error) {
+	// without a token, knowing the pool name would be enough to join
+	if t.ctl.auth.User == "" {
+		return nil, fmt.Errorf("Pooled tunnels need an auth token")
+	}
+
+	policy := t.req.PoolPolicy
+	if policy == "" {
+		policy = poolRoundRobin
+	}
+
+	if policy != poolRoundRobin && policy != poolLeastConns {
+		return nil, fmt.Errorf("Unknown pool policy '%s', use %s or %s", policy, poolRoundRobin, poolLeastConns)
+	}
+
+	return &TunnelPool{
+		token:   t.ctl.auth.User,
+		name:    t.req.Pool,
+		policy:  policy,
+		auth:    t.auth,
+		filter:  t.filter,
+		members: []*Tunnel{t},
+	}, nil
+}
+
+// Join adds a tunnel to the pool if it presented the same token, pool name
+// and edge settings
+func (p *TunnelPool) Join(t *Tunnel) error {
+	if p.token == "" || t.ctl.auth.User != p.token || t.req.Pool != p.name {
+		return fmt.Errorf("The tunnel %s is already registered.", t.url)
+	}
+
+	if t.req.PoolPolicy != "" && t.req.PoolPolicy != p.policy {
+		return fmt.Errorf("The pool %s of tunnel %s uses the %s policy, not %s", p.name, t.url, p.policy, t.req.PoolPolicy)
+	}
+
+	// the passwords are hashed with a salt, so only the users can be
+	// compared. The pool's credentials are the ones which are checked.
+	if !reflect.DeepEqual(t.auth.Users(), p.auth.Users()) {
+		return fmt.Errorf("The pool %s of tunnel %s has http auth users %v, not %v", p.name, t.url, p.auth.Users(), t.auth.Users())
+	}
+
+	if !t.filter.Equal(p.filter) {
+		return fmt.Errorf("The pool %s of tunnel %s allows and denies other IP addresses", p.name, t.url)
+	}
+	t.auth, t.filter = p.auth, p.filter
+
+	p.Lock()
+	defer p.Unlock()
+	p.members = append(p.members, t)
+	return nil
+}
+
+// Leave removes a tunnel from the pool and returns how many members are left
+func (p *TunnelPool) Leave(t *Tunnel) int {
+	p.Lock()
+	defer p.Unlock()
+
+	for i, m := range p.members {
+		if m == t {
+			p.members = append(p.members[:i], p.members[i+1:]...)
+			break
+		}
+	}
+	return len(p.members)
+}
+
+// Pick chooses the member to handle a public connection, skipping those
+// which are shutting down or whose control has missed its heartbeat.
+// Returns nil if no member is alive.
+func (p *TunnelPool) Pick() *Tunnel {
+	p.Lock()
+	defer p.Unlock()
+
+	var alive []*Tunnel
+	for _, t := range p.members {
+		if t.alive() {
+			alive = append(alive, t)
+		}
+	}
+
+	if len(alive) == 0 {
+		return nil
+	}
+
+	switch p.policy {
+	case poolLeastConns:
+		best := alive[0]
+		for _, t := range alive[1:] {
+			if atomic.LoadInt64(&t.conns) < atomic.LoadInt64(&best.conns) {
+				best = t
+			}
+		}
+		return best
+
+	default:
+		p.next = (p.next + 1) % len(alive)
+		return alive[p.next]
+	}
+}
+
+// a tunnel can take public connections while neither it nor its control
+// connection are shutting down and the control is still heartbeating
+func (t *Tunnel) alive() bool {
+	if atomic.LoadInt32(&t.closing) == 1 || t.ctl.shutdown.Begun() {
+		return false
+	}
+
+	lastPing := time.Unix(0, atomic.LoadInt64(&t.ctl.lastPing))
+	return time.Since(lastPing) <= pingTimeoutInterval
+}
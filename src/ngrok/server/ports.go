@@ -0,0 +1,255 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/reservations"
+)
+
+const (
+	// how many times to let the OS pick a port when it keeps picking
+	// reserved ones
+	maxEphemeralAttempts = 5
+
+	// how many free ports of the range to try binding when other
+	// programs hold them
+	maxBindAttempts = 16
+)
+
+/**
+ * portAllocator: Binds the public listeners of TCP or UDP tunnels. Ports
+ *                come from the configured range, or from the OS when there
+ *                is none, and are tracked until the tunnel is shut down.
+ *                Ports reserved for other auth tokens are never handed out.
+ */
+type portAllocator struct {
+	// tcp or udp
+	network string
+
+	ip net.IP
+
+	// the allowed range, 0 and 0 for any port
+	min, max int
+
+	sync.Mutex
+	used map[int]bool
+
+	// the ports of the range which aren't used, and where each is in free
+	free      []int
+	freeIndex map[int]int
+}
+
+// newPortAllocator binds on bindAddr, an IP address, and allocates ports
+// from portRange, e.g. 10000-20000, or any port when it's empty
+func newPortAllocator(network, bindAddr, portRange string) (*portAllocator, error) {
+	a := &portAllocator{network: network, ip: net.IPv4zero, used: make(map[int]bool)}
+
+	if bindAddr != "" {
+		if a.ip = net.ParseIP(bindAddr); a.ip == nil {
+			return nil, fmt.Errorf("Invalid %s bind address '%s'", a.name(), bindAddr)
+		}
+	}
+
+	if portRange != "" {
+		lo, hi, ok := strings.Cut(portRange, "-")
+		if !ok {
+			hi = lo
+		}
+
+		var err1, err2 error
+		a.min, err1 = strconv.Atoi(strings.TrimSpace(lo))
+		a.max, err2 = strconv.Atoi(strings.TrimSpace(hi))
+		if err1 != nil || err2 != nil || a.min < 1 || a.max > 65535 || a.min > a.max {
+			return nil, fmt.Errorf("Invalid %s port range '%s', use e.g. 10000-20000", a.name(), portRange)
+		}
+
+		a.free = make([]int, 0, a.max-a.min+1)
+		a.freeIndex = make(map[int]int, a.max-a.min+1)
+		for port := a.min; port <= a.max; port++ {
+			a.freeIndex[port] = len(a.free)
+			a.free = append(a.free, port)
+		}
+	}
+	return a, nil
+}
+
+func (a *portAllocator) name() string {
+	return strings.ToUpper(a.network)
+}
+
+// the kind of reservation for the allocator's ports
+func (a *portAllocator) kind() string {
+	if a.network == "udp" {
+		return reservations.UdpPort
+	}
+	return reservations.TcpPort
+}
+
+func (a *portAllocator) inRange(port int) bool {
+	return a.min == 0 || (port >= a.min && port <= a.max)
+}
+
+// ListenTCP binds a port for the auth token, any free one if port is 0
+func (a *portAllocator) ListenTCP(port int, token string) (*net.TCPListener, error) {
+	l, err := a.allocate(port, token)
+	if err != nil {
+		return nil, err
+	}
+	return l.(*net.TCPListener), nil
+}
+
+// ListenUDP binds a port for the auth token, any free one if port is 0
+func (a *portAllocator) ListenUDP(port int, token string) (*net.UDPConn, error) {
+	c, err := a.allocate(port, token)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
+
+func (a *portAllocator) allocate(port int, token string) (io.Closer, error) {
+	if port != 0 {
+		return a.listenOn(port, token)
+	}
+
+	if a.min == 0 {
+		return a.listenEphemeral(token)
+	}
+
+	// the reservations are read once, and only the ports the allocator
+	// doesn't use are tried
+	reserved, err := reservationStore.Reserved(a.kind(), token)
+	if err != nil {
+		return nil, err
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	// start at a random free port so that tunnels don't all get the
+	// ports at the bottom of the range
+	size := len(a.free)
+	start, attempts := 0, 0
+	if size > 0 {
+		start = rand.Intn(size)
+	}
+
+	for i := 0; i < size && attempts < maxBindAttempts; i++ {
+		p := a.free[(start+i)%size]
+		if reserved[strconv.Itoa(p)] {
+			continue
+		}
+
+		// another program may hold the port
+		attempts++
+		if c, _, err := a.bind(p); err == nil {
+			a.take(p)
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("No free ports in the range %d-%d", a.min, a.max)
+}
+
+// take marks a port as used, must hold the lock
+func (a *portAllocator) take(port int) {
+	a.used[port] = true
+
+	// swap the port with the last free one
+	if i, ok := a.freeIndex[port]; ok {
+		last := a.free[len(a.free)-1]
+		a.free[i], a.freeIndex[last] = last, i
+		a.free = a.free[:len(a.free)-1]
+		delete(a.freeIndex, port)
+	}
+}
+
+// bind listens on a port, 0 to let the OS pick one, and returns the port
+func (a *portAllocator) bind(port int) (io.Closer, int, error) {
+	if a.network == "udp" {
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: a.ip, Port: port})
+		if err != nil {
+			return nil, 0, err
+		}
+		return c, c.LocalAddr().(*net.UDPAddr).Port, nil
+	}
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: a.ip, Port: port})
+	if err != nil {
+		return nil, 0, err
+	}
+	return l, l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// listenOn binds a specific port
+func (a *portAllocator) listenOn(port int, token string) (io.Closer, error) {
+	if port < 1 || port > 65535 {
+		return nil, fmt.Errorf("Invalid port %d", port)
+	}
+
+	if !a.inRange(port) {
+		return nil, fmt.Errorf("Port %d is outside the allowed range %d-%d", port, a.min, a.max)
+	}
+
+	if err := reservationStore.Check(a.kind(), strconv.Itoa(port), token); err != nil {
+		return nil, err
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	if a.used[port] {
+		return nil, fmt.Errorf("Port %d is already in use", port)
+	}
+
+	c, _, err := a.bind(port)
+	if err != nil {
+		return nil, fmt.Errorf("Port %d is unavailable: %v", port, err)
+	}
+
+	a.take(port)
+	return c, nil
+}
+
+// listenEphemeral lets the OS pick a port
+func (a *portAllocator) listenEphemeral(token string) (io.Closer, error) {
+	for i := 0; i < maxEphemeralAttempts; i++ {
+		c, port, err := a.bind(0)
+		if err != nil {
+			return nil, fmt.Errorf("Error binding %s listener: %v", a.name(), err)
+		}
+
+		if reservationStore.Check(a.kind(), strconv.Itoa(port), token) != nil {
+			// the OS picked a port which is reserved for someone else
+			c.Close()
+			continue
+		}
+
+		a.Lock()
+		a.take(port)
+		a.Unlock()
+		return c, nil
+	}
+	return nil, fmt.Errorf("Failed to bind a port which isn't reserved after %d attempts", maxEphemeralAttempts)
+}
+
+// Release frees a port once its tunnel's listener is closed
+func (a *portAllocator) Release(port int) {
+	a.Lock()
+	defer a.Unlock()
+
+	if !a.used[port] {
+		return
+	}
+	delete(a.used, port)
+
+	if a.min != 0 && a.inRange(port) {
+		a.freeIndex[port] = len(a.free)
+		a.free = append(a.free, port)
+	}
+}
@@ -11,7 +11,8 @@ import (
 )
 
 const (
-	cacheSaveInterval time.Duration = 10 * time.Minute
+	cacheSaveInterval  time.Duration = 10 * time.Minute
+	cacheSweepInterval time.Duration = time.Minute
 )
 
 type cacheUrl string
@@ -20,36 +21,51 @@ func (url cacheUrl) Size() int {
 	return len(url)
 }
 
-// TunnelRegistry maps a tunnel URL to Tunnel structures
+// TunnelRegistry maps a tunnel URL to Tunnel structures, or to the
+// TunnelPool of the tunnels sharing it
 type TunnelRegistry struct {
 	tunnels  map[string]*Tunnel
+	pools    map[string]*TunnelPool
 	affinity *cache.LRUCache
 	log.Logger
+
+	// persists the affinity cache, nil if it's only kept in memory
+	affinityFile *affinityFile
+
 	sync.RWMutex
 }
 
-func NewTunnelRegistry(cacheSize uint64, cacheFile string) *TunnelRegistry {
+func NewTunnelRegistry(cacheSize uint64, cacheFile string, cacheTTL time.Duration) *TunnelRegistry {
 	registry := &TunnelRegistry{
 		tunnels:  make(map[string]*Tunnel),
+		pools:    make(map[string]*TunnelPool),
 		affinity: cache.NewLRUCache(cacheSize),
 		Logger:   log.NewPrefixLogger("registry", "tun"),
 	}
 
-	// LRUCache uses Gob encoding. Unfortunately, Gob is fickle and will fail
-	// to encode or decode any non-primitive types that haven't been "registered"
-	// with it. Since we store cacheUrl objects, we need to register them here first
-	// for the encoding/decoding to work
+	// affinities of clients which don't come back age out
+	registry.affinity.SetTTL(cacheTTL)
+	registry.affinity.OnEvict(func(key string, url cache.Value, reason cache.EvictReason) {
+		registry.Debug("Evicted affinity %s for %s (%v)", url, key, reason)
+	})
+	if cacheTTL > 0 {
+		registry.affinity.StartSweeper(cacheSweepInterval)
+	}
+
+	// Affinity files written by older versions were Gob encoded. Gob is fickle
+	// and will fail to decode any non-primitive types that haven't been
+	// "registered" with it, so we need to register cacheUrl to migrate them.
 	var urlobj cacheUrl
 	gob.Register(urlobj)
 
 	// try to load and then periodically save the affinity cache to file, if specified
 	if cacheFile != "" {
-		err := registry.affinity.LoadItemsFromFile(cacheFile)
-		if err != nil {
+		var err error
+		if registry.affinityFile, err = openAffinityFile(cacheFile, registry.affinity, cacheTTL); err != nil {
 			registry.Error("Failed to load affinity cache %s: %v", cacheFile, err)
+		} else {
+			registry.SaveCacheThread(cacheSaveInterval)
 		}
-
-		registry.SaveCacheThread(cacheFile, cacheSaveInterval)
 	} else {
 		registry.Info("No affinity cache specified")
 	}
@@ -57,38 +73,89 @@ func NewTunnelRegistry(cacheSize uint64, cacheFile string) *TunnelRegistry {
 	return registry
 }
 
-// Spawns a goroutine the periodically saves the cache to a file.
-func (r *TunnelRegistry) SaveCacheThread(path string, interval time.Duration) {
+// Spawns a goroutine the periodically saves a snapshot of the cache
+func (r *TunnelRegistry) SaveCacheThread(interval time.Duration) {
 	go func() {
-		r.Info("Saving affinity cache to %s every %s", path, interval.String())
+		r.Info("Saving affinity cache to %s every %s", r.affinityFile.path, interval.String())
 		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 
 		for range ticker.C {
-			r.Debug("Saving affinity cache")
-			err := r.affinity.SaveItemsToFile(path)
-			if err != nil {
-				r.Error("Failed to save affinity cache: %v", err)
-			} else {
-				r.Info("Saved affinity cache")
-			}
+			r.SaveCache()
 		}
 	}()
 }
 
+// SaveCache writes a snapshot of the affinity cache, if it's persisted
+func (r *TunnelRegistry) SaveCache() {
+	if r.affinityFile == nil {
+		return
+	}
+
+	r.Debug("Saving affinity cache")
+	if err := r.affinityFile.Save(); err != nil {
+		r.Error("Failed to save affinity cache: %v", err)
+	} else {
+		r.Info("Saved affinity cache")
+	}
+}
+
 // Register a tunnel with a specific url, returns an error
-// if a tunnel is already registered at that url
+// if a tunnel is already registered at that url. Tunnels which ask
+// for a pool share the url with the other members of their pool.
 func (r *TunnelRegistry) Register(url string, t *Tunnel) error {
+	var pool *TunnelPool
+	if t.req.Pool != "" {
+		var err error
+		if pool, err = newTunnelPool(t); err != nil {
+			return err
+		}
+	}
+
+	if registered, err := r.insert(url, t, pool, false); registered || err != nil {
+		return err
+	}
+
+	// another node of the cluster may own the url. The registry is a
+	// round trip away, so it's asked without holding the lock, and the
+	// url is checked again once it's claimed.
+	if err := clusterNode.claimTunnel(url); err != nil {
+		return err
+	}
+
+	_, err := r.insert(url, t, pool, true)
+	return err
+}
+
+// insert registers a tunnel at a free url, or joins it to the pool there.
+// It returns false when the url is free but the cluster must be asked
+// first. When the url was taken while it was claimed, the claim is kept
+// for the tunnel or pool which took it.
+func (r *TunnelRegistry) insert(url string, t *Tunnel, pool *TunnelPool, claimed bool) (registered bool, err error) {
 	r.Lock()
 	defer r.Unlock()
 
 	if r.tunnels[url] != nil {
-		return fmt.Errorf("The tunnel %s is already registered.", url)
+		return false, fmt.Errorf("The tunnel %s is already registered.", url)
+	}
+
+	if existing := r.pools[url]; existing != nil {
+		if t.req.Pool == "" {
+			return false, fmt.Errorf("The tunnel %s is already registered.", url)
+		}
+		return true, existing.Join(t)
 	}
 
-	r.tunnels[url] = t
+	if clusterNode != nil && !claimed {
+		return false, nil
+	}
 
-	return nil
+	if pool != nil {
+		r.pools[url] = pool
+	} else {
+		r.tunnels[url] = t
+	}
+	return true, nil
 }
 
 func (r *TunnelRegistry) cacheKeys(t *Tunnel) (ip string, id string) {
@@ -121,6 +188,10 @@ func (r *TunnelRegistry) RegisterAndCache(url string, t *Tunnel) (err error) {
 		ipCacheKey, idCacheKey := r.cacheKeys(t)
 		r.affinity.Set(ipCacheKey, cacheUrl(url))
 		r.affinity.Set(idCacheKey, cacheUrl(url))
+
+		if r.affinityFile != nil {
+			r.affinityFile.Append(url, ipCacheKey, idCacheKey)
+		}
 	}
 	return
 
@@ -129,7 +200,8 @@ func (r *TunnelRegistry) RegisterAndCache(url string, t *Tunnel) (err error) {
 // Register a tunnel with the following process:
 // Consult the affinity cache to try to assign a previously used tunnel url if possible
 // Generate new urls repeatedly with the urlFn and register until one is available.
-func (r *TunnelRegistry) RegisterRepeat(urlFn func() string, t *Tunnel) (string, error) {
+// Urls which check rejects, e.g. because they're reserved, are skipped.
+func (r *TunnelRegistry) RegisterRepeat(urlFn func() string, check func(url string) error, t *Tunnel) (string, error) {
 	url := r.GetCachedRegistration(t)
 	if url == "" {
 		url = urlFn()
@@ -137,7 +209,9 @@ func (r *TunnelRegistry) RegisterRepeat(urlFn func() string, t *Tunnel) (string,
 
 	maxAttempts := 5
 	for i := 0; i < maxAttempts; i++ {
-		if err := r.RegisterAndCache(url, t); err != nil {
+		if err := check(url); err != nil {
+			url = urlFn()
+		} else if err := r.RegisterAndCache(url, t); err != nil {
 			// pick a new url and try again
 			url = urlFn()
 		} else {
@@ -149,18 +223,53 @@ func (r *TunnelRegistry) RegisterRepeat(urlFn func() string, t *Tunnel) (string,
 	return "", fmt.Errorf("Failed to assign a URL after %d attempts!", maxAttempts)
 }
 
-func (r *TunnelRegistry) Del(url string) {
+// Del removes a tunnel from its url, the url is freed once the last
+// member of a pool is removed
+func (r *TunnelRegistry) Del(url string, t *Tunnel) {
 	r.Lock()
 	defer r.Unlock()
-	delete(r.tunnels, url)
+
+	if pool := r.pools[url]; pool != nil {
+		if pool.Leave(t) == 0 {
+			delete(r.pools, url)
+			clusterNode.releaseTunnel(url)
+		}
+		return
+	}
+
+	if r.tunnels[url] == t {
+		delete(r.tunnels, url)
+		clusterNode.releaseTunnel(url)
+	}
 }
 
+// Get returns the tunnel registered at a url, or the member of its pool
+// which should handle the next connection
 func (r *TunnelRegistry) Get(url string) *Tunnel {
 	r.RLock()
 	defer r.RUnlock()
+
+	if pool := r.pools[url]; pool != nil {
+		return pool.Pick()
+	}
 	return r.tunnels[url]
 }
 
+// urls returns the urls of the registered tunnels and pools
+func (r *TunnelRegistry) urls() []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	urls := make([]string, 0, len(r.tunnels)+len(r.pools))
+	for url := range r.tunnels {
+		urls = append(urls, url)
+	}
+	for url := range r.pools {
+		urls = append(urls, url)
+	}
+	return urls
+}
+
 // ControlRegistry maps a client ID to Control structures
 type ControlRegistry struct {
 	controls map[string]*Control
@@ -181,6 +290,18 @@ func (r *ControlRegistry) Get(clientId string) *Control {
 	return r.controls[clientId]
 }
 
+// ids returns the client ids of the registered controls
+func (r *ControlRegistry) ids() []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	ids := make([]string, 0, len(r.controls))
+	for clientId := range r.controls {
+		ids = append(ids, clientId)
+	}
+	return ids
+}
+
 func (r *ControlRegistry) Add(clientId string, ctl *Control) (oldCtl *Control) {
 	r.Lock()
 	defer r.Unlock()
@@ -191,6 +312,7 @@ func (r *ControlRegistry) Add(clientId string, ctl *Control) (oldCtl *Control) {
 	}
 
 	r.controls[clientId] = ctl
+	clusterNode.claimControl(clientId)
 	r.Info("Registered control with id %s", clientId)
 	return
 }
@@ -203,6 +325,7 @@ func (r *ControlRegistry) Del(clientId string) error {
 	} else {
 		r.Info("Removed control registry id %s", clientId)
 		delete(r.controls, clientId)
+		clusterNode.releaseControl(clientId)
 		return nil
 	}
 }
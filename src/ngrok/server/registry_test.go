@@ -0,0 +1,183 @@
+package server
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/cluster"
+	"github.com/inconshreveable/ngrok/src/ngrok/httpauth"
+	"github.com/inconshreveable/ngrok/src/ngrok/ipfilter"
+	"github.com/inconshreveable/ngrok/src/ngrok/log"
+	"github.com/inconshreveable/ngrok/src/ngrok/msg"
+	"github.com/inconshreveable/ngrok/src/ngrok/reservations"
+)
+
+func TestRegisterCluster(t *testing.T) {
+	shared := cluster.NewMemoryRegistry()
+	node := func(id string) *ClusterNode {
+		n := &ClusterNode{Logger: log.NewPrefixLogger("cluster"), node: cluster.Node{Id: id}, registry: shared}
+		if err := shared.Join(n.node); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	defer func(saved *ClusterNode) { clusterNode = saved }(clusterNode)
+	a, b := node("a"), node("b")
+	onA, onB := NewTunnelRegistry(16, "", 0), NewTunnelRegistry(16, "", 0)
+
+	const url = "https://demo.example.com"
+	tunnel := func() *Tunnel { return &Tunnel{req: &msg.ReqTunnel{}} }
+	first := tunnel()
+
+	steps := []struct {
+		name      string
+		node      *ClusterNode
+		op        func() error
+		wantErr   bool
+		wantOwner string
+	}{
+		{"claim", a, func() error { return onA.Register(url, first) }, false, "a"},
+		{"taken on the same node", a, func() error { return onA.Register(url, tunnel()) }, true, "a"},
+		{"taken on another node", b, func() error { return onB.Register(url, tunnel()) }, true, "a"},
+		{"release", a, func() error { onA.Del(url, first); return nil }, false, ""},
+		{"claim after the release", b, func() error { return onB.Register(url, tunnel()) }, false, "b"},
+	}
+
+	for _, step := range steps {
+		clusterNode = step.node
+		if err := step.op(); (err != nil) != step.wantErr {
+			t.Errorf("%s: error %v, want error %v", step.name, err, step.wantErr)
+		}
+
+		if owner, _ := shared.TunnelOwner(url); owner != step.wantOwner {
+			t.Errorf("%s: owner %q, want %q", step.name, owner, step.wantOwner)
+		}
+	}
+
+	// a node which fails to claim doesn't serve the url
+	if onB.Get(url) == nil || onA.Get(url) != nil {
+		t.Errorf("the url is served by the wrong node")
+	}
+}
+
+func TestRegisterPool(t *testing.T) {
+	member := func(token, user string, deny ...string) *Tunnel {
+		t.Helper()
+		tun := &Tunnel{
+			req: &msg.ReqTunnel{Pool: "web"},
+			ctl: &Control{auth: &msg.Auth{User: token}},
+		}
+
+		var err error
+		if tun.filter, err = ipfilter.New(nil, deny); err != nil {
+			t.Fatal(err)
+		}
+
+		if user != "" {
+			hashed, err := httpauth.Hash(user + ":secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tun.auth, err = httpauth.NewVerifier([]string{hashed}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return tun
+	}
+
+	const url = "https://demo.example.com"
+	r := NewTunnelRegistry(16, "", 0)
+	first := member("token", "alice", "10.0.0.0/8")
+	if err := r.Register(url, first); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		tunnel  *Tunnel
+		wantErr bool
+	}{
+		{"same settings", member("token", "alice", "10.0.0.0/8"), false},
+		{"another token", member("other", "alice", "10.0.0.0/8"), true},
+		{"another http auth user", member("token", "bob", "10.0.0.0/8"), true},
+		{"no http auth", member("token", "", "10.0.0.0/8"), true},
+		{"other IP filters", member("token", "alice", "192.168.0.0/16"), true},
+		{"no IP filters", member("token", "alice"), true},
+	}
+
+	for _, tt := range tests {
+		err := r.Register(url, tt.tunnel)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+
+		// members use the first member's credentials and filters
+		if err == nil && (tt.tunnel.auth != first.auth || tt.tunnel.filter != first.filter) {
+			t.Errorf("%s: the member doesn't use the pool's edge settings", tt.name)
+		}
+	}
+
+	if err := r.Register("https://open.example.com", member("", "")); err == nil {
+		t.Errorf("a pool without an auth token was registered")
+	}
+}
+
+func TestPortAllocator(t *testing.T) {
+	store, err := reservations.Open(filepath.Join(t.TempDir(), "reservations.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Reserve(reservations.TcpPort, "47312", "other", false); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(saved *reservations.Store) { reservationStore = saved }(reservationStore)
+	reservationStore = store
+
+	a, err := newPortAllocator("tcp", "127.0.0.1", "47311-47313")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the reserved port is never handed out to another token
+	var listeners []*net.TCPListener
+	for i := 0; i < 2; i++ {
+		l, err := a.ListenTCP(0, "token")
+		if err != nil {
+			t.Fatalf("allocation %d: %v", i, err)
+		}
+		defer l.Close()
+
+		if l.Addr().(*net.TCPAddr).Port == 47312 {
+			t.Errorf("allocated the port reserved for another token")
+		}
+		listeners = append(listeners, l)
+	}
+
+	if _, err = a.ListenTCP(0, "token"); err == nil {
+		t.Errorf("allocated a port of a full range")
+	}
+
+	// the owner of the reservation gets it
+	l, err := a.ListenTCP(0, "other")
+	if err != nil {
+		t.Fatalf("allocation for the owner of the reservation: %v", err)
+	}
+	defer l.Close()
+
+	// a released port is free again
+	port := listeners[0].Addr().(*net.TCPAddr).Port
+	listeners[0].Close()
+	a.Release(port)
+
+	if l, err = a.ListenTCP(0, "token"); err != nil {
+		t.Fatalf("allocation after a release: %v", err)
+	}
+	defer l.Close()
+
+	if got := l.Addr().(*net.TCPAddr).Port; got != port {
+		t.Errorf("allocated port %d, want the released %d", got, port)
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/reservations"
+)
+
+const reservationsUsage = `Usage: ngrokd reservations [-file=PATH] COMMAND
+
+Commands:
+  list                         List the reservations
+  add KIND NAME TOKEN          Reserve a name for an auth token
+  remove KIND NAME             Remove a reservation
+
+KIND is subdomain, hostname, tcp_port or udp_port.
+`
+
+// reservationsCommand runs the admin commands which manage reservations,
+// e.g. ngrokd reservations add subdomain api TOKEN
+func reservationsCommand(args []string) int {
+	fs := flag.NewFlagSet("reservations", flag.ExitOnError)
+	file := fs.String("file", "reservations.json", "Path to the reservations file")
+	force := fs.Bool("force", false, "Take over a name reserved for another token")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, reservationsUsage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	fail := func(err error) int {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	store, err := reservations.Open(*file)
+	if err != nil {
+		return fail(err)
+	}
+
+	args = fs.Args()
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		list, err := store.List()
+		if err != nil {
+			return fail(err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "KIND\tNAME\tTOKEN HASH\tCREATED")
+		for _, r := range list {
+			fmt.Fprintf(w, "%s\t%s\t%.12s\t%s\n", r.Kind, r.Name, r.TokenHash, r.Created.Format("2006-01-02 15:04:05"))
+		}
+		w.Flush()
+
+	case len(args) == 4 && args[0] == "add":
+		r, err := store.Reserve(args[1], args[2], args[3], *force)
+		if err != nil {
+			return fail(err)
+		}
+		fmt.Printf("Reserved %s %s\n", r.Kind, r.Name)
+
+	case len(args) == 3 && args[0] == "remove":
+		if err := store.Release(args[1], args[2]); err != nil {
+			return fail(err)
+		}
+		fmt.Printf("Removed the reservation of %s %s\n", args[1], args[2])
+
+	default:
+		fs.Usage()
+		return 2
+	}
+	return 0
+}
@@ -1,17 +1,20 @@
 package server
 
 import (
-	"encoding/base64"
 	"fmt"
 	"github.com/inconshreveable/ngrok/src/ngrok/conn"
+	"github.com/inconshreveable/ngrok/src/ngrok/httpauth"
+	"github.com/inconshreveable/ngrok/src/ngrok/ipfilter"
 	"github.com/inconshreveable/ngrok/src/ngrok/log"
 	"github.com/inconshreveable/ngrok/src/ngrok/msg"
+	"github.com/inconshreveable/ngrok/src/ngrok/reservations"
 	"github.com/inconshreveable/ngrok/src/ngrok/util"
 	"math/rand"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -39,6 +42,14 @@ type Tunnel struct {
 	// tcp listener
 	listener *net.TCPListener
 
+	// udp socket, and the proxy connection its datagrams are sent over
+	udpConn   *net.UDPConn
+	udpLock   sync.Mutex
+	udpStream conn.Conn
+
+	// when each peer last sent a datagram, replies go only to recent ones
+	udpPeers map[string]time.Time
+
 	// control connection
 	ctl *Control
 
@@ -47,6 +58,15 @@ type Tunnel struct {
 
 	// closing
 	closing int32
+
+	// public connections being handled, for least_conns pools
+	conns int64
+
+	// the addresses allowed to connect, nil for any
+	filter *ipfilter.Filter
+
+	// checks the http auth of requests, nil if the tunnel has none
+	auth *httpauth.Verifier
 }
 
 // Common functionality for registering virtually hosted protocols
@@ -70,10 +90,37 @@ func registerVhost(t *Tunnel, protocol string, servingPort int) (err error) {
 	// Canonicalize by always using lower-case
 	vhost = strings.ToLower(vhost)
 
+	// Pooled tunnels need a url the other members can ask for
+	if t.req.Pool != "" && t.req.Hostname == "" && t.req.Subdomain == "" {
+		return fmt.Errorf("Pooled tunnels must specify a hostname or subdomain")
+	}
+
+	// the same url can be asked for as a hostname or as a subdomain, so
+	// reservations are checked against the url itself
+	checkReserved := func(url string) error {
+		host := strings.TrimPrefix(url, protocol+"://")
+		hostname := host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			hostname = h
+		}
+
+		if err := reservationStore.Check(reservations.Hostname, hostname, t.ctl.auth.User); err != nil {
+			return err
+		}
+
+		if subdomain := strings.TrimSuffix(host, "."+vhost); subdomain != host {
+			return reservationStore.Check(reservations.Subdomain, subdomain, t.ctl.auth.User)
+		}
+		return nil
+	}
+
 	// Register for specific hostname
 	hostname := strings.ToLower(strings.TrimSpace(t.req.Hostname))
 	if hostname != "" {
 		t.url = fmt.Sprintf("%s://%s", protocol, hostname)
+		if err = checkReserved(t.url); err != nil {
+			return
+		}
 		return tunnelRegistry.Register(t.url, t)
 	}
 
@@ -81,13 +128,17 @@ func registerVhost(t *Tunnel, protocol string, servingPort int) (err error) {
 	subdomain := strings.ToLower(strings.TrimSpace(t.req.Subdomain))
 	if subdomain != "" {
 		t.url = fmt.Sprintf("%s://%s.%s", protocol, subdomain, vhost)
+		if err = checkReserved(t.url); err != nil {
+			return
+		}
 		return tunnelRegistry.Register(t.url, t)
 	}
 
-	// Register for random URL
+	// Register for random URL, the one from the affinity cache may have
+	// been reserved since
 	t.url, err = tunnelRegistry.RegisterRepeat(func() string {
 		return fmt.Sprintf("%s://%x.%s", protocol, rand.Int31(), vhost)
-	}, t)
+	}, checkReserved, t)
 
 	return
 }
@@ -102,60 +153,48 @@ func NewTunnel(m *msg.ReqTunnel, ctl *Control) (t *Tunnel, err error) {
 		Logger: log.NewPrefixLogger(),
 	}
 
+	if t.filter, err = ipfilter.New(m.IpAllow, m.IpDeny); err != nil {
+		return
+	}
+
+	// older clients send their http auth in plaintext, hash it like
+	// newer ones do so it isn't kept around
+	credentials := m.HttpAuthUsers
+	if m.HttpAuth != "" {
+		var hashed string
+		if hashed, err = httpauth.Hash(m.HttpAuth); err != nil {
+			return
+		}
+		credentials = append(credentials, hashed)
+		m.HttpAuth = ""
+	}
+
+	if t.auth, err = httpauth.NewVerifier(credentials); err != nil {
+		return
+	}
+
 	proto := t.req.Protocol
 	switch proto {
 	case "tcp":
-		bindTcp := func(port int) error {
-			if t.listener, err = net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("0.0.0.0"), Port: port}); err != nil {
-				err = t.ctl.conn.Error("Error binding TCP listener: %v", err)
-				return err
-			}
-
-			// create the url
-			addr := t.listener.Addr().(*net.TCPAddr)
-			t.url = fmt.Sprintf("tcp://%s:%d", opts.domain, addr.Port)
-
-			// register it
-			if err = tunnelRegistry.RegisterAndCache(t.url, t); err != nil {
-				// This should never be possible because the OS will
-				// only assign available ports to us.
-				t.listener.Close()
-				err = fmt.Errorf("TCP listener bound, but failed to register %s", t.url)
-				return err
-			}
+		if t.req.Pool != "" {
+			err = fmt.Errorf("Only http and https tunnels can be pooled")
+			return
+		}
 
-			go t.listenTcp(t.listener)
-			return nil
+		if err = t.bindTcp(); err != nil {
+			t.ctl.conn.Warn("Failed to bind TCP tunnel: %v", err)
 		}
+		return
 
-		// use the custom remote port you asked for
-		if t.req.RemotePort != 0 {
-			bindTcp(int(t.req.RemotePort))
+	case "udp":
+		if t.req.Pool != "" {
+			err = fmt.Errorf("Only http and https tunnels can be pooled")
 			return
 		}
 
-		// try to return to you the same port you had before
-		cachedUrl := tunnelRegistry.GetCachedRegistration(t)
-		if cachedUrl != "" {
-			var port int
-			parts := strings.Split(cachedUrl, ":")
-			portPart := parts[len(parts)-1]
-			port, err = strconv.Atoi(portPart)
-			if err != nil {
-				t.ctl.conn.Error("Failed to parse cached url port as integer: %s", portPart)
-			} else {
-				// we have a valid, cached port, let's try to bind with it
-				if bindTcp(port) != nil {
-					t.ctl.conn.Warn("Failed to get custom port %d: %v, trying a random one", port, err)
-				} else {
-					// success, we're done
-					return
-				}
-			}
+		if err = t.bindUdp(); err != nil {
+			t.ctl.conn.Warn("Failed to bind UDP tunnel: %v", err)
 		}
-
-		// Bind for TCP connections
-		bindTcp(0)
 		return
 
 	case "http", "https":
@@ -174,18 +213,77 @@ func NewTunnel(m *msg.ReqTunnel, ctl *Control) (t *Tunnel, err error) {
 		return
 	}
 
-	// pre-encode the http basic auth for fast comparisons later
-	if m.HttpAuth != "" {
-		m.HttpAuth = "Basic " + base64.StdEncoding.EncodeToString([]byte(m.HttpAuth))
-	}
-
 	t.AddLogPrefix(t.Id())
-	t.Info("Registered new tunnel on: %s", t.ctl.conn.Id())
+	if t.req.Pool != "" {
+		t.Info("Registered new tunnel on: %s in pool %s", t.ctl.conn.Id(), t.req.Pool)
+	} else {
+		t.Info("Registered new tunnel on: %s", t.ctl.conn.Id())
+	}
 
 	metrics.OpenTunnel(t)
 	return
 }
 
+// bindTcp listens for public connections on the port the client asked for,
+// or else the one it had before, or else any free one
+func (t *Tunnel) bindTcp() (err error) {
+	token := t.ctl.auth.User
+
+	if t.req.RemotePort != 0 {
+		// use the custom remote port you asked for
+		if t.listener, err = tcpPorts.ListenTCP(int(t.req.RemotePort), token); err != nil {
+			return
+		}
+	} else {
+		// try to return to you the same port you had before
+		if port := t.cachedPort(); port != 0 {
+			if t.listener, err = tcpPorts.ListenTCP(port, token); err != nil {
+				t.ctl.conn.Warn("Failed to get custom port %d: %v, trying a random one", port, err)
+			}
+		}
+
+		if t.listener == nil {
+			if t.listener, err = tcpPorts.ListenTCP(0, token); err != nil {
+				return
+			}
+		}
+	}
+
+	// create the url
+	addr := t.listener.Addr().(*net.TCPAddr)
+	t.url = fmt.Sprintf("tcp://%s:%d", opts.domain, addr.Port)
+
+	// register it
+	if err = tunnelRegistry.RegisterAndCache(t.url, t); err != nil {
+		// This should never be possible because the OS will
+		// only assign available ports to us.
+		t.listener.Close()
+		tcpPorts.Release(addr.Port)
+		t.listener = nil
+		return fmt.Errorf("TCP listener bound, but failed to register %s", t.url)
+	}
+
+	go t.listenTcp(t.listener)
+	return nil
+}
+
+// the port this client's tunnel had before, or 0
+func (t *Tunnel) cachedPort() int {
+	cachedUrl := tunnelRegistry.GetCachedRegistration(t)
+	if cachedUrl == "" {
+		return 0
+	}
+
+	parts := strings.Split(cachedUrl, ":")
+	portPart := parts[len(parts)-1]
+	port, err := strconv.Atoi(portPart)
+	if err != nil {
+		t.ctl.conn.Error("Failed to parse cached url port as integer: %s", portPart)
+		return 0
+	}
+	return port
+}
+
 func (t *Tunnel) Shutdown() {
 	t.Info("Shutting down")
 
@@ -195,10 +293,18 @@ func (t *Tunnel) Shutdown() {
 	// if we have a public listener (this is a raw TCP tunnel), shut it down
 	if t.listener != nil {
 		t.listener.Close()
+		tcpPorts.Release(t.listener.Addr().(*net.TCPAddr).Port)
+	}
+
+	// likewise for the socket of a UDP tunnel
+	if t.udpConn != nil {
+		t.udpConn.Close()
+		t.closeUdpStream()
+		udpPorts.Release(t.udpConn.LocalAddr().(*net.UDPAddr).Port)
 	}
 
 	// remove ourselves from the tunnel registry
-	tunnelRegistry.Del(t.url)
+	tunnelRegistry.Del(t.url, t)
 
 	// let the control connection know we're shutting down
 	// currently, only the control connection shuts down tunnels,
@@ -234,6 +340,20 @@ func (t *Tunnel) listenTcp(listener *net.TCPListener) {
 			continue
 		}
 
+		// connections from a load balancer start with a PROXY header,
+		// which is read without holding up the others. They're filtered
+		// by the client address it names, not the load balancer's.
+		if trustedProxies.Contains(tcpConn.RemoteAddr()) {
+			go t.acceptProxied(tcpConn)
+			continue
+		}
+
+		if !t.admits(tcpConn.RemoteAddr()) {
+			t.Info("Refused connection from %v", tcpConn.RemoteAddr())
+			tcpConn.Close()
+			continue
+		}
+
 		conn := conn.Wrap(tcpConn, "pub")
 		conn.AddLogPrefix(t.Id())
 		conn.Info("New connection from %v", conn.RemoteAddr())
@@ -242,6 +362,25 @@ func (t *Tunnel) listenTcp(listener *net.TCPListener) {
 	}
 }
 
+func (t *Tunnel) acceptProxied(tcpConn *net.TCPConn) {
+	publicConn, err := conn.WrapProxied(tcpConn, "pub", trustedProxies)
+	if err != nil {
+		t.Warn("Failed to read PROXY header from %v: %v", tcpConn.RemoteAddr(), err)
+		tcpConn.Close()
+		return
+	}
+
+	publicConn.AddLogPrefix(t.Id())
+	if !t.admits(publicConn.RemoteAddr()) {
+		publicConn.Info("Refused connection from %v", publicConn.RemoteAddr())
+		publicConn.Close()
+		return
+	}
+
+	publicConn.Info("New connection from %v", publicConn.RemoteAddr())
+	t.HandlePublicConnection(publicConn)
+}
+
 func (t *Tunnel) HandlePublicConnection(publicConn conn.Conn) {
 	defer publicConn.Close()
 	defer func() {
@@ -253,6 +392,9 @@ func (t *Tunnel) HandlePublicConnection(publicConn conn.Conn) {
 	startTime := time.Now()
 	metrics.OpenConnection(t, publicConn)
 
+	atomic.AddInt64(&t.conns, 1)
+	defer atomic.AddInt64(&t.conns, -1)
+
 	var proxyConn conn.Conn
 	var err error
 	for i := 0; i < (2 * proxyMaxPoolSize); i++ {
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/conn"
+	"github.com/inconshreveable/ngrok/src/ngrok/log"
+	"github.com/inconshreveable/ngrok/src/ngrok/msg"
+	"github.com/inconshreveable/ngrok/src/ngrok/udp"
+	"github.com/inconshreveable/ngrok/src/ngrok/util"
+)
+
+// how many datagrams may wait to be forwarded while the proxy connection
+// they're sent over is started
+const udpQueueSize = 256
+
+// a datagram from a peer, queued to be sent to the client
+type udpDatagram struct {
+	peer    string
+	payload []byte
+}
+
+// bindUdp binds the port the client asked for, or else the one it had
+// before, or else any free one
+func (t *Tunnel) bindUdp() (err error) {
+	token := t.ctl.auth.User
+
+	if t.req.RemotePort != 0 {
+		if t.udpConn, err = udpPorts.ListenUDP(int(t.req.RemotePort), token); err != nil {
+			return
+		}
+	} else {
+		if port := t.cachedPort(); port != 0 {
+			if t.udpConn, err = udpPorts.ListenUDP(port, token); err != nil {
+				t.ctl.conn.Warn("Failed to get custom port %d: %v, trying a random one", port, err)
+			}
+		}
+
+		if t.udpConn == nil {
+			if t.udpConn, err = udpPorts.ListenUDP(0, token); err != nil {
+				return
+			}
+		}
+	}
+
+	addr := t.udpConn.LocalAddr().(*net.UDPAddr)
+	t.url = fmt.Sprintf("udp://%s:%d", opts.domain, addr.Port)
+
+	if err = tunnelRegistry.RegisterAndCache(t.url, t); err != nil {
+		t.udpConn.Close()
+		udpPorts.Release(addr.Port)
+		t.udpConn = nil
+		return fmt.Errorf("UDP socket bound, but failed to register %s", t.url)
+	}
+
+	datagrams := make(chan udpDatagram, udpQueueSize)
+	go t.listenUdp(t.udpConn, datagrams)
+	go t.forwardUdp(datagrams)
+	return nil
+}
+
+// Reads datagrams from the internet and queues them to be sent to the
+// client. Starting a proxy connection takes a round trip to the client, so
+// that's left to forwardUdp and the socket is read meanwhile.
+func (t *Tunnel) listenUdp(udpConn *net.UDPConn, datagrams chan udpDatagram) {
+	defer close(datagrams)
+	defer func() {
+		if r := recover(); r != nil {
+			log.Warn("listenUdp failed with error %v", r)
+		}
+	}()
+
+	buf := make([]byte, udp.MaxDatagram)
+	for {
+		n, addr, err := udpConn.ReadFromUDP(buf)
+		if err != nil {
+			// not an error, we're shutting down this tunnel
+			if atomic.LoadInt32(&t.closing) == 1 {
+				return
+			}
+
+			t.Error("Failed to read UDP datagram: %v", err)
+			continue
+		}
+
+		if !t.admits(addr) {
+			t.Debug("Dropping datagram from %v, which isn't allowed", addr)
+			continue
+		}
+
+		if !t.udpPeerSent(addr.String()) {
+			t.Debug("Dropping datagram from %v, there are %d peers already", addr, udp.MaxSessions)
+			continue
+		}
+
+		select {
+		case datagrams <- udpDatagram{peer: addr.String(), payload: append([]byte(nil), buf[:n]...)}:
+		default:
+			t.Debug("Dropping datagram from %v, %d are waiting to be forwarded", addr, udpQueueSize)
+		}
+	}
+}
+
+// Sends the queued datagrams to the client, tagged with the address of the
+// peer which sent them, until the tunnel's socket is closed.
+func (t *Tunnel) forwardUdp(datagrams chan udpDatagram) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Warn("forwardUdp failed with error %v", r)
+		}
+	}()
+
+	for d := range datagrams {
+		stream, err := t.getUdpStream()
+		if err != nil {
+			t.Warn("Dropping datagram from %s: %v", d.peer, err)
+			continue
+		}
+
+		// datagrams are written from this goroutine only
+		if err = udp.WriteFrame(stream, d.peer, d.payload); err != nil {
+			stream.Warn("Failed to forward datagram from %s: %v", d.peer, err)
+			t.closeUdpStream()
+		}
+	}
+}
+
+// getUdpStream returns the proxy connection which carries the tunnel's
+// datagrams, starting a new one if there's none yet or the last one failed
+func (t *Tunnel) getUdpStream() (conn.Conn, error) {
+	t.udpLock.Lock()
+	defer t.udpLock.Unlock()
+
+	if t.udpStream != nil {
+		return t.udpStream, nil
+	}
+
+	proxyConn, err := t.ctl.GetProxy()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get proxy connection: %v", err)
+	}
+	proxyConn.AddLogPrefix(t.Id())
+
+	// the datagrams carry the peer addresses, so there's no client address
+	if err = msg.WriteMsg(proxyConn, &msg.StartProxy{Url: t.url}); err != nil {
+		proxyConn.Close()
+		return nil, fmt.Errorf("Failed to write StartProxyMessage: %v", err)
+	}
+
+	// replace the proxy connection we took from the pool
+	util.PanicToError(func() { t.ctl.out <- &msg.ReqProxy{} })
+
+	proxyConn.SetDeadline(time.Time{})
+	t.udpStream = proxyConn
+	t.Info("Sending datagrams over proxy connection %s", proxyConn.Id())
+
+	go t.udpReplies(proxyConn)
+	return proxyConn, nil
+}
+
+// Sends the replies of the client's service back to the peers they're for.
+func (t *Tunnel) udpReplies(stream conn.Conn) {
+	defer func() {
+		if r := recover(); r != nil {
+			stream.Warn("udpReplies failed with error %v", r)
+		}
+	}()
+
+	rd := bufio.NewReader(stream)
+	for {
+		peer, payload, err := udp.ReadFrame(rd)
+		if err != nil {
+			if atomic.LoadInt32(&t.closing) == 0 {
+				stream.Debug("Datagram stream closed: %v", err)
+			}
+			t.dropUdpStream(stream)
+			return
+		}
+
+		// the tunnel is no open relay, it only answers peers which sent it
+		// datagrams recently
+		if !t.udpPeerActive(peer) {
+			stream.Debug("Dropping datagram to %s, which isn't a recent peer", peer)
+			continue
+		}
+
+		addr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			stream.Warn("Invalid peer address %s: %v", peer, err)
+			continue
+		}
+
+		if _, err = t.udpConn.WriteToUDP(payload, addr); err != nil {
+			stream.Debug("Failed to send datagram to %v: %v", addr, err)
+		}
+	}
+}
+
+// udpPeerSent records a datagram from peer, it reports false if the peer is
+// new and the tunnel already has as many peers as the client has sessions
+func (t *Tunnel) udpPeerSent(peer string) bool {
+	t.udpLock.Lock()
+	defer t.udpLock.Unlock()
+
+	now := time.Now()
+	if t.udpPeers == nil {
+		t.udpPeers = make(map[string]time.Time)
+	}
+
+	if _, ok := t.udpPeers[peer]; !ok && len(t.udpPeers) >= udp.MaxSessions {
+		// forget the peers whose sessions have timed out
+		for p, last := range t.udpPeers {
+			if now.Sub(last) >= udp.DefaultIdleTimeout {
+				delete(t.udpPeers, p)
+			}
+		}
+
+		if len(t.udpPeers) >= udp.MaxSessions {
+			return false
+		}
+	}
+
+	t.udpPeers[peer] = now
+	return true
+}
+
+// udpPeerActive reports whether peer sent a datagram within the time a
+// client keeps its session open
+func (t *Tunnel) udpPeerActive(peer string) bool {
+	t.udpLock.Lock()
+	defer t.udpLock.Unlock()
+
+	last, ok := t.udpPeers[peer]
+	return ok && time.Since(last) < udp.DefaultIdleTimeout
+}
+
+// closeUdpStream closes the current datagram stream, a new one is started
+// for the next datagram
+func (t *Tunnel) closeUdpStream() {
+	t.udpLock.Lock()
+	stream := t.udpStream
+	t.udpStream = nil
+	t.udpLock.Unlock()
+
+	if stream != nil {
+		stream.Close()
+	}
+}
+
+// dropUdpStream forgets a stream which failed, unless it's already been
+// replaced
+func (t *Tunnel) dropUdpStream(stream conn.Conn) {
+	t.udpLock.Lock()
+	if t.udpStream == stream {
+		t.udpStream = nil
+	}
+	t.udpLock.Unlock()
+
+	stream.Close()
+}
@@ -0,0 +1,252 @@
+// Datagrams of UDP tunnels
+//
+// A UDP tunnel carries the datagrams of all of its remote peers over a
+// single proxy connection. Since that's a stream, each datagram is framed
+// and tagged with the address of the peer which sent it, or which it's
+// sent back to:
+//
+//	uint16 address length | address | uint16 payload length | payload
+//
+// with the lengths in big endian.
+package udp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/inconshreveable/ngrok/src/ngrok/log"
+)
+
+const (
+	// the largest payload of a UDP datagram
+	MaxDatagram = 65535
+
+	// how long a peer's session lasts without any datagrams
+	DefaultIdleTimeout = 2 * time.Minute
+
+	// how many peers a tunnel relays the datagrams of at once, each has a
+	// local socket on the client
+	MaxSessions = 1024
+)
+
+var errTooManySessions = fmt.Errorf("Too many sessions")
+
+// WriteFrame writes a datagram to or from addr with a single Write, so
+// frames from concurrent writers don't interleave as long as they're
+// serialized by the caller
+func WriteFrame(w io.Writer, addr string, payload []byte) error {
+	if len(addr) > 0xffff || len(payload) > MaxDatagram {
+		return fmt.Errorf("Datagram of %d bytes from %s is too large", len(payload), addr)
+	}
+
+	buf := make([]byte, 0, 4+len(addr)+len(payload))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(addr)))
+	buf = append(buf, addr...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(payload)))
+	buf = append(buf, payload...)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame reads the next datagram and the address it's tagged with
+func ReadFrame(r io.Reader) (addr string, payload []byte, err error) {
+	var n uint16
+	if err = binary.Read(r, binary.BigEndian, &n); err != nil {
+		return
+	}
+
+	a := make([]byte, n)
+	if _, err = io.ReadFull(r, a); err != nil {
+		return
+	}
+
+	if err = binary.Read(r, binary.BigEndian, &n); err != nil {
+		return
+	}
+
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	return string(a), payload, nil
+}
+
+// Forwarder relays the datagrams of a tunnel to a local UDP service. Each
+// remote peer gets its own local socket, so the service's replies can be
+// sent back to the peer they're for. A peer's socket is closed after it's
+// been idle for a while.
+type Forwarder struct {
+	log.Logger
+
+	local string
+	idle  time.Duration
+
+	lock     sync.Mutex
+	sessions map[string]*session
+
+	// serializes the frames written back over the stream
+	writeLock sync.Mutex
+
+	// bytes of the replies sent back, accessed atomically
+	bytesOut int64
+}
+
+type session struct {
+	conn *net.UDPConn
+
+	// unix nanoseconds of the last datagram in either direction
+	lastActive int64
+}
+
+func NewForwarder(localAddr string, idle time.Duration) *Forwarder {
+	if idle <= 0 {
+		idle = DefaultIdleTimeout
+	}
+
+	return &Forwarder{
+		Logger:   log.NewPrefixLogger("udp", localAddr),
+		local:    localAddr,
+		idle:     idle,
+		sessions: make(map[string]*session),
+	}
+}
+
+// Sessions returns how many peers have an open session
+func (f *Forwarder) Sessions() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.sessions)
+}
+
+// Serve relays the datagrams read from stream to the local service, and its
+// replies back over the stream, until the stream fails. It returns how many
+// bytes it forwarded in each direction.
+func (f *Forwarder) Serve(stream io.ReadWriter) (bytesIn, bytesOut int64) {
+	defer f.closeAll()
+
+	rd := bufio.NewReader(stream)
+	for {
+		addr, payload, err := ReadFrame(rd)
+		if err != nil {
+			if err != io.EOF {
+				f.Debug("Failed to read datagram: %v", err)
+			}
+			return bytesIn, atomic.LoadInt64(&f.bytesOut)
+		}
+
+		s, err := f.session(addr, stream)
+		if err == errTooManySessions {
+			f.Debug("Dropping datagram from %s, there are %d sessions already", addr, MaxSessions)
+			continue
+		} else if err != nil {
+			f.Warn("Failed to open a session for %s: %v", addr, err)
+			continue
+		}
+
+		s.touch()
+		if _, err = s.conn.Write(payload); err != nil {
+			f.Debug("Failed to forward datagram from %s: %v", addr, err)
+			continue
+		}
+		bytesIn += int64(len(payload))
+	}
+}
+
+// session returns the session of a peer, opening one if needed and there
+// are fewer than MaxSessions
+func (f *Forwarder) session(addr string, stream io.Writer) (*session, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if s, ok := f.sessions[addr]; ok {
+		return s, nil
+	}
+
+	if len(f.sessions) >= MaxSessions {
+		return nil, errTooManySessions
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", f.local)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &session{conn: c}
+	s.touch()
+	f.sessions[addr] = s
+	f.Info("New session for %s", addr)
+
+	go f.replies(addr, s, stream)
+	return s, nil
+}
+
+// replies sends the local service's datagrams for a peer back over the
+// stream until the session is idle for too long
+func (f *Forwarder) replies(addr string, s *session, stream io.Writer) {
+	defer f.remove(addr, s)
+
+	buf := make([]byte, MaxDatagram)
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(f.idle))
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if time.Since(s.active()) < f.idle {
+					continue
+				}
+				f.Info("Closing session for %s after %v idle", addr, f.idle)
+			}
+			return
+		}
+
+		s.touch()
+		f.writeLock.Lock()
+		err = WriteFrame(stream, addr, buf[:n])
+		f.writeLock.Unlock()
+		if err != nil {
+			f.Debug("Failed to send datagram to %s: %v", addr, err)
+			return
+		}
+		atomic.AddInt64(&f.bytesOut, int64(n))
+	}
+}
+
+func (f *Forwarder) remove(addr string, s *session) {
+	s.conn.Close()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.sessions[addr] == s {
+		delete(f.sessions, addr)
+	}
+}
+
+func (f *Forwarder) closeAll() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for addr, s := range f.sessions {
+		s.conn.Close()
+		delete(f.sessions, addr)
+	}
+}
+
+func (s *session) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *session) active() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastActive))
+}
@@ -44,3 +44,10 @@ func (r *Ring) Slice() []interface{} {
 
 	return items
 }
+
+func (r *Ring) Clear() {
+	r.Lock()
+	defer r.Unlock()
+
+	r.Init()
+}
@@ -41,3 +41,13 @@ func (s *Shutdown) Complete() {
 func (s *Shutdown) WaitComplete() {
 	<-s.complete
 }
+
+// Begun reports whether the shutdown has begun, without waiting for it
+func (s *Shutdown) Begun() bool {
+	select {
+	case <-s.begin:
+		return true
+	default:
+		return false
+	}
+}